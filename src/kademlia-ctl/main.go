@@ -0,0 +1,120 @@
+package main
+
+// Runs shell commands on a node started with a control socket. The command
+// is taken from the arguments, or, without any, one per line from stdin until
+// one fails. Exits with status 1 if a command fails. @path arguments are
+// made absolute first, since the node resolves them in its own directory.
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+import (
+	"shell"
+)
+
+// The messages of the control socket; see shell/control.go.
+type controlRequest struct {
+	Line string `json:"line"`
+	JSON bool   `json:"json"`
+}
+
+type controlResponse struct {
+	Output string `json:"output"`
+	OK     bool   `json:"ok"`
+}
+
+func main() {
+	socket := flag.String("socket", "", "the node's control socket `path` (default data-dir/control.sock)")
+	dataDir := flag.String("data-dir", "", "the node's data `dir`")
+	jsonOutput := flag.Bool("json", false, "print the result of each command as a JSON object")
+	flag.Parse()
+	path := *socket
+	if path == "" && *dataDir != "" {
+		path = *dataDir + "/control.sock"
+	}
+	if path == "" {
+		log.Fatal("usage: kademlia-ctl -socket path | -data-dir dir [command [args ...]]\n")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	run := func(line string) bool {
+		if err := enc.Encode(controlRequest{line, *jsonOutput}); err != nil {
+			log.Fatal(err)
+		}
+		var res controlResponse
+		if err := dec.Decode(&res); err != nil {
+			log.Fatal(err)
+		}
+		if res.Output != "" {
+			fmt.Println(res.Output)
+		}
+		return res.OK
+	}
+
+	if flag.NArg() > 0 {
+		if !run(quoteArgs(absPaths(flag.Args()))) {
+			os.Exit(1)
+		}
+		return
+	}
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for in.Scan() {
+		line := strings.TrimSpace(in.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "quit" {
+			return
+		}
+		if args, err := shell.SplitLine(line); err == nil {
+			line = quoteArgs(absPaths(args))
+		}
+		if !run(line) {
+			os.Exit(1)
+		}
+	}
+	if err := in.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// The command line that gives the shell args as they are, whatever spaces,
+// quotes or other bytes they hold.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = strconv.Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// args with each @path argument made absolute.
+func absPaths(args []string) []string {
+	ret := make([]string, len(args))
+	for i, arg := range args {
+		ret[i] = arg
+		if strings.HasPrefix(arg, "@") {
+			if path, err := filepath.Abs(arg[1:]); err == nil {
+				ret[i] = "@" + path
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestQuoteArgs(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"whoami"}, `"whoami"`},
+		{[]string{"put", "a name", "it's \"quoted\""}, `"put" "a name" "it's \"quoted\""`},
+		{[]string{"put", "", "two\nlines"}, `"put" "" "two\nlines"`},
+		{[]string{"put", "x", "\xff\x00"}, `"put" "x" "\xff\x00"`},
+	} {
+		if got := quoteArgs(test.args); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestAbsPaths(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"put", "key", "@value.txt"}
+	want := []string{"put", "key", "@" + filepath.Join(wd, "value.txt")}
+	if got := absPaths(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("%q: got %q, want %q", args, got, want)
+	}
+	for _, args := range [][]string{
+		{"get", "key", "@/tmp/out"},
+		{"put", "key", "text:@value.txt"},
+		{"put", "key", "base64:aGVsbG8="},
+	} {
+		if got := absPaths(args); !reflect.DeepEqual(got, args) {
+			t.Errorf("%q: got %q", args, got)
+		}
+	}
+}
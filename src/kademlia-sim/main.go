@@ -0,0 +1,41 @@
+package main
+
+// Runs the network simulator and prints its report.
+
+import (
+	"flag"
+	"os"
+	"time"
+)
+
+import (
+	"simulator"
+)
+
+func main() {
+	conf := simulator.DefaultConfig()
+	flag.Int64Var(&conf.Seed, "seed", conf.Seed, "random seed")
+	flag.IntVar(&conf.Nodes, "nodes", conf.Nodes, "initial number of nodes")
+	flag.DurationVar(&conf.Duration, "duration", conf.Duration, "virtual time to simulate")
+	minLatency := flag.Duration("min-latency", 10*time.Millisecond, "minimum one-way latency")
+	maxLatency := flag.Duration("max-latency", 100*time.Millisecond, "maximum one-way latency")
+	coordinates := flag.Bool("coordinates", false, "derive latencies from distances between synthetic node positions")
+	flag.Float64Var(&conf.LossRate, "loss", conf.LossRate, "probability that a call is lost")
+	flag.DurationVar(&conf.RPCTimeout, "timeout", conf.RPCTimeout, "time a lost call takes to fail")
+	flag.Float64Var(&conf.JoinRate, "join-rate", conf.JoinRate, "joins per virtual second")
+	flag.Float64Var(&conf.LeaveRate, "leave-rate", conf.LeaveRate, "leaves per virtual second")
+	flag.Float64Var(&conf.LookupRate, "lookup-rate", conf.LookupRate, "lookups per virtual second")
+	flag.IntVar(&conf.VDOs, "vdos", conf.VDOs, "VDOs published at the start")
+	flag.DurationVar(&conf.SampleInterval, "sample", conf.SampleInterval, "time between samples")
+	flag.BoolVar(&conf.Node.Proximity, "proximity", false, "use proximity neighbor selection")
+	sign := flag.Bool("sign", false, "sign messages as real nodes do, at several times the CPU cost")
+	flag.Parse()
+	conf.Node.Unsigned = !*sign
+	if *coordinates {
+		conf.Latency = simulator.CoordinateLatency{Base: *minLatency, PerUnit: *maxLatency - *minLatency}
+	} else {
+		conf.Latency = simulator.UniformLatency{Min: *minLatency, Max: *maxLatency}
+	}
+
+	simulator.New(conf).Run().WriteReport(os.Stdout)
+}
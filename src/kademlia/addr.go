@@ -0,0 +1,162 @@
+package kademlia
+
+// Contains address handling for IPv4, IPv6 and dual-stack nodes: which
+// addresses a node listens on and advertises, and which of a contact's
+// addresses to dial.
+
+import (
+	"errors"
+	"net"
+)
+
+var ErrNoRoute = errors.New("no address in a reachable family")
+
+// All the addresses of c, the preferred one first.
+func (c *Contact) Addresses() []net.IP {
+	ret := make([]net.IP, 0, 1+len(c.AltHosts))
+	if c.Host != nil {
+		ret = append(ret, c.Host)
+	}
+	return append(ret, c.AltHosts...)
+}
+
+// The hosts to listen on for laddr. A name listens on every address it
+// resolves to, IPv4 first; an IP literal or an empty host, which means all
+// addresses, is used as is.
+func listenHosts(laddr string) (hosts []string, port string, err error) {
+	host, port, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return nil, "", err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{host}, port, nil
+	}
+	ips, err := lookupHost(host)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, ip := range ips {
+		hosts = append(hosts, ip.String())
+	}
+	return hosts, port, nil
+}
+
+// The addresses of hostname, IPv4 first.
+func lookupHost(hostname string) ([]net.IP, error) {
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else if ip != nil {
+			v6 = append(v6, ip)
+		}
+	}
+	return append(v4, v6...), nil
+}
+
+// The addresses to advertise for a node listening on addrs. An unspecified
+// address listens on both families, and stands for the machine's interface
+// addresses.
+func advertisedHosts(addrs []net.Addr) []net.IP {
+	ret := make([]net.IP, 0, len(addrs))
+	add := func(ip net.IP) {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, value := range ret {
+			if value.Equal(ip) {
+				return
+			}
+		}
+		ret = append(ret, ip)
+	}
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		if ip.IsUnspecified() {
+			for _, value := range interfaceHosts() {
+				add(value)
+			}
+		} else {
+			add(ip)
+		}
+	}
+	return ret
+}
+
+// The interface addresses of each family, IPv4 first. Loopback addresses are
+// only used for a family that has no others; link-local ones never are.
+func interfaceHosts() []net.IP {
+	var v4, v6, loop4, loop6 []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ip := ipnet.IP
+		switch {
+		case ip.To4() != nil && ip.IsLoopback():
+			loop4 = append(loop4, ip)
+		case ip.To4() != nil:
+			v4 = append(v4, ip)
+		case ip.IsLoopback():
+			loop6 = append(loop6, ip)
+		default:
+			v6 = append(v6, ip)
+		}
+	}
+	if len(v4) == 0 {
+		v4 = loop4
+	}
+	if len(v6) == 0 {
+		v6 = loop6
+	}
+	return append(v4, v6...)
+}
+
+// A copy of c whose Host is the first of its addresses in a family the
+// table's own node has an address in, and false if there is none.
+func (table *RoutingTable) route(c *Contact) (Contact, bool) {
+	var has4, has6 bool
+	self := table.Self()
+	for _, ip := range self.Addresses() {
+		if ip.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+	for _, ip := range c.Addresses() {
+		if (ip.To4() != nil && has4) || (ip.To4() == nil && has6) {
+			ret := *c
+			ret.Host = ip
+			return ret, true
+		}
+	}
+	return Contact{}, false
+}
+
+// Resolve hostname to an address the node can reach, preferring IPv4.
+func (k *Kademlia) ResolveHost(hostname string) (net.IP, error) {
+	ips, err := lookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+	dst, ok := k.Routes.route(&Contact{AltHosts: ips})
+	if !ok {
+		return nil, ErrNoRoute
+	}
+	return dst.Host, nil
+}
@@ -0,0 +1,102 @@
+package kademlia
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDest(t *testing.T) {
+	if d := Dest(net.ParseIP("127.0.0.1"), 7890); d != "127.0.0.1:7890" {
+		t.Error("IPv4 destination formatted as", d)
+	}
+	if d := Dest(net.ParseIP("::1"), 7890); d != "[::1]:7890" {
+		t.Error("IPv6 destination formatted as", d)
+	}
+}
+
+func TestIPv6Ping(t *testing.T) {
+	instance1 := NewKademlia("[::1]:13200")
+	instance2 := NewKademlia("[::1]:13201")
+	defer instance1.Close()
+	defer instance2.Close()
+	if !instance2.Routes.SelfContact.Host.Equal(net.ParseIP("::1")) {
+		t.Fatal("self contact has host", instance2.Routes.SelfContact.Host)
+	}
+
+	if resp := instance1.DoPing(net.ParseIP("::1"), 13201); resp[:2] != "OK" {
+		t.Fatal(resp)
+	}
+	if _, err := instance1.FindContact(instance2.NodeID); err != nil {
+		t.Error("Instance 2's contact not found in Instance 1's contact list")
+	}
+	instance2.ReadFromBuckets(0)
+	if _, err := instance2.FindContact(instance1.NodeID); err != nil {
+		t.Error("Instance 1's contact not found in Instance 2's contact list")
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	dual := NewKademlia("[::]:13202")
+	v4 := NewKademlia("127.0.0.1:13203")
+	v6 := NewKademlia("[::1]:13204")
+	defer dual.Close()
+	defer v4.Close()
+	defer v6.Close()
+
+	var has4, has6 bool
+	for _, ip := range dual.Routes.SelfContact.Addresses() {
+		if ip.IsUnspecified() {
+			t.Error("unspecified address advertised")
+		}
+		has4 = has4 || ip.To4() != nil
+		has6 = has6 || ip.To4() == nil
+	}
+	if !has4 || !has6 {
+		t.Fatal("dual-stack node advertises", dual.Routes.SelfContact.Addresses())
+	}
+
+	if resp := v4.DoPing(net.ParseIP("127.0.0.1"), 13202); resp[:2] != "OK" {
+		t.Fatal(resp)
+	}
+	if resp := v6.DoPing(net.ParseIP("::1"), 13202); resp[:2] != "OK" {
+		t.Fatal(resp)
+	}
+	dual.ReadFromBuckets(0)
+	if _, err := dual.FindContact(v4.NodeID); err != nil {
+		t.Error("dual-stack node did not add the IPv4 node")
+	}
+	if _, err := dual.FindContact(v6.NodeID); err != nil {
+		t.Error("dual-stack node did not add the IPv6 node")
+	}
+
+	// Each single-stack node reaches the dual-stack one over its own family,
+	// and never learns of the other.
+	c, err := v6.FindContact(dual.NodeID)
+	if err != nil {
+		t.Fatal("IPv6 node did not add the dual-stack node")
+	}
+	if resp := v6.DoFindNode(c, v4.NodeID); resp[:2] != "OK" {
+		t.Error(resp)
+	}
+	result := v6.IterativeFindNode(v4.NodeID, false)
+	for _, c := range result.Contacts() {
+		if c.NodeID == v4.NodeID {
+			t.Error("IPv6 node found the IPv4-only node")
+		}
+	}
+	v6.ReadFromBuckets(0)
+	if _, err := v6.FindContact(v4.NodeID); err == nil {
+		t.Error("IPv6 node added the IPv4-only node")
+	}
+	if _, err := v4.ResolveHost("::1"); err != ErrNoRoute {
+		t.Error("IPv4 node resolved an IPv6 address:", err)
+	}
+
+	c, err = v4.FindContact(dual.NodeID)
+	if err != nil {
+		t.Fatal("IPv4 node did not add the dual-stack node")
+	}
+	if resp := v4.DoFindNode(c, v6.NodeID); resp[:2] != "OK" {
+		t.Error(resp)
+	}
+}
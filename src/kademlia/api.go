@@ -0,0 +1,508 @@
+package kademlia
+
+// Contains the JSON API, served under /api/ on Config.APIAddr. It offers the
+// operations of the command line to other processes on the same machine; it
+// has no authentication, so it only listens on loopback addresses, and only
+// answers requests whose Host is a loopback address or localhost, which keeps
+// web pages from reaching it through DNS rebinding. IDs are hex strings and
+// values are base64, so any bytes can be stored. Requests are POSTed as JSON
+// objects of at most maxAPIBody bytes, with Content-Type application/json so
+// that browsers cannot send them cross-origin without asking; the routing
+// table dump is a GET. Errors come back as {"error": "..."} with a matching
+// status code.
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownContact = errors.New("unknown contact")
+	ErrValueNotFound  = errors.New("value not found")
+	ErrUnvanish       = errors.New("could not recover the data")
+	ErrUnknownVDO     = errors.New("unknown VDO")
+	ErrAPINotLoopback = errors.New("the API only listens on loopback addresses")
+)
+
+// The largest request body the API reads.
+const maxAPIBody = 1 << 20
+
+// A contact as the API shows it.
+type APIContact struct {
+	NodeID   string   `json:"node_id"`
+	Host     string   `json:"host"`
+	Port     uint16   `json:"port"`
+	AltHosts []string `json:"alt_hosts,omitempty"`
+}
+
+func apiContact(c Contact) APIContact {
+	ret := APIContact{NodeID: c.NodeID.AsString(), Port: c.Port}
+	if c.Host != nil {
+		ret.Host = c.Host.String()
+	}
+	for _, ip := range c.AltHosts {
+		ret.AltHosts = append(ret.AltHosts, ip.String())
+	}
+	return ret
+}
+
+// A version as the API shows it, or "" for the zero version.
+func apiVersion(v Version) string {
+	if v.IsZero() {
+		return ""
+	}
+	return v.String()
+}
+
+func apiContacts(contacts []Contact) []APIContact {
+	ret := make([]APIContact, 0, len(contacts))
+	for _, c := range contacts {
+		ret = append(ret, apiContact(c))
+	}
+	return ret
+}
+
+// The body of every API request; each operation reads the fields it needs.
+type APIRequest struct {
+	NodeID string `json:"node_id,omitempty"`
+	// For ping, host:port instead of NodeID.
+	Address    string `json:"address,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Value      []byte `json:"value,omitempty"`
+	VDOID      string `json:"vdo_id,omitempty"`
+	NumberKeys byte   `json:"number_keys,omitempty"`
+	Threshold  byte   `json:"threshold,omitempty"`
+	// Seconds between Vanish refreshes.
+	Timeout int `json:"timeout,omitempty"`
+	// For iterative_store, how many nodes must store the value; for
+	// iterative_find_value, how many must answer; for compare_and_swap, how
+	// many must apply it.
+	Quorum int `json:"quorum,omitempty"`
+	// For compare_and_swap, the version the nodes must hold, none if empty,
+	// or the hash of their value instead.
+	Expected     string `json:"expected,omitempty"`
+	ExpectedHash []byte `json:"expected_hash,omitempty"`
+}
+
+// The body of every API response.
+type APIResponse struct {
+	Error     string       `json:"error,omitempty"`
+	MsgID     string       `json:"msg_id,omitempty"`
+	Contact   *APIContact  `json:"contact,omitempty"`
+	Contacts  []APIContact `json:"contacts,omitempty"`
+	Value     []byte       `json:"value,omitempty"`
+	Version   string       `json:"version,omitempty"`
+	AccessKey int64        `json:"access_key,omitempty"`
+	Buckets   []APIBucket  `json:"buckets,omitempty"`
+	Failed    []APIFailure `json:"failed,omitempty"`
+	// For compare_and_swap, the nodes that held something else.
+	Conflicts []APIConflict `json:"conflicts,omitempty"`
+	// For quorum reads, whether the nodes agreed, and those sent the value.
+	Agreed   *bool        `json:"agreed,omitempty"`
+	Repaired []APIContact `json:"repaired,omitempty"`
+}
+
+type APIBucket struct {
+	PrefixLength int          `json:"prefix_length"`
+	Contacts     []APIContact `json:"contacts"`
+}
+
+// A node an operation could not complete at.
+type APIFailure struct {
+	Contact APIContact `json:"contact"`
+	Error   string     `json:"error"`
+}
+
+// A node that did not apply a compare_and_swap, and the version it holds.
+type APIConflict struct {
+	Contact APIContact `json:"contact"`
+	Version string     `json:"version,omitempty"`
+}
+
+// An API error and the status code it is reported with.
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string { return e.err.Error() }
+
+func badRequest(err error) error { return &apiError{http.StatusBadRequest, err} }
+func notFound(err error) error   { return &apiError{http.StatusNotFound, err} }
+func conflict(err error) error   { return &apiError{http.StatusConflict, err} }
+
+// A failed call to another node.
+func peerError(err error) error { return &apiError{http.StatusBadGateway, err} }
+
+type apiOperation struct {
+	method string
+	run    func(k *Kademlia, req *APIRequest) (*APIResponse, error)
+}
+
+var apiOperations = map[string]apiOperation{
+	"ping":                 {"POST", apiPing},
+	"store":                {"POST", apiStore},
+	"find_node":            {"POST", apiFindNode},
+	"find_value":           {"POST", apiFindValue},
+	"iterative_find_node":  {"POST", apiIterativeFindNode},
+	"iterative_store":      {"POST", apiIterativeStore},
+	"iterative_find_value": {"POST", apiIterativeFindValue},
+	"compare_and_swap":     {"POST", apiCompareAndSwap},
+	"vanish":               {"POST", apiVanish},
+	"unvanish":             {"POST", apiUnvanish},
+	"routing_table":        {"GET", apiRoutingTable},
+}
+
+// An http.Handler serving the API under /api/.
+func (k *Kademlia) APIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loopbackHost(r.Host) {
+			writeAPI(w, http.StatusForbidden, &APIResponse{Error: "host not allowed"})
+			return
+		}
+		op, ok := apiOperations[strings.TrimPrefix(r.URL.Path, "/api/")]
+		if !ok {
+			writeAPI(w, http.StatusNotFound, &APIResponse{Error: "unknown operation"})
+			return
+		}
+		if r.Method != op.method {
+			w.Header().Set("Allow", op.method)
+			writeAPI(w, http.StatusMethodNotAllowed, &APIResponse{Error: "use " + op.method})
+			return
+		}
+		req := new(APIRequest)
+		if op.method == "POST" {
+			if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+				writeAPI(w, http.StatusUnsupportedMediaType, &APIResponse{Error: "want Content-Type application/json"})
+				return
+			}
+			body := http.MaxBytesReader(w, r.Body, maxAPIBody)
+			if err := json.NewDecoder(body).Decode(req); err != nil {
+				status := http.StatusBadRequest
+				if _, ok := err.(*http.MaxBytesError); ok {
+					status = http.StatusRequestEntityTooLarge
+				}
+				writeAPI(w, status, &APIResponse{Error: "bad request: " + err.Error()})
+				return
+			}
+		}
+		res, status := k.runAPI(op, req)
+		writeAPI(w, status, res)
+	})
+}
+
+// Whether host, from a Host header, names a loopback address or localhost.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return strings.EqualFold(host, "localhost")
+}
+
+// Serve the API over plain HTTP on addr, which must be a loopback address.
+func listenAPI(addr string, k *Kademlia) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, ErrAPINotLoopback
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", k.APIHandler())
+	go http.Serve(l, mux)
+	return l, nil
+}
+
+// The address the API listens on, or nil unless Config.APIAddr is set.
+func (k *Kademlia) APIAddr() net.Addr {
+	if k.api == nil {
+		return nil
+	}
+	return k.api.Addr()
+}
+
+// Run the API operation op, as if req had been sent to /api/op, and return
+// the response with its status code.
+func (k *Kademlia) RunAPI(op string, req *APIRequest) (*APIResponse, int) {
+	operation, ok := apiOperations[op]
+	if !ok {
+		return &APIResponse{Error: "unknown operation"}, http.StatusNotFound
+	}
+	return k.runAPI(operation, req)
+}
+
+func (k *Kademlia) runAPI(op apiOperation, req *APIRequest) (*APIResponse, int) {
+	res, err := op.run(k, req)
+	if err == nil {
+		return res, http.StatusOK
+	}
+	status := http.StatusInternalServerError
+	if e, ok := err.(*apiError); ok {
+		status = e.status
+	}
+	if res == nil {
+		res = new(APIResponse)
+	}
+	res.Error = err.Error()
+	return res, status
+}
+
+func writeAPI(w http.ResponseWriter, status int, res *APIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+func parseID(name, s string) (ID, error) {
+	id, err := ParseID(s)
+	if err != nil {
+		return ID{}, badRequest(errors.New("invalid " + name + " (" + s + ")"))
+	}
+	return id, nil
+}
+
+// The contact named by req.NodeID.
+func (k *Kademlia) apiContact(req *APIRequest) (*Contact, error) {
+	id, err := parseID("node_id", req.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := k.FindContact(id)
+	if err != nil {
+		return nil, notFound(ErrUnknownContact)
+	}
+	return c, nil
+}
+
+func apiPing(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	var c *Contact
+	if req.Address != "" {
+		hostname, portstr, err := net.SplitHostPort(req.Address)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		port, err := strconv.ParseUint(portstr, 10, 16)
+		if err != nil {
+			return nil, badRequest(errors.New("invalid port (" + portstr + ")"))
+		}
+		host, err := k.ResolveHost(hostname)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		c = &Contact{Host: host, Port: uint16(port)}
+	} else {
+		var err error
+		if c, err = k.apiContact(req); err != nil {
+			return nil, err
+		}
+	}
+	pong, err := k.sendPing(c)
+	if err != nil {
+		return nil, peerError(err)
+	}
+	k.update(&pong.Sender)
+	sender := apiContact(pong.Sender)
+	return &APIResponse{MsgID: pong.MsgID.AsString(), Contact: &sender}, nil
+}
+
+func apiStore(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	c, err := k.apiContact(req)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	msg := &StoreRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: req.Value, Version: k.NewVersion()}
+	res := new(StoreResult)
+	if err := k.call(c, "Store", msg, res); err != nil {
+		return nil, peerError(err)
+	}
+	return &APIResponse{MsgID: res.MsgID.AsString(), Version: apiVersion(res.Version)}, nil
+}
+
+func apiFindNode(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	c, err := k.apiContact(req)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	msg := &FindNodeRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), NodeID: key}
+	res := new(FindNodeResult)
+	if err := k.call(c, "FindNode", msg, res); err != nil {
+		return nil, peerError(err)
+	}
+	return &APIResponse{MsgID: res.MsgID.AsString(), Contacts: apiContacts(res.Nodes)}, nil
+}
+
+func apiFindValue(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	c, err := k.apiContact(req)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	msg := &FindValueRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key}
+	res := new(FindValueResult)
+	if err := k.call(c, "FindValue", msg, res); err != nil {
+		return nil, peerError(err)
+	}
+	ret := &APIResponse{MsgID: res.MsgID.AsString(), Value: res.Value, Version: apiVersion(res.Version), Contacts: apiContacts(res.Nodes)}
+	if res.Value == nil {
+		return ret, notFound(ErrValueNotFound)
+	}
+	return ret, nil
+}
+
+func apiIterativeFindNode(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &APIResponse{Contacts: apiContacts(k.IterativeFindNode(key, false).Contacts())}, nil
+}
+
+// Store at the K closest nodes to the key, and report those that took it and
+// those that failed.
+func apiIterativeStore(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	res, err := k.IterativeStore(key, req.Value, req.Quorum)
+	ret := &APIResponse{Contacts: apiContacts(res.Stored), Version: apiVersion(res.Version)}
+	for _, f := range res.Failed {
+		ret.Failed = append(ret.Failed, APIFailure{apiContact(f.Contact), f.Err.Error()})
+	}
+	if err != nil {
+		return ret, peerError(err)
+	}
+	return ret, nil
+}
+
+// Swap at the K closest nodes to the key. Fails with 409 if nodes held
+// something else, and 502 if too few answered.
+func apiCompareAndSwap(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	expected := Expectation{Hash: req.ExpectedHash}
+	if req.Expected != "" {
+		if expected.Version, err = ParseVersion(req.Expected); err != nil {
+			return nil, badRequest(err)
+		}
+	}
+	res, err := k.IterativeCompareAndSwap(key, req.Value, expected, req.Quorum)
+	ret := &APIResponse{Contacts: apiContacts(res.Swapped), Version: apiVersion(res.Version)}
+	for _, c := range res.Conflicts {
+		ret.Conflicts = append(ret.Conflicts, APIConflict{apiContact(c.Contact), apiVersion(c.Current)})
+	}
+	for _, f := range res.Failed {
+		ret.Failed = append(ret.Failed, APIFailure{apiContact(f.Contact), f.Err.Error()})
+	}
+	if err == nil {
+		return ret, nil
+	} else if len(res.Conflicts) > 0 {
+		return ret, conflict(err)
+	}
+	return ret, peerError(err)
+}
+
+func apiIterativeFindValue(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if req.Quorum > 0 {
+		return apiQuorumRead(k, key, req.Quorum)
+	}
+	res := k.IterativeFindNode(key, true)
+	if res.Value() == nil {
+		return &APIResponse{Contacts: apiContacts(res.Contacts())}, notFound(ErrValueNotFound)
+	}
+	return &APIResponse{Value: res.Value(), Version: apiVersion(res.Version())}, nil
+}
+
+// Read from quorum nodes, and report those that answered and those repaired.
+func apiQuorumRead(k *Kademlia, key ID, quorum int) (*APIResponse, error) {
+	res, err := k.IterativeFindValue(key, quorum, nil)
+	ret := &APIResponse{Value: res.Value, Version: apiVersion(res.Version), Agreed: &res.Agreed, Repaired: apiContacts(res.Repaired)}
+	for _, r := range res.Replicas {
+		ret.Contacts = append(ret.Contacts, apiContact(r.Contact))
+	}
+	switch err {
+	case nil:
+		return ret, nil
+	case ErrValueNotFound:
+		return ret, notFound(err)
+	}
+	return ret, peerError(err)
+}
+
+func apiVanish(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	vdoid, err := parseID("vdo_id", req.VDOID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Threshold == 0 || req.NumberKeys < req.Threshold {
+		return nil, badRequest(errors.New("need 0 < threshold <= number_keys"))
+	}
+	if req.Timeout <= 0 {
+		return nil, badRequest(errors.New("need a positive timeout"))
+	}
+	vdo := VanishData(k, vdoid, req.Value, req.NumberKeys, req.Threshold)
+	if k.DoStoreVDO(vdo, req.Timeout) != "Success!" {
+		return nil, errors.New("could not vanish the data")
+	}
+	return &APIResponse{AccessKey: vdo.AccessKey}, nil
+}
+
+func apiUnvanish(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	nodeid, err := parseID("node_id", req.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	vdoid, err := parseID("vdo_id", req.VDOID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := k.Unvanish(nodeid, vdoid)
+	if err == ErrUnknownContact || err == ErrUnknownVDO || err == ErrUnvanish {
+		return nil, notFound(err)
+	} else if err != nil {
+		return nil, peerError(err)
+	}
+	return &APIResponse{Value: data}, nil
+}
+
+func apiRoutingTable(k *Kademlia, req *APIRequest) (*APIResponse, error) {
+	self := apiContact(k.Routes.Self())
+	ret := &APIResponse{Contact: &self, Buckets: make([]APIBucket, 0)}
+	for i := 0; i < IDBits; i++ {
+		if bucket := k.ReadFromBuckets(i); len(bucket) > 0 {
+			ret.Buckets = append(ret.Buckets, APIBucket{i, apiContacts(bucket)})
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,243 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// POST req to the API operation op, and decode the response.
+func postAPI(t *testing.T, server *httptest.Server, op string, req APIRequest) (int, *APIResponse) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(server.URL+"/api/"+op, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	res := new(APIResponse)
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, res
+}
+
+func TestAPI(t *testing.T) {
+	instanceList := newMemoryNodes(t, 20)
+	k := instanceList[0]
+	server := httptest.NewServer(k.APIHandler())
+	defer server.Close()
+	peer := instanceList[1].Routes.Self()
+
+	status, res := postAPI(t, server, "ping", APIRequest{NodeID: peer.NodeID.AsString()})
+	if status != http.StatusOK || res.Contact == nil || res.Contact.NodeID != peer.NodeID.AsString() {
+		t.Errorf("ping: %d %+v", status, res)
+	}
+	status, res = postAPI(t, server, "ping", APIRequest{Address: Dest(peer.Host, peer.Port)})
+	if status != http.StatusOK || res.Contact == nil || res.Contact.NodeID != peer.NodeID.AsString() {
+		t.Errorf("ping by address: %d %+v", status, res)
+	}
+
+	// Values are binary safe.
+	value := []byte{0, 1, 2, 0xff, '\n'}
+	key := NewRandomID()
+	status, res = postAPI(t, server, "store", APIRequest{NodeID: peer.NodeID.AsString(), Key: key.AsString(), Value: value})
+	if status != http.StatusOK {
+		t.Errorf("store: %d %+v", status, res)
+	}
+	status, res = postAPI(t, server, "find_value", APIRequest{NodeID: peer.NodeID.AsString(), Key: key.AsString()})
+	if status != http.StatusOK || !bytes.Equal(res.Value, value) {
+		t.Errorf("find_value: %d %+v", status, res)
+	}
+	status, res = postAPI(t, server, "find_value", APIRequest{NodeID: peer.NodeID.AsString(), Key: NewRandomID().AsString()})
+	if status != http.StatusNotFound || len(res.Contacts) == 0 {
+		t.Errorf("find_value of a missing key: %d %+v", status, res)
+	}
+	status, res = postAPI(t, server, "find_node", APIRequest{NodeID: peer.NodeID.AsString(), Key: NewRandomID().AsString()})
+	if status != http.StatusOK || len(res.Contacts) == 0 {
+		t.Errorf("find_node: %d %+v", status, res)
+	}
+
+	key = NewRandomID()
+	status, res = postAPI(t, server, "iterative_store", APIRequest{Key: key.AsString(), Value: value})
+	if status != http.StatusOK || len(res.Contacts) == 0 {
+		t.Errorf("iterative_store: %d %+v", status, res)
+	}
+	other := httptest.NewServer(instanceList[19].APIHandler())
+	defer other.Close()
+	status, res = postAPI(t, other, "iterative_find_value", APIRequest{Key: key.AsString()})
+	if status != http.StatusOK || !bytes.Equal(res.Value, value) {
+		t.Errorf("iterative_find_value: %d %+v", status, res)
+	}
+	status, res = postAPI(t, other, "iterative_find_value", APIRequest{Key: key.AsString(), Quorum: 3})
+	if status != http.StatusOK || !bytes.Equal(res.Value, value) || res.Version == "" || res.Agreed == nil || len(res.Contacts) != 3 {
+		t.Errorf("quorum iterative_find_value: %d %+v", status, res)
+	}
+	status, res = postAPI(t, other, "iterative_find_value", APIRequest{Key: NewRandomID().AsString()})
+	if status != http.StatusNotFound {
+		t.Errorf("iterative_find_value of a missing key: %d %+v", status, res)
+	}
+	key = NewRandomID()
+	status, res = postAPI(t, server, "compare_and_swap", APIRequest{Key: key.AsString(), Value: value})
+	if status != http.StatusOK || len(res.Contacts) == 0 || res.Version == "" {
+		t.Errorf("compare_and_swap: %d %+v", status, res)
+	}
+	created := res.Version
+	status, res = postAPI(t, server, "compare_and_swap", APIRequest{Key: key.AsString(), Value: value})
+	if status != http.StatusConflict || len(res.Conflicts) == 0 || res.Conflicts[0].Version != created {
+		t.Errorf("compare_and_swap of an existing key: %d %+v", status, res)
+	}
+	status, res = postAPI(t, server, "compare_and_swap", APIRequest{Key: key.AsString(), Value: value, Expected: created})
+	if status != http.StatusOK {
+		t.Errorf("compare_and_swap from %s: %d %+v", created, status, res)
+	}
+	status, res = postAPI(t, server, "iterative_find_node", APIRequest{Key: peer.NodeID.AsString()})
+	if status != http.StatusOK || len(res.Contacts) == 0 || res.Contacts[0].NodeID != peer.NodeID.AsString() {
+		t.Errorf("iterative_find_node: %d %+v", status, res)
+	}
+
+	resp, err := http.Get(server.URL + "/api/routing_table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = new(APIResponse)
+	err = json.NewDecoder(resp.Body).Decode(res)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || len(res.Buckets) == 0 || res.Contact.NodeID != k.NodeID.AsString() {
+		t.Errorf("routing_table: %d %v %+v", resp.StatusCode, err, res)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	network := NewMemoryNetwork()
+	k := NewKademliaWithConfig("127.0.0.1:0", Config{Transport: network.Transport()})
+	server := httptest.NewServer(k.APIHandler())
+	defer server.Close()
+
+	for _, test := range []struct {
+		op     string
+		req    APIRequest
+		status int
+	}{
+		{"store", APIRequest{NodeID: "zz", Key: NewRandomID().AsString()}, http.StatusBadRequest},
+		{"store", APIRequest{NodeID: NewRandomID().AsString(), Key: NewRandomID().AsString()}, http.StatusNotFound},
+		{"ping", APIRequest{Address: "127.0.0.1:9"}, http.StatusBadGateway},
+		{"ping", APIRequest{Address: "127.0.0.1"}, http.StatusBadRequest},
+		{"iterative_find_node", APIRequest{Key: "abc"}, http.StatusBadRequest},
+		{"vanish", APIRequest{VDOID: NewRandomID().AsString(), NumberKeys: 2, Threshold: 3, Timeout: 1}, http.StatusBadRequest},
+		{"unvanish", APIRequest{NodeID: k.NodeID.AsString(), VDOID: NewRandomID().AsString()}, http.StatusNotFound},
+		{"compare_and_swap", APIRequest{Key: NewRandomID().AsString(), Expected: "later"}, http.StatusBadRequest},
+		{"compare_and_swap", APIRequest{Key: NewRandomID().AsString()}, http.StatusBadGateway},
+		{"no_such_operation", APIRequest{}, http.StatusNotFound},
+		{"routing_table", APIRequest{}, http.StatusMethodNotAllowed},
+	} {
+		status, res := postAPI(t, server, test.op, test.req)
+		if status != test.status || res.Error == "" {
+			t.Errorf("%s %+v: got %d %+v, want %d", test.op, test.req, status, res, test.status)
+		}
+	}
+
+	resp, err := http.Post(server.URL+"/api/ping", "application/json", bytes.NewReader([]byte("{")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed body: got %d", resp.StatusCode)
+	}
+
+	for _, contentType := range []string{"text/plain", "application/x-www-form-urlencoded", ""} {
+		resp, err := http.Post(server.URL+"/api/ping", contentType, bytes.NewReader([]byte(`{"address":"127.0.0.1:9"}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("Content-Type %q: got %d", contentType, resp.StatusCode)
+		}
+	}
+
+	big := append([]byte(`{"value":"`), bytes.Repeat([]byte("A"), maxAPIBody)...)
+	big = append(big, `"}`...)
+	if resp, err = http.Post(server.URL+"/api/store", "application/json; charset=utf-8", bytes.NewReader(big)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: got %d", resp.StatusCode)
+	}
+
+	for host, want := range map[string]int{
+		"localhost":      http.StatusOK,
+		"localhost:8000": http.StatusOK,
+		"127.0.0.1:8000": http.StatusOK,
+		"[::1]:8000":     http.StatusOK,
+		"attacker.test":  http.StatusForbidden,
+		"10.0.0.1:8000":  http.StatusForbidden,
+		"localhost.test": http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest("GET", server.URL+"/api/routing_table", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Host %q: got %d, want %d", host, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestAPIListener(t *testing.T) {
+	network := NewMemoryNetwork()
+	k := NewKademliaWithConfig("127.0.0.1:0", Config{Transport: network.Transport(), APIAddr: "127.0.0.1:0"})
+	defer k.Close()
+	resp, err := http.Get("http://" + k.APIAddr().String() + "/api/routing_table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("routing_table: got %d", resp.StatusCode)
+	}
+	for _, addr := range []string{":0", "0.0.0.0:0", "192.0.2.1:0"} {
+		if _, err := listenAPI(addr, k); err != ErrAPINotLoopback {
+			t.Errorf("%s: got %v", addr, err)
+		}
+	}
+	if NewKademliaWithConfig("127.0.0.1:0", Config{Transport: network.Transport()}).APIAddr() != nil {
+		t.Error("API served by default")
+	}
+}
+
+// A peer with a valid node certificate reaches the RPC listener, but not the
+// API through it.
+func TestAPINotOnPeerListener(t *testing.T) {
+	server := NewKademliaWithConfig("127.0.0.1:0", Config{APIAddr: "127.0.0.1:0"})
+	defer server.Close()
+	ident, err := NewIdentity(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := selfSignedCertificate(ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig(cert, server.NodeID)}}
+	self := server.Routes.Self()
+	for _, op := range []string{"routing_table", "ping"} {
+		resp, err := client.Post("https://"+Dest(self.Host, self.Port)+"/api/"+op, "application/json", bytes.NewReader([]byte(`{"address":"192.0.2.1:80"}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s over the peer listener: got %d", op, resp.StatusCode)
+		}
+	}
+}
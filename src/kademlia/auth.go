@@ -0,0 +1,263 @@
+package kademlia
+
+// Contains message authentication. Every node owns an ed25519 key pair and its
+// NodeID is the SHA-1 hash of the public key, so a valid signature over a
+// message proves that it was sent by the node it claims to come from.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests and responses older or newer than this are rejected, and message
+// IDs are remembered for this long to catch replays.
+const ReplayWindow = 5 * time.Minute
+
+var (
+	ErrUnsigned         = errors.New("message is not signed")
+	ErrBadSignature     = errors.New("invalid message signature")
+	ErrIdentityMismatch = errors.New("node ID does not match signing key")
+	ErrStaleMessage     = errors.New("message timestamp outside replay window")
+	ErrReplayedMessage  = errors.New("message ID already seen")
+	ErrMsgIDMismatch    = errors.New("response does not answer request")
+)
+
+// A node's long-term key pair.
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// Generate a new identity, reading randomness from r (crypto/rand.Reader if
+// nil).
+func NewIdentity(r io.Reader) (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{pub, priv}, nil
+}
+
+func (ident *Identity) NodeID() ID {
+	return IDFromPublicKey(ident.PublicKey)
+}
+
+// Write the identity's private key seed to path, readable only by its owner.
+func (ident *Identity) Save(path string) error {
+	return ioutil.WriteFile(path, []byte(hex.EncodeToString(ident.PrivateKey.Seed())+"\n"), 0600)
+}
+
+// Read an identity written by Save.
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New(path + ": not an identity")
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &Identity{priv.Public().(ed25519.PublicKey), priv}, nil
+}
+
+// The node ID bound to a public key.
+func IDFromPublicKey(pub []byte) ID {
+	return ID(sha1.Sum(pub))
+}
+
+// Signature is the authentication envelope carried by every request and
+// response. Data covers every other field of the message, including
+// PublicKey and Timestamp.
+type Signature struct {
+	PublicKey []byte
+	Timestamp int64
+	Data      []byte
+}
+
+type signedMessage interface {
+	signature() *Signature
+	messageID() ID
+}
+
+func (k *Kademlia) sign(msg signedMessage) {
+	if k.conf.Unsigned {
+		return
+	}
+	sig := msg.signature()
+	*sig = Signature{PublicKey: k.identity.PublicKey, Timestamp: k.conf.Now().UnixNano()}
+	sig.Data = ed25519.Sign(k.identity.PrivateKey, digest(msg))
+}
+
+// Check the signature on an incoming request claiming to come from sender.
+func (k *Kademlia) verifyRequest(sender *Contact, msg signedMessage) error {
+	sig := msg.signature()
+	if len(sig.Data) == 0 {
+		if k.conf.AllowUnsigned {
+			return nil
+		}
+		return ErrUnsigned
+	}
+	if err := verifySignature(sender.NodeID, msg); err != nil {
+		return err
+	}
+	return k.replay.check(msg.messageID(), time.Unix(0, sig.Timestamp))
+}
+
+// Check the signature on the response to req. If expected is the zero ID
+// (e.g. a ping by address) any correctly signed response is accepted.
+func (k *Kademlia) verifyResponse(expected ID, req, res signedMessage) error {
+	if res.messageID() != req.messageID() {
+		return ErrMsgIDMismatch
+	}
+	sig := res.signature()
+	if len(sig.Data) == 0 {
+		if k.conf.AllowUnsigned {
+			return nil
+		}
+		return ErrUnsigned
+	}
+	if expected == (ID{}) {
+		expected = IDFromPublicKey(sig.PublicKey)
+	}
+	if err := verifySignature(expected, res); err != nil {
+		return err
+	}
+	if !withinWindow(time.Unix(0, sig.Timestamp), k.conf.Now()) {
+		return ErrStaleMessage
+	}
+	return nil
+}
+
+func verifySignature(id ID, msg signedMessage) error {
+	sig := msg.signature()
+	if len(sig.PublicKey) != ed25519.PublicKeySize {
+		return ErrBadSignature
+	}
+	if IDFromPublicKey(sig.PublicKey) != id {
+		return ErrIdentityMismatch
+	}
+	data := sig.Data
+	sig.Data = nil
+	ok := ed25519.Verify(sig.PublicKey, digest(msg), data)
+	sig.Data = data
+	if !ok {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func withinWindow(ts, now time.Time) bool {
+	d := now.Sub(ts)
+	return d < ReplayWindow && d > -ReplayWindow
+}
+
+// Remembers recently seen message IDs.
+type replayCache struct {
+	sync.Mutex
+	seen      map[ID]time.Time
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func newReplayCache(now func() time.Time) *replayCache {
+	return &replayCache{seen: make(map[ID]time.Time), lastPrune: now(), now: now}
+}
+
+func (rc *replayCache) check(msgID ID, ts time.Time) error {
+	now := rc.now()
+	if !withinWindow(ts, now) {
+		return ErrStaleMessage
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	if now.Sub(rc.lastPrune) > ReplayWindow {
+		for id, t := range rc.seen {
+			if now.Sub(t) > ReplayWindow {
+				delete(rc.seen, id)
+			}
+		}
+		rc.lastPrune = now
+	}
+	if _, found := rc.seen[msgID]; found {
+		return ErrReplayedMessage
+	}
+	rc.seen[msgID] = now
+	return nil
+}
+
+// digest returns a canonical encoding of a message. gob is not usable here as
+// its output depends on the order in which a process first saw each type.
+func digest(msg signedMessage) []byte {
+	var buf bytes.Buffer
+	encodeValue(&buf, reflect.ValueOf(msg))
+	return buf.Bytes()
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) {
+	var tmp [8]byte
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0)
+			return
+		}
+		buf.WriteByte(1)
+		encodeValue(buf, v.Elem())
+	case reflect.Interface:
+		// Only the Err fields of results are interfaces; they carry no data
+		// worth authenticating.
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			encodeValue(buf, v.Field(i))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			encodeValue(buf, v.Index(i))
+		}
+	case reflect.Slice:
+		binary.BigEndian.PutUint64(tmp[:], uint64(v.Len()))
+		buf.Write(tmp[:])
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.Write(v.Bytes())
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			encodeValue(buf, v.Index(i))
+		}
+	case reflect.String:
+		binary.BigEndian.PutUint64(tmp[:], uint64(v.Len()))
+		buf.Write(tmp[:])
+		buf.WriteString(v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Uint8:
+		buf.WriteByte(byte(v.Uint()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		binary.BigEndian.PutUint64(tmp[:], uint64(v.Int()))
+		buf.Write(tmp[:])
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		binary.BigEndian.PutUint64(tmp[:], v.Uint())
+		buf.Write(tmp[:])
+	case reflect.Float32, reflect.Float64:
+		binary.BigEndian.PutUint64(tmp[:], math.Float64bits(v.Float()))
+		buf.Write(tmp[:])
+	default:
+		panic("kademlia: cannot sign field of kind " + v.Kind().String())
+	}
+}
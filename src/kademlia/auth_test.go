@@ -0,0 +1,129 @@
+package kademlia
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) *Kademlia {
+	ident, err := NewIdentity(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := new(Kademlia)
+	k.identity = ident
+	k.NodeID = ident.NodeID()
+	k.conf.Now = time.Now
+	k.replay = newReplayCache(k.conf.Now)
+	return k
+}
+
+func TestSignedRequest(t *testing.T) {
+	sender := newTestSigner(t)
+	receiver := newTestSigner(t)
+	self := Contact{NodeID: sender.NodeID, Host: net.ParseIP("127.0.0.1"), Port: 7890}
+
+	req := &StoreRequest{Sender: self, MsgID: NewRandomID(), Key: NewRandomID(), Value: []byte("answer")}
+	sender.sign(req)
+	if err := receiver.verifyRequest(&req.Sender, req); err != nil {
+		t.Error("valid request rejected: ", err)
+	}
+	if err := receiver.verifyRequest(&req.Sender, req); err != ErrReplayedMessage {
+		t.Error("replayed request accepted: ", err)
+	}
+
+	req.MsgID = NewRandomID()
+	if err := receiver.verifyRequest(&req.Sender, req); err != ErrBadSignature {
+		t.Error("tampered request accepted: ", err)
+	}
+
+	// Claim to be someone else.
+	forged := &StoreRequest{Sender: self, MsgID: NewRandomID(), Key: NewRandomID()}
+	forged.Sender.NodeID = receiver.NodeID
+	sender.sign(forged)
+	if err := receiver.verifyRequest(&forged.Sender, forged); err != ErrIdentityMismatch {
+		t.Error("impersonating request accepted: ", err)
+	}
+}
+
+func TestUnsignedRequest(t *testing.T) {
+	receiver := newTestSigner(t)
+	req := &PingMessage{Sender: Contact{NodeID: NewRandomID(), Host: net.ParseIP("127.0.0.1"), Port: 7890}, MsgID: NewRandomID()}
+	if err := receiver.verifyRequest(&req.Sender, req); err != ErrUnsigned {
+		t.Error("unsigned request accepted: ", err)
+	}
+	receiver.conf.AllowUnsigned = true
+	if err := receiver.verifyRequest(&req.Sender, req); err != nil {
+		t.Error("unsigned request rejected in compatibility mode: ", err)
+	}
+
+	sender := newTestSigner(t)
+	sender.conf.Unsigned = true
+	sender.sign(req)
+	if len(req.Sig.Data) != 0 {
+		t.Error("unsigned node signed its request")
+	}
+}
+
+func TestSignedResponse(t *testing.T) {
+	client := newTestSigner(t)
+	server := newTestSigner(t)
+	req := &FindNodeRequest{MsgID: NewRandomID(), NodeID: NewRandomID()}
+	client.sign(req)
+
+	res := &FindNodeResult{MsgID: req.MsgID, Nodes: []Contact{{NodeID: NewRandomID(), Host: net.ParseIP("10.0.0.1"), Port: 1}}}
+	server.sign(res)
+	if err := client.verifyResponse(server.NodeID, req, res); err != nil {
+		t.Error("valid response rejected: ", err)
+	}
+	if err := client.verifyResponse(client.NodeID, req, res); err != ErrIdentityMismatch {
+		t.Error("response from wrong node accepted: ", err)
+	}
+
+	res.Nodes[0].Port = 2
+	if err := client.verifyResponse(server.NodeID, req, res); err != ErrBadSignature {
+		t.Error("tampered response accepted: ", err)
+	}
+
+	other := &FindNodeResult{MsgID: NewRandomID()}
+	server.sign(other)
+	if err := client.verifyResponse(server.NodeID, req, other); err != ErrMsgIDMismatch {
+		t.Error("response to another request accepted: ", err)
+	}
+}
+
+func TestSaveIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "identity")
+
+	ident, err := NewIdentity(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ident.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.NodeID() != ident.NodeID() || !loaded.PrivateKey.Equal(ident.PrivateKey) {
+		t.Error("loaded a different identity")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("identity file mode %v, %v", info.Mode(), err)
+	}
+
+	ioutil.WriteFile(path, []byte("abcd\n"), 0600)
+	if _, err := LoadIdentity(path); err == nil {
+		t.Error("loaded a truncated identity")
+	}
+}
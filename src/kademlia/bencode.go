@@ -0,0 +1,143 @@
+package kademlia
+
+// Contains a minimal bencode codec for the KRPC protocol. Values are decoded
+// into int64, string, []interface{} and map[string]interface{}; the same
+// types, plus int and []byte, can be encoded.
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+var ErrMalformedBencode = errors.New("malformed bencode")
+
+// Deeper nesting is rejected rather than recursed into.
+const maxBencodeDepth = 32
+
+func bencode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencodeTo(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func bencodeTo(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case int:
+		buf.WriteString("i" + strconv.Itoa(v) + "e")
+	case int64:
+		buf.WriteString("i" + strconv.FormatInt(v, 10) + "e")
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)) + ":" + v)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(v)) + ":")
+		buf.Write(v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, e := range v {
+			if err := bencodeTo(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		// Dictionary keys are sorted as raw strings.
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			bencodeTo(buf, key)
+			if err := bencodeTo(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return errors.New("bencode: unsupported type")
+	}
+	return nil
+}
+
+// Decode a single value that must take up all of data.
+func bdecode(data []byte) (interface{}, error) {
+	v, rest, err := bdecodeValue(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, ErrMalformedBencode
+	}
+	return v, nil
+}
+
+func bdecodeValue(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 || depth > maxBencodeDepth {
+		return nil, nil, ErrMalformedBencode
+	}
+	switch c := data[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return nil, nil, ErrMalformedBencode
+		}
+		n, err := strconv.ParseInt(string(data[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, ErrMalformedBencode
+		}
+		return n, data[end+1:], nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data, ':')
+		if colon < 0 {
+			return nil, nil, ErrMalformedBencode
+		}
+		n, err := strconv.Atoi(string(data[:colon]))
+		if err != nil || n < 0 || n > len(data)-colon-1 {
+			return nil, nil, ErrMalformedBencode
+		}
+		return string(data[colon+1 : colon+1+n]), data[colon+1+n:], nil
+	case c == 'l':
+		list := make([]interface{}, 0)
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			var v interface{}
+			var err error
+			if v, data, err = bdecodeValue(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			list = append(list, v)
+		}
+		if len(data) == 0 {
+			return nil, nil, ErrMalformedBencode
+		}
+		return list, data[1:], nil
+	case c == 'd':
+		dict := make(map[string]interface{})
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			var key, v interface{}
+			var err error
+			if key, data, err = bdecodeValue(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			s, ok := key.(string)
+			if !ok {
+				return nil, nil, ErrMalformedBencode
+			}
+			if v, data, err = bdecodeValue(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			dict[s] = v
+		}
+		if len(data) == 0 {
+			return nil, nil, ErrMalformedBencode
+		}
+		return dict, data[1:], nil
+	}
+	return nil, nil, ErrMalformedBencode
+}
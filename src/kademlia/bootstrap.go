@@ -0,0 +1,120 @@
+package kademlia
+
+// Contains joining the network: contacting seed nodes, then looking up the
+// node's own ID and refreshing the buckets farther out, so that the routing
+// table holds the node's neighbours and a spread of the rest of the network.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+var ErrNoSeeds = errors.New("no seed answered")
+
+const (
+	DefaultBootstrapAttempts = 5
+	DefaultBootstrapBackoff  = 500 * time.Millisecond
+)
+
+// Join the network through any of seeds, given as host:port. A host name
+// stands for every address it resolves to. Seeds that do not answer are tried
+// again with exponential backoff, up to Config.BootstrapAttempts times in all.
+// Once one answers, the node looks itself up and refreshes its buckets.
+func (k *Kademlia) Bootstrap(seeds []string) error {
+	var candidates []Contact
+	var lastErr error
+	for _, seed := range seeds {
+		hostname, portstr, err := net.SplitHostPort(seed)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		port, err := strconv.ParseUint(portstr, 10, 16)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ips, err := lookupHost(hostname)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			candidates = append(candidates, Contact{Host: ip, Port: uint16(port)})
+		}
+	}
+
+	attempts := k.conf.BootstrapAttempts
+	if attempts <= 0 {
+		attempts = DefaultBootstrapAttempts
+	}
+	backoff := k.conf.BootstrapBackoff
+	if backoff <= 0 {
+		backoff = DefaultBootstrapBackoff
+	}
+	reached := 0
+	for attempt := 0; attempt < attempts && len(candidates) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		for _, c := range candidates {
+			c := c
+			pong, err := k.sendPing(&c)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if pong.Sender.NodeID != k.NodeID {
+				k.update(&pong.Sender)
+				reached++
+			}
+		}
+		if reached > 0 {
+			break
+		}
+	}
+	// Wait for the seeds to reach the routing table.
+	k.ReadFromBuckets(0)
+	if reached == 0 {
+		if lastErr != nil {
+			return fmt.Errorf("%w: %v", ErrNoSeeds, lastErr)
+		}
+		return ErrNoSeeds
+	}
+
+	k.IterativeFindNode(k.NodeID, false)
+	k.RefreshBuckets()
+	return nil
+}
+
+// Look up a random ID in every bucket farther from the node than its closest
+// neighbour, so that each of those buckets fills up.
+func (k *Kademlia) RefreshBuckets() {
+	closest := k.Routes.FindClosest(k.NodeID, 2)
+	nearest := 0
+	for _, c := range closest {
+		if c.NodeID != k.NodeID {
+			nearest = c.NodeID.Xor(k.NodeID).PrefixLen()
+			break
+		}
+	}
+	for i := 0; i < nearest; i++ {
+		k.IterativeFindNode(randomIDInBucket(k.NodeID, i), false)
+	}
+}
+
+// A random ID that shares exactly prefix_length leading bits with self.
+func randomIDInBucket(self ID, prefix_length int) (ret ID) {
+	ret = NewRandomID()
+	for i := 0; i < prefix_length; i++ {
+		mask := byte(0x80) >> uint(i%8)
+		ret[i/8] = ret[i/8]&^mask | self[i/8]&mask
+	}
+	mask := byte(0x80) >> uint(prefix_length%8)
+	ret[prefix_length/8] = ret[prefix_length/8]&^mask | ^self[prefix_length/8]&mask
+	return
+}
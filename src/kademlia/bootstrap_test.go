@@ -0,0 +1,60 @@
+package kademlia
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRandomIDInBucket(t *testing.T) {
+	self := NewRandomID()
+	for _, i := range []int{0, 1, 7, 8, 100, 159} {
+		if p := randomIDInBucket(self, i).Xor(self).PrefixLen(); p != i {
+			t.Errorf("ID for bucket %d falls in bucket %d", i, p)
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	network := NewMemoryNetwork()
+	conf := Config{BootstrapAttempts: 2, BootstrapBackoff: time.Millisecond}
+	nodes := make([]*Kademlia, 40)
+	for i := range nodes {
+		conf.Transport = network.Transport()
+		nodes[i] = NewKademliaWithConfig("127.0.0.1:"+strconv.Itoa(i+1), conf)
+	}
+
+	if err := nodes[1].Bootstrap([]string{"127.0.0.1:999"}); !errors.Is(err, ErrNoSeeds) {
+		t.Error("bootstrap without a live seed returned", err)
+	}
+	// Everyone joins through the first node, or through a dead seed and
+	// then the previous node.
+	for i := 1; i < len(nodes); i++ {
+		seeds := []string{"127.0.0.1:1"}
+		if i%2 == 0 {
+			seeds = []string{"127.0.0.1:999", "127.0.0.1:" + strconv.Itoa(i)}
+		}
+		if err := nodes[i].Bootstrap(seeds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last := nodes[len(nodes)-1]
+	known := 0
+	for i := 0; i < IDBits; i++ {
+		known += len(last.ReadFromBuckets(i))
+	}
+	if known < K {
+		t.Errorf("the last node knows only %d contacts", known)
+	}
+	for _, target := range nodes[:5] {
+		found := false
+		for _, c := range last.IterativeFindNode(target.NodeID, false).Contacts() {
+			found = found || c.NodeID == target.NodeID
+		}
+		if !found {
+			t.Error("lookup from the last node did not find", target.NodeID.AsString())
+		}
+	}
+}
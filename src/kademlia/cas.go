@@ -0,0 +1,159 @@
+package kademlia
+
+// Contains compare-and-swap: a conditional store that a node only applies if
+// it still holds the value the writer read, checked by version or by hash in
+// the same step as the store, and IterativeCompareAndSwap, which needs a
+// quorum of the K closest nodes to apply it. Unlike a plain store, a swap that
+// fails at a node is not tried at the next closest: that node never held the
+// value, so it would apply any swap, and two writers could each count a
+// majority.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrSwapQuorum = errors.New("compare-and-swap quorum not reached")
+
+// What a node must hold for a compare-and-swap to apply.
+type Expectation struct {
+	// The version of the value; the zero Version means no value.
+	Version Version
+	// If not nil, the HashValue of the value instead, whatever its version.
+	Hash []byte
+}
+
+// The hash a compare-and-swap can expect a value to have.
+func HashValue(value []byte) []byte {
+	sum := sha1.Sum(value)
+	return sum[:]
+}
+
+// A conditional store on its way to the goroutine that owns the hashtable.
+type swapSet struct {
+	KeySet
+	expected Expectation
+	ttl      time.Duration
+}
+
+// Apply set if the hashtable holds what it expects and its version is newer,
+// and leave set with the version held afterwards. Runs in handleChan, like
+// every other access to the hashtable, so nothing comes between the
+// comparison and the store.
+func (k *Kademlia) swap(set *swapSet) {
+	now := k.conf.Now()
+	old, existed := k.hashtable[set.Key]
+	live := existed && !old.expired(now)
+	var match bool
+	if set.expected.Hash != nil {
+		match = live && bytes.Equal(HashValue(old.Value), set.expected.Hash)
+	} else if live {
+		match = old.Version == set.expected.Version
+	} else {
+		match = set.expected.Version.IsZero()
+	}
+	if !match || existed && !set.Version.Newer(old.Version) {
+		set.Version = old.Version
+		set.resultChan <- 0
+		return
+	}
+	k.metrics.stored(existed, old.Value, set.Value)
+	stored := storedValue{set.Value, set.Version, time.Time{}}
+	if set.ttl > 0 {
+		stored.Expires = now.Add(set.ttl)
+	} else if set.ttl < 0 {
+		stored.Expires = now
+	}
+	k.hashtable[set.Key] = stored
+	k.clock.Observe(set.Version.Timestamp)
+	set.resultChan <- 1
+}
+
+// A replica that answered a compare-and-swap without applying it.
+type SwapConflict struct {
+	Contact Contact
+	// The version the node holds, which may be that of an expired value, or
+	// the zero Version if it never had one.
+	Current Version
+}
+
+// The outcome of a compare-and-swap at the K closest nodes.
+type SwapResult struct {
+	Key ID
+	// The version the value was written with.
+	Version Version
+	// How many replicas had to apply the write.
+	Quorum int
+	// The nodes that applied it, closest first.
+	Swapped []Contact
+	// The nodes that held something else, closest first.
+	Conflicts []SwapConflict
+	// The nodes that failed to answer, in the order they were tried.
+	Failed []ReplicaError
+}
+
+// Whether enough replicas applied the write.
+func (ret *SwapResult) OK() bool {
+	return len(ret.Swapped) >= ret.Quorum
+}
+
+// Store value at the K nodes closest to key, under a new version, at each node
+// only if it holds what expected describes. The swap succeeds if at least
+// quorum of them apply it; a quorum of 0 or less means a majority of K, however
+// many the lookup found. Returns ErrSwapQuorum, along with the result,
+// otherwise. Nodes that applied a failed swap keep the new value; the conflicts
+// tell the caller what the others hold, to read again and retry.
+func (k *Kademlia) IterativeCompareAndSwap(key ID, value []byte, expected Expectation, quorum int) (*SwapResult, error) {
+	return k.compareAndSwap(key, value, expected, 0, quorum)
+}
+
+// IterativeCompareAndSwap, with the nodes keeping the value for ttl as the
+// CompareAndSwapRequest describes.
+func (k *Kademlia) compareAndSwap(key ID, value []byte, expected Expectation, ttl time.Duration, quorum int) (*SwapResult, error) {
+	found := k.IterativeFindNode(key, false)
+	if quorum <= 0 {
+		quorum = K/2 + 1
+	}
+	// The new version must be newer than the one expected, even if this
+	// node's clock lags the writer's.
+	k.clock.Observe(expected.Version.Timestamp)
+	ret := &SwapResult{Key: key, Version: k.NewVersion(), Quorum: quorum}
+
+	replies := make(chan SwapConflict, 2*K)
+	answered, failed := sendAll(found.contacts, func(c Contact) error {
+		req := &CompareAndSwapRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: value, Version: ret.Version, Expected: expected, TTL: ttl}
+		res := new(CompareAndSwapResult)
+		if err := k.call(&c, "CompareAndSwap", req, res); err != nil {
+			return err
+		}
+		if !res.Swapped {
+			replies <- SwapConflict{c, res.Current}
+		}
+		return nil
+	})
+	close(replies)
+	ret.Failed = failed
+	conflicts := make(map[ID]bool)
+	for c := range replies {
+		ret.Conflicts = append(ret.Conflicts, c)
+		conflicts[c.Contact.NodeID] = true
+		// So that a retry gets a version newer than the conflicting one.
+		k.clock.Observe(c.Current.Timestamp)
+	}
+	for _, c := range answered {
+		if !conflicts[c.NodeID] {
+			ret.Swapped = append(ret.Swapped, c)
+		}
+	}
+	sortByDistance(ret.Swapped, key)
+	sort.Slice(ret.Conflicts, func(i, j int) bool {
+		return ret.Conflicts[i].Contact.NodeID.Xor(key).Less(ret.Conflicts[j].Contact.NodeID.Xor(key))
+	})
+	if !ret.OK() {
+		return ret, ErrSwapQuorum
+	}
+	return ret, nil
+}
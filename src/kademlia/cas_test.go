@@ -0,0 +1,105 @@
+package kademlia
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIterativeCompareAndSwap(t *testing.T) {
+	instanceList := newMemoryNodes(t, 40)
+	k := instanceList[0]
+	network := k.transport.(*MemoryTransport).network
+	key := NewRandomID()
+	closest := k.IterativeFindNode(key, false).Contacts()
+	if len(closest) != K {
+		t.Fatalf("found %d nodes", len(closest))
+	}
+
+	// Creating the value succeeds once.
+	first, err := k.IterativeCompareAndSwap(key, []byte("one"), Expectation{}, 0)
+	if err != nil || len(first.Swapped) != K || first.Quorum != K/2+1 {
+		t.Fatalf("create: %v, swapped at %d", err, len(first.Swapped))
+	}
+	res, err := k.IterativeCompareAndSwap(key, []byte("other"), Expectation{}, 0)
+	if err != ErrSwapQuorum || len(res.Swapped) != 0 || len(res.Conflicts) != K {
+		t.Fatalf("second create: %v, swapped at %d", err, len(res.Swapped))
+	}
+	for _, c := range res.Conflicts {
+		if c.Current != first.Version {
+			t.Errorf("conflict at version %v, want %v", c.Current, first.Version)
+		}
+	}
+
+	// By version, then by hash.
+	second, err := k.IterativeCompareAndSwap(key, []byte("two"), Expectation{Version: first.Version}, K)
+	if err != nil || !second.Version.Newer(first.Version) {
+		t.Fatalf("swap by version: %v", err)
+	}
+	if _, err = k.IterativeCompareAndSwap(key, []byte("three"), Expectation{Hash: HashValue([]byte("one"))}, 1); err != ErrSwapQuorum {
+		t.Errorf("swap by stale hash: %v", err)
+	}
+	third, err := k.IterativeCompareAndSwap(key, []byte("three"), Expectation{Hash: HashValue([]byte("two"))}, K)
+	if err != nil {
+		t.Fatalf("swap by hash: %v", err)
+	}
+
+	// One replica moved on, and three fail. No other node stands in for
+	// those, and the rest make the quorum.
+	moved := k.NewVersion()
+	req := &StoreRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: []byte("moved"), Version: moved}
+	if err := k.call(&closest[0], "Store", req, new(StoreResult)); err != nil {
+		t.Fatal(err)
+	}
+	bad := make(map[string]bool)
+	for _, c := range closest[1:4] {
+		bad[Dest(c.Host, c.Port)] = true
+	}
+	dropCalls(network, "CompareAndSwap", bad)
+	res, err = k.IterativeCompareAndSwap(key, []byte("four"), Expectation{Version: third.Version}, 0)
+	if err != nil || len(res.Failed) != 3 || len(res.Conflicts) != 1 {
+		t.Fatalf("got %v, %d failed, %d conflicts", err, len(res.Failed), len(res.Conflicts))
+	}
+	if c := res.Conflicts[0]; c.Contact.NodeID != closest[0].NodeID || c.Current != moved {
+		t.Errorf("conflict at %v, version %v", c.Contact.NodeID.AsString(), c.Current)
+	}
+	if len(res.Swapped) != K-4 {
+		t.Errorf("swapped at %d nodes", len(res.Swapped))
+	}
+	dropCalls(network, "CompareAndSwap", map[string]bool{})
+
+	// Of two writers racing from the same version, at most one wins.
+	var wg sync.WaitGroup
+	wins := make(chan bool, 2)
+	for _, node := range instanceList[1:3] {
+		wg.Add(1)
+		go func(node *Kademlia) {
+			defer wg.Done()
+			_, err := node.IterativeCompareAndSwap(key, []byte(node.NodeID.AsString()), Expectation{Version: res.Version}, 0)
+			wins <- err == nil
+		}(node)
+	}
+	wg.Wait()
+	if <-wins && <-wins {
+		t.Error("both writers won")
+	}
+}
+
+func TestCompareAndSwapHalfUnreachable(t *testing.T) {
+	instanceList := newMemoryNodes(t, 60)
+	k := instanceList[0]
+	network := k.transport.(*MemoryTransport).network
+	key := NewRandomID()
+	closest := k.IterativeFindNode(key, false).Contacts()
+
+	// Half the replicas fail the swap. The next closest nodes never had the
+	// value and would apply anything, so they do not stand in.
+	bad := make(map[string]bool)
+	for _, c := range closest[:K/2] {
+		bad[Dest(c.Host, c.Port)] = true
+	}
+	dropCalls(network, "CompareAndSwap", bad)
+	res, err := k.IterativeCompareAndSwap(key, []byte("one"), Expectation{}, 0)
+	if err != ErrSwapQuorum || res.Quorum != K/2+1 || len(res.Swapped) != K/2 || len(res.Failed) != K/2 {
+		t.Fatalf("create: %v, swapped at %d, %d failed", err, len(res.Swapped), len(res.Failed))
+	}
+}
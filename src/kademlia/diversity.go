@@ -0,0 +1,186 @@
+package kademlia
+
+// Contains IP diversity limits for the routing table. One host running many
+// IDs, or one network handing out many addresses, could otherwise fill the
+// buckets and eclipse the node. Contacts are grouped by each of their
+// addresses and by the /24 (IPv4) or /64 (IPv6) subnet around it.
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ErrTooManyFromIP     = errors.New("too many contacts from one IP")
+	ErrTooManyFromSubnet = errors.New("too many contacts from one subnet")
+)
+
+// Rejected contacts kept for inspection.
+const maxRecentRejections = 16
+
+// Limits on routing table contacts sharing an address. Zero means no limit.
+type Diversity struct {
+	// Contacts in one bucket with the same IP or subnet.
+	PerIPPerBucket     int
+	PerSubnetPerBucket int
+	// Contacts in the whole table with the same IP or subnet.
+	PerIP     int
+	PerSubnet int
+	// LookupPerSubnet makes lookups return at most this many contacts from
+	// one subnet among their K closest, as long as other candidates remain.
+	LookupPerSubnet int
+}
+
+func (d Diversity) enabled() bool {
+	return d.PerIPPerBucket > 0 || d.PerSubnetPerBucket > 0 || d.PerIP > 0 || d.PerSubnet > 0
+}
+
+// A contact refused by the diversity limits, and why.
+type Rejection struct {
+	Contact Contact
+	Reason  error
+}
+
+// Counts of contacts refused by the diversity limits, and the latest ones.
+type DiversityStats struct {
+	RejectedIP     uint64
+	RejectedSubnet uint64
+	Recent         []Rejection
+}
+
+// The subnet ip belongs to: its /24 for IPv4, its /64 for IPv6.
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// Check whether contact may join the bucket at prefix_length. Contacts with
+// the ID of contact are not counted against it. Must be called with the
+// table locked.
+func (table *RoutingTable) checkDiversity(prefix_length int, contact *Contact) error {
+	d := table.diversity
+	if !d.enabled() {
+		return nil
+	}
+	addrs := contact.Addresses()
+	ips := make(map[string]bool, len(addrs))
+	subnets := make(map[string]bool, len(addrs))
+	for _, ip := range addrs {
+		ips[ip.String()] = true
+		subnets[subnet(ip)] = true
+	}
+
+	var bucketIP, bucketSubnet, tableIP, tableSubnet int
+	for i := range table.buckets {
+		for _, c := range table.buckets[i] {
+			if c.NodeID == contact.NodeID {
+				continue
+			}
+			sameIP, sameSubnet := false, false
+			for _, ip := range c.Addresses() {
+				sameIP = sameIP || ips[ip.String()]
+				sameSubnet = sameSubnet || subnets[subnet(ip)]
+			}
+			if sameIP {
+				tableIP++
+				if i == prefix_length {
+					bucketIP++
+				}
+			}
+			if sameSubnet {
+				tableSubnet++
+				if i == prefix_length {
+					bucketSubnet++
+				}
+			}
+		}
+	}
+
+	var err error
+	switch {
+	case d.PerIPPerBucket > 0 && bucketIP >= d.PerIPPerBucket,
+		d.PerIP > 0 && tableIP >= d.PerIP:
+		err = ErrTooManyFromIP
+		table.diversityStats.RejectedIP++
+	case d.PerSubnetPerBucket > 0 && bucketSubnet >= d.PerSubnetPerBucket,
+		d.PerSubnet > 0 && tableSubnet >= d.PerSubnet:
+		err = ErrTooManyFromSubnet
+		table.diversityStats.RejectedSubnet++
+	default:
+		return nil
+	}
+	recent := append(table.diversityStats.Recent, Rejection{*contact, err})
+	if len(recent) > maxRecentRejections {
+		recent = recent[len(recent)-maxRecentRejections:]
+	}
+	table.diversityStats.Recent = recent
+	return err
+}
+
+// Whether a and b give the same addresses.
+func sameAddresses(a, b *Contact) bool {
+	x, y := a.Addresses(), b.Addresses()
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !x[i].Equal(y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Counts of contacts the diversity limits kept out of the table.
+func (table *RoutingTable) DiversityStats() DiversityStats {
+	table.RLock()
+	defer table.RUnlock()
+	ret := table.diversityStats
+	ret.Recent = append([]Rejection(nil), ret.Recent...)
+	return ret
+}
+
+// The first count of shortlist, which is sorted by distance, taking at most
+// perSubnet contacts from one subnet while others remain. The result stays
+// sorted.
+func diverseClosest(shortlist []ContactDistance, count int, perSubnet int) []ContactDistance {
+	if perSubnet <= 0 || len(shortlist) <= count {
+		if len(shortlist) > count {
+			shortlist = shortlist[:count]
+		}
+		return shortlist
+	}
+	chosen := make([]bool, len(shortlist))
+	taken := make(map[string]int)
+	n := 0
+	for i, c := range shortlist {
+		if n == count {
+			break
+		}
+		key := subnet(c.contact.Host)
+		if taken[key] >= perSubnet {
+			continue
+		}
+		taken[key]++
+		chosen[i] = true
+		n++
+	}
+	for i := range shortlist {
+		if n == count {
+			break
+		}
+		if !chosen[i] {
+			chosen[i] = true
+			n++
+		}
+	}
+	ret := make([]ContactDistance, 0, count)
+	for i, c := range shortlist {
+		if chosen[i] {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
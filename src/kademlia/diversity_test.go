@@ -0,0 +1,88 @@
+package kademlia
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDiversityLimits(t *testing.T) {
+	self := Contact{NodeID: NewRandomID(), Host: net.ParseIP("10.0.0.1"), Port: 1,
+		AltHosts: []net.IP{net.ParseIP("fd00::1")}}
+	rt := NewRoutingTable(self)
+	rt.diversity = Diversity{PerIP: 2, PerSubnet: 3}
+	add := func(host string) *Contact {
+		c := &Contact{NodeID: NewRandomID(), Host: net.ParseIP(host), Port: 1}
+		rt.Update(c)
+		return c
+	}
+	known := func(c *Contact) bool {
+		for _, found := range rt.FindClosest(c.NodeID, 1) {
+			return found.NodeID == c.NodeID
+		}
+		return false
+	}
+
+	a := add("192.0.2.1")
+	b := add("192.0.2.1")
+	if !known(a) || !known(b) {
+		t.Fatal("contacts under the limit were rejected")
+	}
+	if known(add("192.0.2.1")) {
+		t.Error("third contact from one IP was accepted")
+	}
+	if !known(add("192.0.2.2")) {
+		t.Error("contact from another IP in the subnet was rejected")
+	}
+	if known(add("192.0.2.3")) {
+		t.Error("fourth contact from one /24 was accepted")
+	}
+	if !known(add("198.51.100.1")) {
+		t.Error("contact from another subnet was rejected")
+	}
+	// IPv6 contacts are grouped by /64.
+	add("2001:db8::1")
+	add("2001:db8::2")
+	add("2001:db8::3")
+	if known(add("2001:db8::ffff")) || !known(add("2001:db8:0:1::1")) {
+		t.Error("IPv6 subnet limit not applied by /64")
+	}
+	// A known contact cannot move into a full subnet.
+	moved := *a
+	moved.Host = net.ParseIP("2001:db8::4")
+	rt.Update(&moved)
+	for _, c := range rt.FindClosest(a.NodeID, 1) {
+		if !c.Host.Equal(a.Host) {
+			t.Error("known contact moved into a full subnet")
+		}
+	}
+
+	stats := rt.DiversityStats()
+	if stats.RejectedIP != 1 || stats.RejectedSubnet != 3 || len(stats.Recent) != 4 {
+		t.Errorf("stats %+v", stats)
+	}
+	if stats.Recent[0].Reason != ErrTooManyFromIP || stats.Recent[1].Reason != ErrTooManyFromSubnet {
+		t.Error("rejections reported with the wrong reasons")
+	}
+}
+
+func TestDiverseClosest(t *testing.T) {
+	hosts := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "198.51.100.1", "192.0.2.4", "203.0.113.1"}
+	shortlist := make([]ContactDistance, len(hosts))
+	for i, host := range hosts {
+		shortlist[i] = ContactDistance{Contact{Host: net.ParseIP(host)}, ID{byte(i)}}
+	}
+	got := diverseClosest(shortlist, 4, 2)
+	want := []string{"192.0.2.1", "192.0.2.2", "198.51.100.1", "203.0.113.1"}
+	for i := range want {
+		if !got[i].contact.Host.Equal(net.ParseIP(want[i])) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	// With too few other candidates, the rest come from the crowded subnet.
+	if got := diverseClosest(shortlist[:5], 4, 1); len(got) != 4 || got[1].Dist != shortlist[1].Dist {
+		t.Errorf("got %v", got)
+	}
+	if got := diverseClosest(shortlist, 3, 0); len(got) != 3 || got[2].Dist != shortlist[2].Dist {
+		t.Error("limit applied when disabled")
+	}
+}
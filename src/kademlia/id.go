@@ -88,6 +88,8 @@ func CopyID(id ID) (ret ID) {
 }
 
 // Generate a ID matching a given string.
+// Short strings are zero-padded and long ones truncated; ParseID rejects
+// both.
 func IDFromString(idstr string) (ret ID, err error) {
 	bytes, err := hex.DecodeString(idstr)
 	if err != nil {
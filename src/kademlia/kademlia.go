@@ -4,13 +4,14 @@ package kademlia
 // as a receiver for the RPC methods, which is required by that package.
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 	"net/rpc"
 	"strconv"
 	"sync"
+	"time"
 )
 
 const (
@@ -19,6 +20,8 @@ const (
 	K     = 20
 )
 
+var ErrClosed = errors.New("node closed")
+
 // Kademlia type. You can put whatever state you need in this.
 type Kademlia struct {
 	NodeID           ID
@@ -26,10 +29,96 @@ type Kademlia struct {
 	contactChan      chan *Contact
 	keyChan          chan *KeySet
 	searchChan       chan *KeySet
-	hashtable        map[ID][]byte
+	swapChan         chan *swapSet
+	sweepChan        chan chan int
+	hashtable        map[ID]storedValue
 	bucketChan       chan int
 	bucketResultChan chan []Contact
 	VDOmap           VDOmap
+	identity         *Identity
+	transport        Transport
+	krpc             *KRPC
+	observations     *observations
+	limiter          *limiter
+	metrics          *metrics
+	// The addresses the node listens on.
+	localHosts []net.IP
+	replay     *replayCache
+	conf       Config
+	started    time.Time
+	clock      *hlc
+	// The JSON API and metrics listeners, if any.
+	api             net.Listener
+	metricsListener net.Listener
+	// Closed by Close, to stop handleChan and maintainLoop.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Node options. The zero value gives the default behaviour.
+type Config struct {
+	// Identity is the node's key pair. A new one is generated if nil.
+	Identity *Identity
+	// AllowUnsigned tolerates peers that do not sign their messages, for
+	// compatibility with older nodes. Bad signatures are always rejected.
+	AllowUnsigned bool
+	// Unsigned sends requests and replies without signatures, which peers
+	// accept only with AllowUnsigned. For simulations, where signing costs
+	// most of the CPU time and proves nothing.
+	Unsigned bool
+	// Insecure serves and dials plain HTTP instead of TLS.
+	Insecure bool
+	// Transport carries the RPCs. Defaults to an HTTPTransport.
+	Transport Transport
+	// ManualMaintenance stops background routing table maintenance; it then
+	// only happens when Maintain is called. Used by simulators that need
+	// reproducible runs.
+	ManualMaintenance bool
+	// KRPC also serves the BitTorrent Mainline DHT protocol over UDP, on the
+	// transport's port number.
+	KRPC bool
+	// ObservedQuorum is how many peers in distinct subnets must report the
+	// same address before the node advertises it. Defaults to
+	// DefaultObservedQuorum.
+	ObservedQuorum int
+	// BootstrapAttempts is how many times Bootstrap tries the seeds, waiting
+	// BootstrapBackoff after the first round and twice as long after each
+	// further one. Default to DefaultBootstrapAttempts and
+	// DefaultBootstrapBackoff.
+	BootstrapAttempts int
+	BootstrapBackoff  time.Duration
+	// Limits restricts incoming RPCs. The zero value imposes none.
+	Limits Limits
+	// Diversity caps the contacts sharing an IP or subnet in the routing
+	// table. The zero value imposes none.
+	Diversity Diversity
+	// MaxFailures is how many calls in a row a contact may fail before it
+	// leaves the routing table. Defaults to DefaultMaxFailures.
+	MaxFailures int
+	// Every LivenessInterval, the LivenessCheck contacts not seen for that
+	// long are pinged. Default to DefaultLivenessInterval and
+	// DefaultLivenessCheck.
+	LivenessInterval time.Duration
+	LivenessCheck    int
+	// Proximity turns on proximity neighbor selection: full buckets keep the
+	// contacts with the lowest round trip times, and lookups weigh the round
+	// trip times of their next candidates.
+	Proximity bool
+	// Now is the clock that versions and signatures are stamped with, that
+	// stored values expire by and that contact liveness is timed by.
+	// Defaults to time.Now; tests and the simulator set it to control time.
+	Now func() time.Time
+	// MaxClockSkew is how far ahead of Now a version from another node may
+	// be. Stores and replies with later versions are turned away. Defaults
+	// to DefaultMaxClockSkew.
+	MaxClockSkew time.Duration
+	// APIAddr, if set, is the loopback host:port to serve the JSON API on,
+	// over plain HTTP. The API is not authenticated, so anyone who can
+	// connect to it controls the node.
+	APIAddr string
+	// MetricsAddr, if set, is the host:port to serve /metrics on, over plain
+	// HTTP for Prometheus.
+	MetricsAddr string
 }
 
 type VDOmap struct {
@@ -40,55 +129,124 @@ type VDOmap struct {
 type KeySet struct {
 	Key        ID
 	Value      []byte
+	Version    Version
 	resultChan chan int
 }
 
 func NewKademlia(laddr string) *Kademlia {
-	// TODO: Initialize other state here as you add functionality.
+	return NewKademliaWithConfig(laddr, Config{})
+}
+
+func NewKademliaWithConfig(laddr string, conf Config) *Kademlia {
 	k := new(Kademlia)
-	k.NodeID = NewRandomID()
+	k.conf = conf
+	if k.conf.Now == nil {
+		k.conf.Now = time.Now
+	}
+	k.started = k.conf.Now()
+	if k.conf.MaxClockSkew <= 0 {
+		k.conf.MaxClockSkew = DefaultMaxClockSkew
+	}
+	k.clock = newHLC(k.conf.Now, k.conf.MaxClockSkew)
+	k.identity = conf.Identity
+	if k.identity == nil {
+		ident, err := NewIdentity(nil)
+		if err != nil {
+			log.Fatal("NewIdentity: ", err)
+		}
+		k.identity = ident
+	}
+	k.NodeID = k.identity.NodeID()
+	k.replay = newReplayCache(k.conf.Now)
+	k.observations = newObservations()
+	k.limiter = newLimiter(conf.Limits)
+	k.metrics = newMetrics()
 	k.contactChan = make(chan *Contact)
 	k.keyChan = make(chan *KeySet)
 	k.searchChan = make(chan *KeySet)
-	k.hashtable = make(map[ID][]byte)
+	k.swapChan = make(chan *swapSet)
+	k.sweepChan = make(chan chan int)
+	k.hashtable = make(map[ID]storedValue)
 	k.bucketChan = make(chan int)
 	k.bucketResultChan = make(chan []Contact)
+	k.done = make(chan struct{})
 	k.VDOmap.m = make(map[ID]VanashingDataObject)
 
 	// Set up RPC server
 	// NOTE: KademliaCore is just a wrapper around Kademlia. This type includes
 	// the RPC functions.
-	server := rpc.NewServer()
-	server.Register(&KademliaCore{k})
-	_, port, _ := net.SplitHostPort(laddr)
-	server.HandleHTTP(rpc.DefaultRPCPath+port, rpc.DefaultDebugPath+port)
-
-	l, err := net.Listen("tcp", laddr)
+	k.transport = conf.Transport
+	if k.transport == nil {
+		k.transport = &HTTPTransport{Insecure: conf.Insecure}
+	}
+	addrs, err := k.transport.Serve(laddr, k)
 	if err != nil {
 		log.Fatal("Listen: ", err)
 	}
-	// Run RPC server forever.
-	go http.Serve(l, nil)
+	if conf.APIAddr != "" {
+		k.api, err = listenAPI(conf.APIAddr, k)
+		if err != nil {
+			log.Fatal("Listen: ", err)
+		}
+	}
+	if conf.MetricsAddr != "" {
+		k.metricsListener, err = listenMetrics(conf.MetricsAddr, k)
+		if err != nil {
+			log.Fatal("Listen: ", err)
+		}
+	}
 
 	// Add self contact
-	hostname, port, _ := net.SplitHostPort(l.Addr().String())
+	_, port, _ := net.SplitHostPort(addrs[0].String())
 	port_int, _ := strconv.Atoi(port)
-	ipAddrStrings, _ := net.LookupHost(hostname)
-	var host net.IP
-	for i := 0; i < len(ipAddrStrings); i++ {
-		host = net.ParseIP(ipAddrStrings[i])
-		if host.To4() != nil {
-			break
-		}
+	hosts := advertisedHosts(addrs)
+	k.localHosts = hosts
+	SelfContact := Contact{NodeID: k.NodeID, Port: uint16(port_int)}
+	if len(hosts) > 0 {
+		SelfContact.Host = hosts[0]
+		SelfContact.AltHosts = hosts[1:]
 	}
-	SelfContact := Contact{k.NodeID, host, uint16(port_int)}
 	k.Routes = NewRoutingTable(SelfContact)
+	k.Routes.ping = k.probe
+	k.Routes.now = k.conf.Now
+	k.Routes.proximity = conf.Proximity
+	k.Routes.diversity = conf.Diversity
+	if conf.KRPC {
+		k.krpc, err = listenKRPC(k, addrs[0].String())
+		if err != nil {
+			log.Fatal("Listen: ", err)
+		}
+	}
 
 	go handleChan(k)
+	if !conf.ManualMaintenance {
+		go k.maintainLoop()
+	}
 
 	return k
 }
 
+// Stop serving RPCs and stop the node's background goroutines. The node must
+// not be used afterwards.
+func (k *Kademlia) Close() error {
+	k.closeOnce.Do(func() { close(k.done) })
+	if k.krpc != nil {
+		k.krpc.Close()
+	}
+	if k.api != nil {
+		k.api.Close()
+	}
+	if k.metricsListener != nil {
+		k.metricsListener.Close()
+	}
+	return k.transport.Close()
+}
+
+// The KRPC endpoint, or nil unless Config.KRPC is set.
+func (k *Kademlia) KRPC() *KRPC {
+	return k.krpc
+}
+
 type NotFoundError struct {
 	id  ID
 	msg string
@@ -107,20 +265,91 @@ func handleChan(k *Kademlia) {
 			k.Routes.Unlock()
 
 		case prefix_length := <-k.bucketChan:
-			k.bucketResultChan <- k.Routes.buckets[prefix_length]
+			// Evictions change buckets outside this goroutine, so hand out a
+			// copy.
+			k.Routes.RLock()
+			bucket := append([]Contact(nil), k.Routes.buckets[prefix_length]...)
+			k.Routes.RUnlock()
+			k.bucketResultChan <- bucket
 		case set := <-k.keyChan:
-			k.hashtable[set.Key] = set.Value
+			// Keep the newest version; set ends up with the one kept.
+			old, existed := k.hashtable[set.Key]
+			stored := !existed || !old.Version.Newer(set.Version)
+			if stored {
+				k.metrics.stored(existed, old.Value, set.Value)
+				k.hashtable[set.Key] = storedValue{set.Value, set.Version, time.Time{}}
+				k.clock.Observe(set.Version.Timestamp)
+			} else {
+				set.Value, set.Version = old.Value, old.Version
+			}
+			if set.resultChan != nil {
+				if stored {
+					set.resultChan <- 1
+				} else {
+					set.resultChan <- 0
+				}
+			}
+		case set := <-k.swapChan:
+			k.swap(set)
+		case result := <-k.sweepChan:
+			result <- k.sweep()
 		case set := <-k.searchChan:
-			set.Value = k.hashtable[set.Key]
+			stored := k.hashtable[set.Key]
+			if !stored.expired(k.conf.Now()) {
+				set.Value, set.Version = stored.Value, stored.Version
+			}
 			if set.Value == nil {
 				set.resultChan <- 0
 			} else {
 				set.resultChan <- 1
 			}
+		case <-k.done:
+			return
+		}
+	}
+}
+
+// Run pending routing table maintenance and drop values that expired long
+// ago.
+func (k *Kademlia) Maintain() {
+	k.Routes.RunEvictions()
+	result := make(chan int)
+	select {
+	case k.sweepChan <- result:
+		<-result
+	case <-k.done:
+	}
+}
+
+func (k *Kademlia) maintainLoop() {
+	interval := k.conf.LivenessInterval
+	if interval <= 0 {
+		interval = DefaultLivenessInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.Routes.kick:
+			k.Maintain()
+		case <-ticker.C:
+			k.CheckLiveness()
+			k.Maintain()
+		case <-k.done:
+			return
 		}
 	}
 }
 
+// Hand contact to the handler for the routing table, unless the node is
+// closed.
+func (k *Kademlia) update(contact *Contact) {
+	select {
+	case k.contactChan <- contact:
+	case <-k.done:
+	}
+}
+
 func (k *Kademlia) ReadFromBuckets(prefix_length int) []Contact {
 	k.bucketChan <- prefix_length
 	ret := <-k.bucketResultChan
@@ -128,14 +357,14 @@ func (k *Kademlia) ReadFromBuckets(prefix_length int) []Contact {
 }
 
 func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
-	if nodeId == k.Routes.SelfContact.NodeID {
-		return &k.Routes.SelfContact, nil
+	if nodeId == k.NodeID {
+		self := k.Routes.Self()
+		return &self, nil
 	}
 	prefix_length := nodeId.Xor(k.Routes.SelfContact.NodeID).PrefixLen()
 	bucket := k.ReadFromBuckets(prefix_length)
 	for _, value := range bucket {
 		if value.NodeID.Equals(nodeId) {
-			k.contactChan <- &value
 			return &value, nil
 		}
 	}
@@ -143,81 +372,133 @@ func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	return nil, &NotFoundError{nodeId, "Not found"}
 }
 
-// This is the function to perform the RPC
-func (k *Kademlia) DoPing(host net.IP, port uint16) string {
-	ping := PingMessage{k.Routes.SelfContact, NewRandomID()}
-	var pong PongMessage
+// call performs a signed RPC on the node at c and verifies the signed response.
+// If c.NodeID is the zero ID, any node may answer.
+func (k *Kademlia) call(c *Contact, method string, req, res signedMessage) error {
+	_, err := k.timedCall(c, method, req, res)
+	return err
+}
 
-	port_str := strconv.Itoa(int(port))
-	client, err := rpc.DialHTTPPath("tcp", Dest(host, port), rpc.DefaultRPCPath+port_str)
+// Like call, but also returns the round trip time of the call.
+func (k *Kademlia) timedCall(c *Contact, method string, req, res signedMessage) (time.Duration, error) {
+	dst, ok := k.Routes.route(c)
+	if !ok {
+		return 0, ErrNoRoute
+	}
+	k.sign(req)
+	var rtt time.Duration
+	var err error
+	if t, ok := k.transport.(timedTransport); ok {
+		rtt, err = t.timedCall(&dst, method, req, res)
+	} else {
+		start := time.Now()
+		err = k.transport.Call(&dst, method, req, res)
+		rtt = time.Since(start)
+	}
+	if err != nil && err.Error() == ErrRateLimited.Error() {
+		// The error crossed the network as a string.
+		err = ErrRateLimited
+	}
+	if err == nil {
+		err = k.verifyResponse(c.NodeID, req, res)
+	}
+	k.recordCall(c, rtt, err)
+	k.metrics.called(method, rtt, err)
 	if err != nil {
-		log.Fatal("DialHTTP: ", err)
+		return rtt, err
 	}
-	defer func() {
-		client.Close()
-	}()
-	err = client.Call("KademliaCore.Ping", ping, &pong)
+	k.observe(c.NodeID, dst.Host, res)
+	return rtt, nil
+}
+
+// Ping c without adding it to the routing table. Only its liveness record
+// is updated, so the table must not be locked by the caller.
+func (k *Kademlia) sendPing(c *Contact) (*PongMessage, error) {
+	pong, _, err := k.timedPing(c)
+	return pong, err
+}
+
+// Like sendPing, but also returns the round trip time of the ping.
+func (k *Kademlia) timedPing(c *Contact) (*PongMessage, time.Duration, error) {
+	ping := &PingMessage{Sender: k.Routes.Self(), MsgID: NewRandomID()}
+	pong := new(PongMessage)
+	rtt, err := k.timedCall(c, "Ping", ping, pong)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if c.NodeID != (ID{}) && pong.Sender.NodeID != c.NodeID {
+		return nil, rtt, ErrIdentityMismatch
+	}
+	if len(pong.Sig.Data) != 0 && IDFromPublicKey(pong.Sig.PublicKey) != pong.Sender.NodeID {
+		return nil, rtt, ErrIdentityMismatch
+	}
+	return pong, rtt, nil
+}
+
+// Ping c for the routing table, which only needs the round trip time.
+func (k *Kademlia) probe(c *Contact) (time.Duration, error) {
+	_, rtt, err := k.timedPing(c)
+	return rtt, err
+}
+
+// This is the function to perform the RPC
+func (k *Kademlia) DoPing(host net.IP, port uint16) string {
+	pong, err := k.sendPing(&Contact{Host: host, Port: port})
 	if err != nil {
-		log.Fatal("Call: ", err)
 		return "ERR: " + err.Error()
 	}
-	k.contactChan <- &(&pong).Sender
+	k.update(&pong.Sender)
 
 	return "OK: " + pong.MsgID.AsString()
 }
 
 func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
-	req := StoreRequest{k.Routes.SelfContact, NewRandomID(), key, value}
-	var res StoreResult
+	req := &StoreRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: value, Version: k.NewVersion()}
+	res := new(StoreResult)
 
-	port_str := strconv.Itoa(int(contact.Port))
-	client, err := rpc.DialHTTPPath("tcp", Dest(contact.Host, contact.Port), rpc.DefaultRPCPath+port_str)
+	err := k.call(contact, "Store", req, res)
 	if err != nil {
-		log.Fatal("DialHTTP: ", err)
-	}
-	defer client.Close()
-	err = client.Call("KademliaCore.Store", req, &res)
-	if err != nil {
-		log.Fatal("Call: ", err)
 		return "ERR: " + err.Error()
 	}
 	return "OK: " + res.MsgID.AsString()
 }
 
 func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
-	req := FindNodeRequest{k.Routes.SelfContact, NewRandomID(), searchKey}
-	var res FindNodeResult
+	req := &FindNodeRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), NodeID: searchKey}
+	res := new(FindNodeResult)
 
-	port_str := strconv.Itoa(int(contact.Port))
-	client, err := rpc.DialHTTPPath("tcp", Dest(contact.Host, contact.Port), rpc.DefaultRPCPath+port_str)
-	if err != nil {
-		log.Fatal("DialHTTP: ", err)
-	}
-	defer client.Close()
-	err = client.Call("KademliaCore.FindNode", req, &res)
+	err := k.call(contact, "FindNode", req, res)
 	if err != nil {
-		log.Fatal("Call: ", err)
 		return "ERR: " + err.Error()
 	}
 	return "OK: " + res.MsgID.AsString()
 }
 
 func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) string {
-	req := FindValueRequest{*contact, NewRandomID(), searchKey}
+	value, version, _, err := k.FindValue(contact, searchKey)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	if value == nil {
+		return "ERR: cannot find key"
+	}
+	return "OK: value --> " + string(value) + versionSuffix(version)
+}
+
+// Ask contact for the value stored under searchKey. Returns the value and its
+// version, or nil and the contacts it knows closest to the key.
+func (k *Kademlia) FindValue(contact *Contact, searchKey ID) ([]byte, Version, []Contact, error) {
+	req := &FindValueRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: searchKey}
 	res := new(FindValueResult)
 
-	port_str := strconv.Itoa(int(contact.Port))
-	client, err := rpc.DialHTTPPath("tcp", Dest(contact.Host, contact.Port), rpc.DefaultRPCPath+port_str)
-	if err != nil {
-		log.Fatal("DialHTTP: ", err)
+	if err := k.call(contact, "FindValue", req, res); err != nil {
+		return nil, Version{}, nil, err
 	}
-	defer client.Close()
-	err = client.Call("KademliaCore.FindValue", req, &res)
-	if err != nil {
-		log.Fatal("Call: ", err)
-		return "ERR: " + err.Error()
+	if k.clock.ahead(res.Version.Timestamp) {
+		return nil, Version{}, nil, ErrFutureVersion
 	}
-	return "OK: value --> " + string(res.Value)
+	k.clock.Observe(res.Version.Timestamp)
+	return res.Value, res.Version, res.Nodes, nil
 }
 
 func (k *Kademlia) LocalFindValue(searchKey ID) string {
@@ -225,9 +506,9 @@ func (k *Kademlia) LocalFindValue(searchKey ID) string {
 	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
 	keys, found := k.LocalFindValueHelper(searchKey)
 	if found == 1 {
-		return "OK: value --> " + string(keys.Value)
+		return "OK: value --> " + string(keys.Value) + versionSuffix(keys.Version)
 	}
-	return "Err: cannot find key"
+	return "ERR: cannot find key"
 }
 
 func (k *Kademlia) LocalFindValueHelper(searchKey ID) (ret *KeySet, found int) {
@@ -246,28 +527,26 @@ func (k *Kademlia) DoIterativeFindNode(id ID) string {
 	if len(ret.contacts) > 0 {
 		return "Success itertativefindnode"
 	} else {
-		return "Failed to iterativefindnode"
+		return "ERR: Failed to iterativefindnode"
 	}
 }
 func (k *Kademlia) DoIterativeStore(key ID, value []byte) string {
 	// For project 2!
-	ret := k.IterativeFindNode(key, false)
-	for _, c := range ret.contacts {
-		new_c := c
-		go k.DoStore(&new_c, key, value)
+	ret, err := k.IterativeStore(key, value, 1)
+	if err != nil {
+		return "ERR: " + err.Error()
 	}
-
-	return "Success store!"
+	return fmt.Sprintf("OK: stored at %d nodes, %d failed", len(ret.Stored), len(ret.Failed))
 
 }
 func (k *Kademlia) DoIterativeFindValue(key ID) string {
 	// For project 2!
 	ret := k.IterativeFindNode(key, true)
 	if ret.value != nil {
-		str := "Key: " + ret.key.AsString() + " --> Value: " + string(ret.value)
+		str := "Key: " + ret.key.AsString() + " --> Value: " + string(ret.value) + versionSuffix(ret.version)
 		return str
 	} else {
-		return "Cannot find value"
+		return "ERR: Cannot find value"
 	}
 }
 
@@ -298,50 +577,69 @@ func (k *Kademlia) DoStoreVDO(newVDO VanashingDataObject, timeout int) string {
 		return "Success!"
 
 	} else {
-		return "Fail!"
+		return "ERR: Fail!"
 	}
 }
 
 func (k *Kademlia) DoGetVDO(nodeid ID, vdoid ID) string {
+	data, err := k.Unvanish(nodeid, vdoid)
+	if err == ErrUnvanish {
+		return "ERR: Unvanish Fail!"
+	} else if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return string(data)
+
+}
+
+// Get the VDO with vdoid from the node closest to nodeid and recover its data.
+func (k *Kademlia) Unvanish(nodeid ID, vdoid ID) ([]byte, error) {
+	vdo, err := k.fetchVDO(nodeid, vdoid)
+	if err != nil {
+		return nil, err
+	}
+	data := UnvanishData(k, vdo)
+	if len(data) == 0 {
+		return nil, ErrUnvanish
+	}
+	return data, nil
+}
+
+// Get the VDO with vdoid from the node closest to nodeid.
+func (k *Kademlia) fetchVDO(nodeid ID, vdoid ID) (VanashingDataObject, error) {
 	//find the right contact using FindClosest
 	var right_contact Contact
 	if nodeid == k.NodeID {
-		right_contact = k.Routes.SelfContact
+		right_contact = k.Routes.Self()
 	} else {
 		contacts := k.Routes.FindClosest(nodeid, 20)
+		if len(contacts) == 0 {
+			return VanashingDataObject{}, ErrUnknownContact
+		}
 		right_contact = contacts[0]
 	}
 
 	//using GetVDO to retrieve the right VDO
-	req := GetVDORequest{right_contact, NewRandomID(), vdoid}
+	req := &GetVDORequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), VdoID: vdoid}
 	res := new(GetVDOResult)
 
-	port_str := strconv.Itoa(int(right_contact.Port))
-	client, err := rpc.DialHTTPPath("tcp", Dest(right_contact.Host, right_contact.Port), rpc.DefaultRPCPath+port_str)
-	if err != nil {
-		log.Fatal("DialHTTP: ", err)
-	}
-	defer client.Close()
-	err = client.Call("KademliaCore.GetVDO", req, &res)
-
-	if err != nil {
-		log.Fatal("Call: ", err)
-		return "ERR: " + err.Error()
+	if err := k.call(&right_contact, "GetVDO", req, res); err != nil {
+		return VanashingDataObject{}, err
 	}
-
-	data := string(UnvanishData(k, res.VDO))
-
-	if len(data) != 0 {
-		//log.Fatal("Unvanish Success!")
-	} else {
-		log.Fatal("Unvanish Fail!")
+	if res.VDO.AccessKey == 0 {
+		// The node does not have it.
+		return VanashingDataObject{}, ErrUnknownVDO
 	}
-	return data
-
+	return res.VDO, nil
 }
 
 ////////////////////////for project 3/////////////////////////////
 
+// The HTTP path of the RPC endpoint of the node listening on port.
+func rpcPath(port uint16) string {
+	return rpc.DefaultRPCPath + strconv.Itoa(int(port))
+}
+
 func Dest(host net.IP, port uint16) string {
-	return host.String() + ":" + strconv.FormatInt(int64(port), 10)
+	return net.JoinHostPort(host.String(), strconv.FormatInt(int64(port), 10))
 }
@@ -137,3 +137,26 @@ func TestDoGetVDO(t *testing.T) {
 	}
 
 }
+
+func TestHandlersAfterClose(t *testing.T) {
+	network := NewMemoryNetwork()
+	conf := Config{ManualMaintenance: true, Unsigned: true, AllowUnsigned: true, Transport: network.Transport()}
+	k := NewKademliaWithConfig("127.0.0.1:1", conf)
+	k.Close()
+
+	sender := Contact{NodeID: NewRandomID(), Host: net.IPv4(127, 0, 0, 2), Port: 1}
+	kc := &KademliaCore{kademlia: k}
+	done := make(chan error)
+	go func() {
+		kc.Ping(PingMessage{Sender: sender, MsgID: NewRandomID()}, new(PongMessage))
+		done <- kc.Store(StoreRequest{Sender: sender, MsgID: NewRandomID(), Key: NewRandomID(), Value: []byte("v"), Version: k.NewVersion()}, new(StoreResult))
+	}()
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Error("store on a closed node: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handlers blocked after Close")
+	}
+}
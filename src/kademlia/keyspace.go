@@ -0,0 +1,58 @@
+package kademlia
+
+// Contains keys derived from names, so that applications can store values
+// under "config/alice" instead of a hand-made 160-bit key, and strict parsing
+// of hex IDs.
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+var ErrBadID = errors.New("want 40 hex digits")
+
+// A set of names mapped to keys. Keyspaces with different namespaces map the
+// same name to unrelated keys, so applications sharing a network do not step
+// on each other's names. The zero Keyspace has the empty namespace.
+type Keyspace struct {
+	Namespace string
+}
+
+func NewKeyspace(namespace string) Keyspace {
+	return Keyspace{namespace}
+}
+
+// The key of name: the SHA-1 hash of the namespace's length as a uvarint, the
+// namespace and the name. The empty namespace is no exception, so no name in
+// it hashes like a name in another.
+func (ks Keyspace) Key(name string) ID {
+	h := sha1.New()
+	var n [binary.MaxVarintLen64]byte
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(ks.Namespace)))])
+	h.Write([]byte(ks.Namespace))
+	h.Write([]byte(name))
+	var ret ID
+	copy(ret[:], h.Sum(nil))
+	return ret
+}
+
+// The key of name in the empty namespace, the SHA-1 hash of a zero byte and
+// the name.
+func KeyFromName(name string) ID {
+	return Keyspace{}.Key(name)
+}
+
+// Parse an ID written as exactly 40 hex digits. Unlike IDFromString, it
+// rejects strings of any other length.
+func ParseID(s string) (ID, error) {
+	var ret ID
+	if len(s) != 2*IDBytes {
+		return ret, ErrBadID
+	}
+	if _, err := hex.Decode(ret[:], []byte(s)); err != nil {
+		return ret, ErrBadID
+	}
+	return ret, nil
+}
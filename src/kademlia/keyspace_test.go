@@ -0,0 +1,42 @@
+package kademlia
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyFromName(t *testing.T) {
+	// SHA-1 of "\x00abc".
+	if got := KeyFromName("abc").AsString(); got != "dd3742ec1a4d2a5b563a2b62aef7fc4a46fa6cca" {
+		t.Errorf("got %v", got)
+	}
+	if NewKeyspace("").Key("abc") != KeyFromName("abc") {
+		t.Error("the empty namespace changes keys")
+	}
+	app := NewKeyspace("app")
+	if app.Key("abc") == KeyFromName("abc") || app.Key("abc") != app.Key("abc") {
+		t.Error("namespaced key")
+	}
+	// The namespace and the name are not simply concatenated.
+	if NewKeyspace("ab").Key("c") == NewKeyspace("a").Key("bc") {
+		t.Error("namespaces collide")
+	}
+	// Nor can a name in the empty namespace pass for a namespace.
+	if KeyFromName("\x03appabc") == app.Key("abc") {
+		t.Error("the empty namespace collides with another")
+	}
+}
+
+func TestParseID(t *testing.T) {
+	id := NewRandomID()
+	for _, s := range []string{id.AsString(), strings.ToUpper(id.AsString())} {
+		if got, err := ParseID(s); err != nil || got != id {
+			t.Errorf("%s: got %v, %v", s, got.AsString(), err)
+		}
+	}
+	for _, s := range []string{"", "abcd", id.AsString() + "00", id.AsString()[1:], "zz" + id.AsString()[2:]} {
+		if _, err := ParseID(s); err != ErrBadID {
+			t.Errorf("%q: got %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package kademlia
+
+// Contains the BitTorrent Mainline DHT protocol (BEP 5): bencoded KRPC
+// messages over UDP. It listens on the UDP port with the same number as the
+// transport's, so one Contact describes a node for both protocols.
+//
+// KRPC shares the node's state with the native RPCs. Nodes heard from over
+// KRPC go into the node's routing table, and find_node and get_peers answer
+// from it. KRPC messages are neither signed nor encrypted, so a forged contact
+// can get in, but the native transport pins node IDs, so it fails the native
+// calls made to it and is dropped like any dead contact. Announced peers are
+// stored in the node's hashtable under the info hash in the peer keyspace, as
+// the compact addresses of the live peers, where native lookups find them
+// too; a keyspace of their own keeps announces from overwriting other values.
+// peers.go tracks when each peer expires.
+//
+// Queries are handled by at most maxKRPCHandlers goroutines at once, and each
+// must pass the node's rate limits under the method "krpc_" plus the query's
+// method; queries beyond either are dropped, as UDP senders retry.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait for a reply.
+	KRPCTimeout = 5 * time.Second
+	// Announce tokens are valid for between one and two of these.
+	tokenRotation = 5 * time.Minute
+
+	compactNodeLen = IDBytes + 6
+	compactPeerLen = 6
+
+	// Queries handled at once.
+	maxKRPCHandlers = 64
+)
+
+// The keyspace announced peers are stored in, by info hash.
+var peerspace = NewKeyspace("krpc-peers")
+
+// Error codes from BEP 5.
+const (
+	KRPCGenericError  = 201
+	KRPCServerError   = 202
+	KRPCProtocolError = 203
+	KRPCMethodUnknown = 204
+)
+
+var ErrKRPCTimeout = errors.New("krpc: query timed out")
+
+// An error message from the remote node.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return "krpc: error " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+// What a get_peers query returns: peers for the info hash if the node has
+// any, otherwise the closest nodes it knows. Token authorizes an announce.
+type GetPeersResult struct {
+	Peers []*net.TCPAddr
+	Nodes []Contact
+	Token string
+}
+
+type KRPC struct {
+	kademlia *Kademlia
+	conn     *net.UDPConn
+	peers    *peerStore
+	// Serializes storing the peers of an info hash, so that a newer version
+	// never holds an older list.
+	publishMu sync.Mutex
+	handlers  chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]chan map[string]interface{}
+	nextTID uint16
+
+	secretMu   sync.Mutex
+	secret     [20]byte
+	oldSecret  [20]byte
+	secretTime time.Time
+}
+
+func listenKRPC(k *Kademlia, laddr string) (*KRPC, error) {
+	addr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	kr := &KRPC{kademlia: k, conn: conn, pending: make(map[string]chan map[string]interface{})}
+	kr.peers = newPeerStore(k.conf.Now)
+	kr.handlers = make(chan struct{}, maxKRPCHandlers)
+	kr.rotateSecret()
+	kr.oldSecret = kr.secret
+	go kr.serve()
+	return kr, nil
+}
+
+// The address the node receives KRPC messages on.
+func (kr *KRPC) Addr() *net.UDPAddr {
+	return kr.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (kr *KRPC) Close() error {
+	return kr.conn.Close()
+}
+
+func (kr *KRPC) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := kr.conn.ReadFromUDP(buf)
+		if err != nil {
+			// Closed.
+			return
+		}
+		v, err := bdecode(buf[:n])
+		if err != nil {
+			continue
+		}
+		msg, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tid, _ := msg["t"].(string)
+		switch y, _ := msg["y"].(string); y {
+		case "q":
+			select {
+			case kr.handlers <- struct{}{}:
+				go func() {
+					kr.handleQuery(from, tid, msg)
+					<-kr.handlers
+				}()
+			default:
+				// Too many queries at once.
+			}
+		case "r", "e":
+			kr.mu.Lock()
+			ch := kr.pending[tid+from.String()]
+			delete(kr.pending, tid+from.String())
+			kr.mu.Unlock()
+			if ch != nil {
+				ch <- msg
+			}
+		}
+	}
+}
+
+func (kr *KRPC) send(to *net.UDPAddr, msg map[string]interface{}) error {
+	data, err := bencode(msg)
+	if err != nil {
+		return err
+	}
+	_, err = kr.conn.WriteToUDP(data, to)
+	return err
+}
+
+func (kr *KRPC) sendError(to *net.UDPAddr, tid string, code int, message string) {
+	kr.send(to, map[string]interface{}{
+		"t": tid,
+		"y": "e",
+		"e": []interface{}{code, message},
+	})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// SERVER
+///////////////////////////////////////////////////////////////////////////////
+func (kr *KRPC) handleQuery(from *net.UDPAddr, tid string, msg map[string]interface{}) {
+	method, _ := msg["q"].(string)
+	release, err := kr.kademlia.limiter.admit(from.IP, "krpc_"+method)
+	if err != nil {
+		return
+	}
+	defer release()
+	args, _ := msg["a"].(map[string]interface{})
+	sender, ok := dictID(args, "id")
+	if !ok {
+		kr.sendError(from, tid, KRPCProtocolError, "invalid id")
+		return
+	}
+
+	var res map[string]interface{}
+	var kerr *KRPCError
+	switch method {
+	case "ping":
+		res = kr.response()
+	case "find_node":
+		target, ok := dictID(args, "target")
+		if !ok {
+			kerr = &KRPCError{KRPCProtocolError, "invalid target"}
+			break
+		}
+		res = kr.response()
+		res["nodes"] = string(compactNodes(kr.closest(target, sender)))
+	case "get_peers":
+		infoHash, ok := dictID(args, "info_hash")
+		if !ok {
+			kerr = &KRPCError{KRPCProtocolError, "invalid info_hash"}
+			break
+		}
+		res = kr.response()
+		res["token"] = kr.token(from.IP, kr.currentSecret())
+		if peers := kr.storedPeers(infoHash); len(peers) > 0 {
+			values := make([]interface{}, 0, len(peers))
+			for _, peer := range peers {
+				values = append(values, string(peer))
+			}
+			res["values"] = values
+		} else {
+			res["nodes"] = string(compactNodes(kr.closest(infoHash, sender)))
+		}
+	case "announce_peer":
+		kerr = kr.announce(from, args)
+		res = kr.response()
+	default:
+		kerr = &KRPCError{KRPCMethodUnknown, "method unknown"}
+	}
+	if kerr != nil {
+		kr.sendError(from, tid, kerr.Code, kerr.Message)
+		return
+	}
+
+	if sender != kr.kademlia.NodeID {
+		if c, ok := udpContact(sender, from); ok {
+			kr.update(c)
+		}
+	}
+	kr.send(from, map[string]interface{}{"t": tid, "y": "r", "r": res})
+}
+
+func (kr *KRPC) announce(from *net.UDPAddr, args map[string]interface{}) *KRPCError {
+	infoHash, ok := dictID(args, "info_hash")
+	if !ok {
+		return &KRPCError{KRPCProtocolError, "invalid info_hash"}
+	}
+	token, _ := args["token"].(string)
+	if !kr.validToken(from.IP, token) {
+		return &KRPCError{KRPCProtocolError, "bad token"}
+	}
+	port, _ := args["port"].(int64)
+	if implied, _ := args["implied_port"].(int64); implied != 0 {
+		port = int64(from.Port)
+	}
+	ip := from.IP.To4()
+	if ip == nil || port <= 0 || port > 65535 {
+		return &KRPCError{KRPCProtocolError, "invalid port"}
+	}
+	peer := make([]byte, compactPeerLen)
+	copy(peer, ip)
+	binary.BigEndian.PutUint16(peer[4:], uint16(port))
+
+	if !kr.peers.add(infoHash, peer) {
+		return &KRPCError{KRPCServerError, "too many peers"}
+	}
+	kr.publish(infoHash)
+	return nil
+}
+
+// The key the peers of infoHash are stored under.
+func peerKey(infoHash ID) ID {
+	return peerspace.Key(string(infoHash[:]))
+}
+
+// Store the live peers of infoHash in the hashtable, or nothing if there are
+// none.
+func (kr *KRPC) publish(infoHash ID) {
+	kr.publishMu.Lock()
+	defer kr.publishMu.Unlock()
+	var value []byte
+	for _, peer := range kr.peers.all(infoHash) {
+		value = append(value, peer...)
+	}
+	k := kr.kademlia
+	set := &KeySet{peerKey(infoHash), value, k.NewVersion(), make(chan int)}
+	select {
+	case k.keyChan <- set:
+		<-set.resultChan
+	case <-k.done:
+	}
+}
+
+// Up to maxPeerValues of the peers stored for infoHash, picked at random.
+// Peers that have expired since are left out, and the list stored again
+// without them.
+func (kr *KRPC) storedPeers(infoHash ID) [][]byte {
+	set, found := kr.kademlia.LocalFindValueHelper(peerKey(infoHash))
+	if found == 0 || len(set.Value)%compactPeerLen != 0 {
+		return nil
+	}
+	var ret [][]byte
+	stale := false
+	for i := 0; i < len(set.Value); i += compactPeerLen {
+		peer := set.Value[i : i+compactPeerLen]
+		if kr.peers.has(infoHash, peer) {
+			ret = append(ret, peer)
+		} else {
+			stale = true
+		}
+	}
+	if stale {
+		kr.publish(infoHash)
+	}
+	return pickPeers(ret)
+}
+
+func (kr *KRPC) response() map[string]interface{} {
+	return map[string]interface{}{"id": string(kr.kademlia.NodeID[:])}
+}
+
+func (kr *KRPC) closest(target ID, requester ID) []Contact {
+	return withoutContact(kr.kademlia.Routes.FindClosest(target, K+1), requester, K)
+}
+
+// Add a node heard from over KRPC to the routing table.
+func (kr *KRPC) update(c *Contact) {
+	kr.kademlia.update(c)
+}
+
+// Tokens are an HMAC of the requester's IP, so only that IP can use them.
+func (kr *KRPC) token(ip net.IP, secret [20]byte) string {
+	mac := hmac.New(sha1.New, secret[:])
+	mac.Write(ip.To16())
+	return string(mac.Sum(nil)[:8])
+}
+
+func (kr *KRPC) validToken(ip net.IP, token string) bool {
+	current := kr.currentSecret()
+	kr.secretMu.Lock()
+	old := kr.oldSecret
+	kr.secretMu.Unlock()
+	return hmac.Equal([]byte(token), []byte(kr.token(ip, current))) ||
+		hmac.Equal([]byte(token), []byte(kr.token(ip, old)))
+}
+
+func (kr *KRPC) currentSecret() [20]byte {
+	kr.secretMu.Lock()
+	defer kr.secretMu.Unlock()
+	if kr.kademlia.conf.Now().Sub(kr.secretTime) > tokenRotation {
+		kr.oldSecret = kr.secret
+		kr.rotateSecretLocked()
+	}
+	return kr.secret
+}
+
+func (kr *KRPC) rotateSecret() {
+	kr.secretMu.Lock()
+	defer kr.secretMu.Unlock()
+	kr.rotateSecretLocked()
+}
+
+func (kr *KRPC) rotateSecretLocked() {
+	rand.Read(kr.secret[:])
+	kr.secretTime = kr.kademlia.conf.Now()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// CLIENT
+///////////////////////////////////////////////////////////////////////////////
+
+// Send a query and wait for the reply. The responder goes into the routing
+// table.
+func (kr *KRPC) query(to *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(kr.kademlia.NodeID[:])
+	ch := make(chan map[string]interface{}, 1)
+	kr.mu.Lock()
+	kr.nextTID++
+	tid := string([]byte{byte(kr.nextTID >> 8), byte(kr.nextTID)})
+	key := tid + to.String()
+	kr.pending[key] = ch
+	kr.mu.Unlock()
+
+	err := kr.send(to, map[string]interface{}{"t": tid, "y": "q", "q": method, "a": args})
+	if err != nil {
+		kr.forget(key)
+		return nil, err
+	}
+	var msg map[string]interface{}
+	select {
+	case msg = <-ch:
+	case <-time.After(KRPCTimeout):
+		kr.forget(key)
+		return nil, ErrKRPCTimeout
+	}
+
+	if msg["y"] == "e" {
+		kerr := &KRPCError{Code: KRPCGenericError}
+		if e, _ := msg["e"].([]interface{}); len(e) == 2 {
+			code, _ := e[0].(int64)
+			kerr.Code = int(code)
+			kerr.Message, _ = e[1].(string)
+		}
+		return nil, kerr
+	}
+	res, _ := msg["r"].(map[string]interface{})
+	id, ok := dictID(res, "id")
+	if !ok {
+		return nil, &KRPCError{KRPCProtocolError, "invalid id in response"}
+	}
+	if c, ok := udpContact(id, to); ok && id != kr.kademlia.NodeID {
+		kr.update(c)
+	}
+	return res, nil
+}
+
+func (kr *KRPC) forget(key string) {
+	kr.mu.Lock()
+	delete(kr.pending, key)
+	kr.mu.Unlock()
+}
+
+// Ping the node at addr and return its ID.
+func (kr *KRPC) Ping(addr *net.UDPAddr) (ID, error) {
+	res, err := kr.query(addr, "ping", map[string]interface{}{})
+	if err != nil {
+		return ID{}, err
+	}
+	id, _ := dictID(res, "id")
+	return id, nil
+}
+
+// Ask the node at addr for the nodes closest to target.
+func (kr *KRPC) FindNode(addr *net.UDPAddr, target ID) ([]Contact, error) {
+	res, err := kr.query(addr, "find_node", map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := res["nodes"].(string)
+	return parseCompactNodes([]byte(nodes))
+}
+
+func (kr *KRPC) GetPeers(addr *net.UDPAddr, infoHash ID) (*GetPeersResult, error) {
+	res, err := kr.query(addr, "get_peers", map[string]interface{}{"info_hash": string(infoHash[:])})
+	if err != nil {
+		return nil, err
+	}
+	ret := new(GetPeersResult)
+	ret.Token, _ = res["token"].(string)
+	values, _ := res["values"].([]interface{})
+	for _, v := range values {
+		peer, _ := v.(string)
+		if len(peer) != compactPeerLen {
+			return nil, &KRPCError{KRPCProtocolError, "invalid peer"}
+		}
+		ret.Peers = append(ret.Peers, &net.TCPAddr{
+			IP:   net.IP([]byte(peer[:4])),
+			Port: int(binary.BigEndian.Uint16([]byte(peer[4:]))),
+		})
+	}
+	nodes, _ := res["nodes"].(string)
+	if ret.Nodes, err = parseCompactNodes([]byte(nodes)); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Announce that this host serves infoHash on port, using the token from an
+// earlier get_peers to the same node.
+func (kr *KRPC) AnnouncePeer(addr *net.UDPAddr, infoHash ID, port uint16, token string) error {
+	_, err := kr.query(addr, "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      int(port),
+		"token":     token,
+	})
+	return err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// ENCODING
+///////////////////////////////////////////////////////////////////////////////
+func dictID(dict map[string]interface{}, key string) (id ID, ok bool) {
+	s, _ := dict[key].(string)
+	if len(s) != IDBytes {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+func udpContact(id ID, addr *net.UDPAddr) (*Contact, bool) {
+	if addr.Port <= 0 || addr.Port > 65535 {
+		return nil, false
+	}
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &Contact{NodeID: id, Host: ip, Port: uint16(addr.Port)}, true
+}
+
+// Compact node info: the ID, IPv4 address and port of each node. Nodes
+// without an IPv4 address are left out.
+func compactNodes(contacts []Contact) []byte {
+	ret := make([]byte, 0, len(contacts)*compactNodeLen)
+	for _, c := range contacts {
+		ip := c.Host.To4()
+		if ip == nil {
+			continue
+		}
+		ret = append(ret, c.NodeID[:]...)
+		ret = append(ret, ip...)
+		ret = append(ret, byte(c.Port>>8), byte(c.Port))
+	}
+	return ret
+}
+
+func parseCompactNodes(data []byte) ([]Contact, error) {
+	if len(data)%compactNodeLen != 0 {
+		return nil, &KRPCError{KRPCProtocolError, "invalid nodes"}
+	}
+	ret := make([]Contact, 0, len(data)/compactNodeLen)
+	for i := 0; i < len(data); i += compactNodeLen {
+		var c Contact
+		copy(c.NodeID[:], data[i:])
+		c.Host = net.IPv4(data[i+IDBytes], data[i+IDBytes+1], data[i+IDBytes+2], data[i+IDBytes+3])
+		c.Port = binary.BigEndian.Uint16(data[i+IDBytes+4:])
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
@@ -0,0 +1,201 @@
+package kademlia
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBencode(t *testing.T) {
+	msg := map[string]interface{}{
+		"t": "aa",
+		"y": "q",
+		"q": "ping",
+		"a": map[string]interface{}{"id": "abcdefghij0123456789"},
+	}
+	data, err := bencode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The example from BEP 5.
+	expected := "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"
+	if string(data) != expected {
+		t.Errorf("encoded %q, expected %q", data, expected)
+	}
+	v, err := bdecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, msg) {
+		t.Errorf("decoded %v, expected %v", v, msg)
+	}
+	v, err = bdecode([]byte("li-3el0:ee"))
+	if err != nil || !reflect.DeepEqual(v, []interface{}{int64(-3), []interface{}{""}}) {
+		t.Errorf("decoded %v, %v", v, err)
+	}
+
+	for _, bad := range []string{"", "i12", "5:abc", "l", "d1:ae", "di1ei2ee", "1:ab", "ie"} {
+		if _, err := bdecode([]byte(bad)); err != ErrMalformedBencode {
+			t.Errorf("decoding %q: expected ErrMalformedBencode, got %v", bad, err)
+		}
+	}
+}
+
+func TestKRPC(t *testing.T) {
+	nodes := make([]*Kademlia, 3)
+	for i := range nodes {
+		nodes[i] = NewKademliaWithConfig("localhost:"+strconv.Itoa(13100+i), Config{KRPC: true})
+		defer nodes[i].Close()
+	}
+	addr1 := nodes[1].KRPC().Addr()
+	addr2 := nodes[2].KRPC().Addr()
+
+	id, err := nodes[0].KRPC().Ping(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nodes[1].NodeID {
+		t.Error("ping returned the wrong ID")
+	}
+	if _, err := nodes[2].KRPC().Ping(addr1); err != nil {
+		t.Fatal(err)
+	}
+	// Both pings reached the routing tables.
+	nodes[0].ReadFromBuckets(0)
+	nodes[1].ReadFromBuckets(0)
+	if !hasContact(nodes[1].Routes, nodes[0].NodeID) {
+		t.Error("queried node did not add the sender")
+	}
+	if !hasContact(nodes[0].Routes, nodes[1].NodeID) {
+		t.Error("querying node did not add the responder")
+	}
+
+	found, err := nodes[0].KRPC().FindNode(addr1, nodes[2].NodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].NodeID != nodes[2].NodeID || found[0].Port != uint16(addr2.Port) {
+		t.Errorf("find_node returned %v", found)
+	}
+
+	infoHash := NewRandomID()
+	res, err := nodes[0].KRPC().GetPeers(addr1, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 0 || len(res.Nodes) != 1 || res.Token == "" {
+		t.Errorf("get_peers returned %v", res)
+	}
+	if err := nodes[0].KRPC().AnnouncePeer(addr1, infoHash, 6881, "bogus"); err == nil {
+		t.Error("announce with a bad token succeeded")
+	} else if kerr, ok := err.(*KRPCError); !ok || kerr.Code != KRPCProtocolError {
+		t.Errorf("expected a protocol error, got %v", err)
+	}
+	if err := nodes[0].KRPC().AnnouncePeer(addr1, infoHash, 6881, res.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = nodes[2].KRPC().GetPeers(addr1, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].Port != 6881 || !res.Peers[0].IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("get_peers returned peers %v", res.Peers)
+	}
+	// The peers are stored in the hashtable, apart from other values.
+	if keys, found := nodes[1].LocalFindValueHelper(peerKey(infoHash)); found != 1 || !bytes.Equal(keys.Value, []byte{127, 0, 0, 1, 0x1a, 0xe1}) {
+		t.Error("announced peer not in the hashtable")
+	}
+	if _, found := nodes[1].LocalFindValueHelper(infoHash); found != 0 {
+		t.Error("announced peers stored under the info hash")
+	}
+}
+
+func TestKRPCLimits(t *testing.T) {
+	limits := Limits{PerIP: map[string]RateLimit{"krpc_ping": {Rate: 0.001, Burst: 1}}}
+	server := NewKademliaWithConfig("localhost:13103", Config{KRPC: true, Limits: limits})
+	defer server.Close()
+	client := NewKademliaWithConfig("localhost:13104", Config{KRPC: true})
+	defer client.Close()
+
+	if _, err := client.KRPC().Ping(server.KRPC().Addr()); err != nil {
+		t.Fatal(err)
+	}
+	// The second ping is dropped, not answered.
+	ping := map[string]interface{}{"t": "zz", "y": "q", "q": "ping", "a": map[string]interface{}{"id": string(client.NodeID[:])}}
+	if err := client.KRPC().send(server.KRPC().Addr(), ping); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; server.LimiterStats().RateLimited["krpc_ping"] == 0; i++ {
+		if i == 100 {
+			t.Fatal("ping over the limit not turned away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := server.LimiterStats(); stats.Admitted["krpc_ping"] != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func hasContact(table *RoutingTable, id ID) bool {
+	closest := table.FindClosest(id, 1)
+	return len(closest) == 1 && closest[0].NodeID == id
+}
+
+func TestPeerStore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newPeerStore(func() time.Time { return now })
+	infoHash := NewRandomID()
+	peer := func(i int, port uint16) []byte {
+		return []byte{10, byte(i >> 16), byte(i >> 8), byte(i), byte(port >> 8), byte(port)}
+	}
+
+	// Another port at the same IP replaces the first.
+	s.add(infoHash, peer(1, 6881))
+	s.add(infoHash, peer(1, 6882))
+	if got := s.get(infoHash); len(got) != 1 || !bytes.Equal(got[0], peer(1, 6882)) {
+		t.Errorf("got %v", got)
+	}
+	if !s.has(infoHash, peer(1, 6882)) || s.has(infoHash, peer(1, 6881)) {
+		t.Error("has a replaced port")
+	}
+
+	// A reply holds no more than fits a datagram.
+	for i := 2; i <= 2*maxPeerValues; i++ {
+		s.add(infoHash, peer(i, 6881))
+	}
+	values := make([]interface{}, 0)
+	for _, p := range s.get(infoHash) {
+		values = append(values, string(p))
+	}
+	if len(values) != maxPeerValues {
+		t.Errorf("%d values", len(values))
+	}
+	reply, _ := bencode(map[string]interface{}{"t": "aa", "y": "r", "r": map[string]interface{}{
+		"id": string(infoHash[:]), "token": "12345678", "values": values,
+	}})
+	if len(reply) > 1280 {
+		t.Errorf("reply of %d bytes", len(reply))
+	}
+
+	// The store fills up, until the announces expire.
+	for i := 2*maxPeerValues + 1; i <= maxPeers; i++ {
+		s.add(NewRandomID(), peer(i, 6881))
+	}
+	if s.add(infoHash, peer(maxPeers+1, 6881)) {
+		t.Error("announce into a full store")
+	}
+	now = now.Add(peerTTL)
+	if s.has(infoHash, peer(1, 6882)) {
+		t.Error("has an expired peer")
+	}
+	if !s.add(infoHash, peer(maxPeers+1, 6881)) || s.count != 1 {
+		t.Errorf("%d peers after expiry", s.count)
+	}
+	if got := s.get(infoHash); len(got) != 1 {
+		t.Errorf("%d peers", len(got))
+	}
+}
@@ -0,0 +1,160 @@
+package kademlia
+
+// Contains liveness tracking for routing table contacts. Every RPC to a
+// contact and every request from one updates its record; contacts that fail
+// MaxFailures calls in a row leave the table, and the least recently seen
+// ones are pinged now and then so that dead contacts are found even when
+// nothing else talks to them.
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	DefaultMaxFailures      = 3
+	DefaultLivenessInterval = time.Minute
+	DefaultLivenessCheck    = ALPHA
+)
+
+// What the node knows about a contact's health.
+type Liveness struct {
+	// When the contact last sent a request or answered one.
+	LastSeen time.Time
+	// When the contact last answered a request.
+	LastReply time.Time
+	// Calls to the contact that failed since it last answered.
+	Failures int
+	// Smoothed round trip time of the contact's replies.
+	RTT time.Duration
+}
+
+// Record that contact was heard from. Must be called with the table locked.
+func (table *RoutingTable) seen(id ID) {
+	if l := table.liveness[id]; l != nil {
+		l.LastSeen = table.now()
+		l.Failures = 0
+	}
+}
+
+// Record a reply from id that took rtt.
+func (table *RoutingTable) replied(id ID, rtt time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	now := table.now()
+	l := table.liveness[id]
+	if l == nil {
+		if table.proximity {
+			table.addProbe(id, probe{rtt, now})
+		}
+		return
+	}
+	l.LastSeen = now
+	l.LastReply = now
+	l.Failures = 0
+	if l.RTT == 0 {
+		l.RTT = rtt
+	} else {
+		// As TCP does, weigh the new sample by 1/8.
+		l.RTT += (rtt - l.RTT) / 8
+	}
+}
+
+// Record a failed call to id, and drop it once it has failed max times in a
+// row.
+func (table *RoutingTable) failed(id ID, max int) {
+	table.Lock()
+	defer table.Unlock()
+	l := table.liveness[id]
+	if l == nil {
+		return
+	}
+	l.Failures++
+	if l.Failures < max {
+		return
+	}
+	bucket := &table.buckets[id.Xor(table.SelfContact.NodeID).PrefixLen()]
+	for x, value := range *bucket {
+		if value.NodeID.Equals(id) {
+			*bucket = append((*bucket)[:x], (*bucket)[x+1:]...)
+			break
+		}
+	}
+	delete(table.liveness, id)
+}
+
+// The liveness record of the contact with id, if it is in the table.
+func (table *RoutingTable) Liveness(id ID) (Liveness, bool) {
+	table.RLock()
+	defer table.RUnlock()
+	l := table.liveness[id]
+	if l == nil {
+		return Liveness{}, false
+	}
+	return *l, true
+}
+
+// Must be called with the table locked.
+func (table *RoutingTable) lastSeen(id ID) time.Time {
+	if l := table.liveness[id]; l != nil {
+		return l.LastSeen
+	}
+	return time.Time{}
+}
+
+// Up to count contacts not seen since before, least recently seen first.
+func (table *RoutingTable) stale(before time.Time, count int) []Contact {
+	table.RLock()
+	defer table.RUnlock()
+	ret := make([]Contact, 0)
+	for _, bucket := range table.buckets {
+		for _, c := range bucket {
+			if table.lastSeen(c.NodeID).Before(before) {
+				ret = append(ret, c)
+			}
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return table.lastSeen(ret[i].NodeID).Before(table.lastSeen(ret[j].NodeID))
+	})
+	if len(ret) > count {
+		ret = ret[:count]
+	}
+	return ret
+}
+
+// Ping the contacts that have been quiet longest. Contacts that keep failing
+// leave the routing table; see Config.MaxFailures.
+func (k *Kademlia) CheckLiveness() {
+	interval := k.conf.LivenessInterval
+	if interval <= 0 {
+		interval = DefaultLivenessInterval
+	}
+	count := k.conf.LivenessCheck
+	if count <= 0 {
+		count = DefaultLivenessCheck
+	}
+	for _, c := range k.Routes.stale(k.conf.Now().Add(-interval), count) {
+		c := c
+		k.sendPing(&c)
+	}
+}
+
+// Update the liveness record of c after a call that took rtt.
+func (k *Kademlia) recordCall(c *Contact, rtt time.Duration, err error) {
+	if c.NodeID == (ID{}) {
+		return
+	}
+	switch err {
+	case nil:
+		k.Routes.replied(c.NodeID, rtt)
+	case ErrNoRoute, ErrRateLimited:
+		// Says nothing about whether the contact is alive.
+	default:
+		max := k.conf.MaxFailures
+		if max <= 0 {
+			max = DefaultMaxFailures
+		}
+		k.Routes.failed(c.NodeID, max)
+	}
+}
@@ -0,0 +1,62 @@
+package kademlia
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	network := NewMemoryNetwork()
+	conf := Config{ManualMaintenance: true, MaxFailures: 2, LivenessInterval: time.Hour}
+	conf.Transport = network.Transport()
+	a := NewKademliaWithConfig("127.0.0.1:1", conf)
+	conf.Transport = network.Transport()
+	b := NewKademliaWithConfig("127.0.0.1:2", conf)
+	conf.Transport = network.Transport()
+	c := NewKademliaWithConfig("127.0.0.1:3", conf)
+
+	for _, peer := range []*Kademlia{b, c} {
+		self := peer.Routes.Self()
+		if resp := a.DoPing(self.Host, self.Port); !strings.HasPrefix(resp, "OK") {
+			t.Fatal(resp)
+		}
+	}
+	a.ReadFromBuckets(0)
+	bc := b.Routes.Self()
+	if resp := a.DoFindNode(&bc, NewRandomID()); !strings.HasPrefix(resp, "OK") {
+		t.Fatal(resp)
+	}
+	l, ok := a.Routes.Liveness(b.NodeID)
+	if !ok || l.LastReply.IsZero() || l.RTT <= 0 || l.Failures != 0 {
+		t.Fatalf("liveness after a reply: %+v", l)
+	}
+
+	b.Close()
+	a.DoFindNode(&bc, NewRandomID())
+	if l, _ := a.Routes.Liveness(b.NodeID); l.Failures != 1 {
+		t.Errorf("failures after a failed call: %d", l.Failures)
+	}
+	if _, err := a.FindContact(b.NodeID); err != nil {
+		t.Error("contact dropped before reaching the threshold")
+	}
+	a.DoFindNode(&bc, NewRandomID())
+	if _, err := a.FindContact(b.NodeID); err == nil {
+		t.Error("contact kept after failing twice")
+	}
+	if _, ok := a.Routes.Liveness(b.NodeID); ok {
+		t.Error("liveness kept for a dropped contact")
+	}
+
+	// Contacts quiet for longer than the interval are pinged.
+	if stale := a.Routes.stale(time.Now().Add(-time.Hour), 1); len(stale) != 0 {
+		t.Error("recently seen contact reported stale")
+	}
+	c.Close()
+	a.conf.LivenessInterval = time.Nanosecond
+	a.CheckLiveness()
+	a.CheckLiveness()
+	if _, err := a.FindContact(c.NodeID); err == nil {
+		t.Error("liveness check kept a dead contact")
+	}
+}
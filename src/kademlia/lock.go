@@ -0,0 +1,126 @@
+package kademlia
+
+// Contains leases: locks that expire, for leader election and the like. A
+// lease lives at the K nodes closest to its lock's key, which drop it once its
+// time to live runs out. Acquiring, renewing and releasing it are
+// compare-and-swaps that a majority of those K nodes must apply; nodes further
+// away never stand in for ones that fail, as they would grant the lease to a
+// second holder. Each one writes a newer version, and the version is the
+// holder's fencing token: a resource that remembers the newest token it has
+// seen can turn away a holder whose lease expired and passed to someone else.
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLockHeld  = errors.New("lock held")
+	ErrLeaseLost = errors.New("lease lost")
+)
+
+// Locks have keys of their own, apart from values stored under the same names.
+var lockspace = NewKeyspace("lock")
+
+// A lock held by this node.
+type Lease struct {
+	Name string
+	Key  ID
+	// The fencing token. Renewing the lease gives it a newer one.
+	Token Version
+	TTL   time.Duration
+	// When the lease ends unless renewed, by this node's clock. It is counted
+	// from before the request went out, so the nodes holding the lease drop
+	// it a little later.
+	Expires time.Time
+	// The nodes that took the lease, closest first.
+	Replicas []Contact
+}
+
+// Take the lock called name for ttl, if no one holds it. Returns ErrLockHeld
+// if nodes hold someone else's lease, and ErrSwapQuorum if too few answered.
+func (k *Kademlia) Acquire(name string, ttl time.Duration) (*Lease, error) {
+	key := lockspace.Key(name)
+	start := k.conf.Now()
+	res, err := k.compareAndSwap(key, k.NodeID[:], Expectation{}, ttl, 0)
+	if err == ErrSwapQuorum && newerConflict(res) {
+		// Expired leases with versions from a clock running ahead of ours
+		// turned the swap away. It moved our clock past them, so try again.
+		k.abandon(res)
+		start = k.conf.Now()
+		res, err = k.compareAndSwap(key, k.NodeID[:], Expectation{}, ttl, 0)
+	}
+	if err != nil {
+		k.abandon(res)
+		if len(res.Conflicts) > 0 {
+			return nil, ErrLockHeld
+		}
+		return nil, err
+	}
+	return &Lease{Name: name, Key: key, Token: res.Version, TTL: ttl, Expires: start.Add(ttl), Replicas: res.Swapped}, nil
+}
+
+// Extend lease by its TTL, with a new token. Returns ErrLeaseLost if nodes hold
+// another lease, because this one expired or was released. After any error
+// the lease must be taken as lost.
+func (k *Kademlia) Renew(lease *Lease) error {
+	start := k.conf.Now()
+	res, err := k.compareAndSwap(lease.Key, k.NodeID[:], Expectation{Version: lease.Token}, lease.TTL, 0)
+	if err != nil {
+		k.abandon(res)
+		if len(res.Conflicts) > 0 {
+			return ErrLeaseLost
+		}
+		return err
+	}
+	lease.Token, lease.Expires, lease.Replicas = res.Version, start.Add(lease.TTL), res.Swapped
+	return nil
+}
+
+// Give lease up before it expires. Returns ErrLeaseLost if nodes hold another
+// lease; either way, the lease is no longer this node's.
+func (k *Kademlia) Release(lease *Lease) error {
+	res, err := k.compareAndSwap(lease.Key, nil, Expectation{Version: lease.Token}, -1, 0)
+	if err != nil && len(res.Conflicts) > 0 {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// Drop the lease a failed swap left at the nodes that applied it, so that it
+// does not block the lock until it expires.
+func (k *Kademlia) abandon(res *SwapResult) {
+	if len(res.Swapped) > 0 {
+		k.compareAndSwap(res.Key, nil, Expectation{Version: res.Version}, -1, 1)
+	}
+}
+
+// Whether a node turned a swap away holding a newer version than the swap's.
+func newerConflict(res *SwapResult) bool {
+	for _, c := range res.Conflicts {
+		if c.Current.Newer(res.Version) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Fence guards a resource that a lock protects. It admits holders in token
+// order: once it has seen a token, it turns away older ones, whose leases have
+// expired or been renewed. The zero Fence admits any token first.
+type Fence struct {
+	sync.Mutex
+	last Version
+}
+
+// Whether token is as new as any admitted before; if so, it is the newest.
+func (f *Fence) Admit(token Version) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.last.Newer(token) {
+		return false
+	}
+	f.last = token
+	return true
+}
@@ -0,0 +1,209 @@
+package kademlia
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to.
+type manualClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLease(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	instanceList := newMemoryNodesWithConfig(t, 40, Config{Now: clock.Now})
+	a, b := instanceList[0], instanceList[1]
+	var fence Fence
+
+	lease, err := a.Acquire("leader", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lease.Replicas) != K || lease.Expires != clock.Now().Add(10*time.Second) || !fence.Admit(lease.Token) {
+		t.Fatalf("lease at %d nodes until %v", len(lease.Replicas), lease.Expires)
+	}
+	if _, err := b.Acquire("leader", 10*time.Second); err != ErrLockHeld {
+		t.Errorf("second holder: %v", err)
+	}
+	if _, err := b.Acquire("follower", 10*time.Second); err != nil {
+		t.Errorf("another lock: %v", err)
+	}
+
+	// Renewing keeps the lock past the first TTL.
+	clock.Advance(6 * time.Second)
+	old := lease.Token
+	if err := a.Renew(lease); err != nil || !lease.Token.Newer(old) {
+		t.Fatalf("renew: %v", err)
+	}
+	clock.Advance(6 * time.Second)
+	if _, err := b.Acquire("leader", 10*time.Second); err != ErrLockHeld {
+		t.Errorf("acquired a renewed lease: %v", err)
+	}
+
+	// Once the lease expires, another node takes the lock, and the stale
+	// holder is fenced off.
+	clock.Advance(5 * time.Second)
+	taken, err := b.Acquire("leader", 10*time.Second)
+	if err != nil {
+		t.Fatalf("acquire after expiry: %v", err)
+	}
+	if !taken.Token.Newer(lease.Token) || !fence.Admit(taken.Token) || fence.Admit(lease.Token) {
+		t.Error("token of the new holder does not fence the old one")
+	}
+	if err := a.Renew(lease); err != ErrLeaseLost {
+		t.Errorf("renew of an expired lease: %v", err)
+	}
+	if err := a.Release(lease); err != ErrLeaseLost {
+		t.Errorf("release of an expired lease: %v", err)
+	}
+
+	// Released, the lock is free at once.
+	if err := b.Release(taken); err != nil {
+		t.Fatal(err)
+	}
+	again, err := a.Acquire("leader", 10*time.Second)
+	if err != nil || !again.Token.Newer(taken.Token) {
+		t.Fatalf("acquire after release: %v", err)
+	}
+}
+
+func TestLeaseNodeFailures(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	instanceList := newMemoryNodesWithConfig(t, 40, Config{Now: clock.Now})
+	k := instanceList[0]
+	network := k.transport.(*MemoryTransport).network
+	key := lockspace.Key("leader")
+	closest := k.IterativeFindNode(key, false).Contacts()
+	if len(closest) != K {
+		t.Fatalf("found %d nodes", len(closest))
+	}
+
+	// With a few of the closest nodes down, the others make the quorum.
+	bad := make(map[string]bool)
+	for _, c := range closest[:5] {
+		bad[Dest(c.Host, c.Port)] = true
+	}
+	dropCalls(network, "CompareAndSwap", bad)
+	lease, err := k.Acquire("leader", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range lease.Replicas {
+		if bad[Dest(c.Host, c.Port)] {
+			t.Errorf("lease at failed node %v", c.NodeID.AsString())
+		}
+	}
+	if err := k.Release(lease); err != nil {
+		t.Fatal(err)
+	}
+
+	// With only five nodes up, acquiring fails, and the nodes that took the
+	// lease drop it: the lock is free once the others recover, long before
+	// the TTL.
+	up := make(map[string]bool)
+	for _, c := range closest[K-5:] {
+		up[Dest(c.Host, c.Port)] = true
+	}
+	for _, node := range instanceList {
+		if addr := Dest(node.Routes.SelfContact.Host, node.Routes.SelfContact.Port); !up[addr] {
+			bad[addr] = true
+		}
+	}
+	dropCalls(network, "CompareAndSwap", bad)
+	if _, err := k.Acquire("leader", time.Hour); err != ErrSwapQuorum {
+		t.Fatalf("acquire without a majority: %v", err)
+	}
+	for _, c := range closest[K-5:] {
+		if value, _, _, err := k.FindValue(&c, key); err != nil || value != nil {
+			t.Errorf("lease left at %v: %q, %v", c.NodeID.AsString(), value, err)
+		}
+	}
+	dropCalls(network, "CompareAndSwap", map[string]bool{})
+	if _, err := instanceList[1].Acquire("leader", 10*time.Second); err != nil {
+		t.Errorf("acquire after a failed one: %v", err)
+	}
+}
+
+func TestLeaseHalfUnreachable(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	instanceList := newMemoryNodesWithConfig(t, 60, Config{Now: clock.Now})
+	k := instanceList[0]
+	network := k.transport.(*MemoryTransport).network
+	closest := k.IterativeFindNode(lockspace.Key("leader"), false).Contacts()
+
+	// With half the replicas failing, the lease is not granted: the next
+	// closest nodes do not stand in, so no other holder could find a
+	// majority among the other half and them.
+	bad := make(map[string]bool)
+	for _, c := range closest[:K/2] {
+		bad[Dest(c.Host, c.Port)] = true
+	}
+	dropCalls(network, "CompareAndSwap", bad)
+	if lease, err := k.Acquire("leader", time.Hour); err != ErrSwapQuorum {
+		t.Fatalf("acquired at %d nodes: %v", len(lease.Replicas), err)
+	}
+	dropCalls(network, "CompareAndSwap", map[string]bool{})
+	if _, err := instanceList[1].Acquire("leader", time.Hour); err != nil {
+		t.Errorf("acquire after a failed one: %v", err)
+	}
+}
+
+func TestLeaseSweep(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	instanceList := newMemoryNodesWithConfig(t, 40, Config{Now: clock.Now})
+	k := instanceList[0]
+	released, err := k.Acquire("released", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Release(released); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := k.Acquire("expired", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func() (keys int) {
+		for _, node := range instanceList {
+			node.Maintain()
+			node.metrics.Lock()
+			keys += node.metrics.storedKeys
+			node.metrics.Unlock()
+		}
+		return keys
+	}
+	want := len(released.Replicas) + len(expired.Replicas)
+
+	// Both stay a while, so that their versions order late writes, then go.
+	clock.Advance(DefaultMaxClockSkew)
+	if got := stored(); got != want {
+		t.Errorf("%d keys stored within the grace period, want %d", got, want)
+	}
+	clock.Advance(2 * DefaultMaxClockSkew)
+	if got := stored(); got != 0 {
+		t.Errorf("%d keys stored after the grace period", got)
+	}
+}
+
+func TestFence(t *testing.T) {
+	var fence Fence
+	old, newer := Version{Timestamp: 1}, Version{Timestamp: 2}
+	if !fence.Admit(old) || !fence.Admit(old) || !fence.Admit(newer) || fence.Admit(old) {
+		t.Error("fence admits out of order")
+	}
+}
@@ -1,198 +1,237 @@
 package kademlia
 
 import (
-	"log"
-	"net/rpc"
 	"sort"
-	"strconv"
-	"sync"
+	"time"
 )
 
-// make a map to be concurrent support with lock
-type ConcurrMap struct {
-	sync.RWMutex
-	m map[ID]int
-}
-
 type IterativeResult struct {
 	contacts []Contact
 	key      ID
 	value    []byte
+	version  Version
+	rounds   [][]Contact
+	// Candidates beyond the K closest, closest first, to stand in for nodes
+	// that fail later.
+	spare []Contact
+}
+
+// The K closest contacts found.
+func (ret *IterativeResult) Contacts() []Contact {
+	return ret.contacts
+}
+
+// The value found, or nil.
+func (ret *IterativeResult) Value() []byte {
+	return ret.value
+}
+
+// The version of the value found.
+func (ret *IterativeResult) Version() Version {
+	return ret.version
+}
+
+// The contacts queried in each round of the lookup, in query order. The
+// number of rounds is the hop count of the lookup.
+func (ret *IterativeResult) Rounds() [][]Contact {
+	return ret.rounds
 }
 
 func (k *Kademlia) IterativeFindNode(target ID, findvalue bool) (ret *IterativeResult) {
-	tempShortlist := k.Routes.FindClosest(target, K)
+	return k.lookup(target, findvalue, nil)
+}
+
+// Run a lookup, recording every query in trace if it is not nil.
+func (k *Kademlia) lookup(target ID, findvalue bool, trace *LookupTrace) (ret *IterativeResult) {
+	start := time.Now()
+	// The node whose reply named each contact, for the trace.
+	learnedFrom := make(map[ID]ID)
 	shortlist := make([]ContactDistance, 0)
-	var closestNode Contact
 	visited := make(map[ID]int)
-	active := new(ConcurrMap)
-	active.m = make(map[ID]int)
-	nodeChan := make(chan Contact)
-	keyChan := make(chan []byte)
+	active := make(map[ID]int)
+	resultChan := make(chan queryResult, ALPHA)
 	ret = new(IterativeResult)
 	if findvalue == true {
 		ret.key = target
 	}
 	ret.value = nil
 
-	for _, node := range tempShortlist {
-		shortlist = append(shortlist, ContactDistance{node, node.NodeID.Xor(target).ToInt()})
+	for _, node := range k.Routes.FindClosest(target, K) {
+		shortlist = append(shortlist, ContactDistance{node, node.NodeID.Xor(target)})
 	}
+	sort.Sort(ByDist(shortlist))
 
-	go func() {
-		for {
-			select {
-			case node := <-nodeChan:
-				found := 0
-				for _, value := range shortlist {
-					if value.contact.NodeID == node.NodeID {
-						found = 1
-						break
-					}
-				}
-				if found == 0 {
-					shortlist = append(shortlist, ContactDistance{node, node.NodeID.Xor(target).ToInt()})
-				}
-				sort.Sort(ByDist(shortlist))
-			case value := <-keyChan:
-				ret.value = value
-				fakeNode := new(Contact)
-				fakeNode.NodeID = ret.key
-				shortlist = append(shortlist, ContactDistance{*fakeNode, (*fakeNode).NodeID.Xor(target).ToInt()})
-
+	for !terminated(shortlist, active, ret.value) {
+		round := k.nextRound(shortlist, visited)
+		for _, c := range round {
+			if findvalue == false {
+				go k.sendQuery(c, target, resultChan)
+			} else {
+				go k.sendFindValueQuery(c, target, resultChan)
 			}
+			visited[c.NodeID] = 1
 		}
-	}()
-
-	waitChan := make(chan int, ALPHA)
 
-	for !terminated(shortlist, active, closestNode, ret.value) {
-		count := 0
-		// DATA RACE error by golang test, but not effect any behaviours
-		for _, c := range shortlist {
-
-			if visited[c.contact.NodeID] == 0 {
-				if count >= ALPHA {
-					break
+		if len(round) == 0 {
+			// Nothing left to ask; the remaining candidates failed.
+			break
+		}
+		results := make(map[ID]queryResult, len(round))
+		for range round {
+			res := <-resultChan
+			results[res.contact.NodeID] = res
+		}
+		if trace != nil {
+			for _, c := range round {
+				trace.addQuery(len(ret.rounds), learnedFrom[c.NodeID], results[c.NodeID])
+			}
+		}
+		ret.rounds = append(ret.rounds, round)
+
+		// Replies are merged in query order, so that neither the shortlist
+		// nor the routing table depends on which reply came back first.
+		for i := range round {
+			res := results[round[i].NodeID]
+			if res.err != nil {
+				// Nodes that fail drop out of the lookup.
+				shortlist = withoutDistance(shortlist, round[i].NodeID)
+				continue
+			}
+			active[round[i].NodeID] = 1
+			k.update(&round[i])
+			// Of the values found in the same round, keep the newest.
+			if res.value != nil && (ret.value == nil || res.version.Newer(ret.version)) {
+				ret.value, ret.version = res.value, res.version
+				k.clock.Observe(res.version.Timestamp)
+			}
+			for _, node := range res.nodes {
+				if visited[node.NodeID] == 1 || containsDistance(shortlist, node.NodeID) {
+					continue
 				}
-				if findvalue == false {
-					go sendQuery(c.contact, active, waitChan, nodeChan)
-				} else {
-					go sendFindValueQuery(c.contact, active, waitChan, nodeChan, keyChan, target)
+				if _, ok := k.Routes.route(&node); !ok {
+					continue
 				}
-				visited[c.contact.NodeID] = 1
-				count++
+				shortlist = append(shortlist, ContactDistance{node, node.NodeID.Xor(target)})
+				learnedFrom[node.NodeID] = round[i].NodeID
 			}
 		}
-
-		for ; count > 0; count-- {
-			<-waitChan
-		}
+		sort.Sort(ByDist(shortlist))
 	}
 
 	ret.contacts = make([]Contact, 0)
-	sort.Sort(ByDist(shortlist))
-	if len(shortlist) > K {
-		shortlist = shortlist[:K]
+	closest := diverseClosest(shortlist, K, k.conf.Diversity.LookupPerSubnet)
+	for _, value := range closest {
+		ret.contacts = append(ret.contacts, value.contact)
 	}
 	for _, value := range shortlist {
-		ret.contacts = append(ret.contacts, value.contact)
+		if len(ret.spare) < K && !containsDistance(closest, value.contact.NodeID) {
+			ret.spare = append(ret.spare, value.contact)
+		}
+	}
+	if findvalue {
+		k.metrics.lookup(len(ret.rounds), time.Since(start), ret.value != nil)
+	} else {
+		k.metrics.lookup(len(ret.rounds), time.Since(start), len(ret.contacts) > 0)
+	}
+	if trace != nil {
+		trace.finish(target, findvalue, start, ret)
 	}
 
 	return
 }
 
-func sendFindValueQuery(c Contact, active *ConcurrMap, waitChan chan int, nodeChan chan Contact, keyChan chan []byte, target ID) {
-	args := FindValueRequest{c, NewRandomID(), target}
-	var reply FindValueResult
-	active.Lock()
-	active.m[c.NodeID] = 1
-	active.Unlock()
-
-	port_str := strconv.Itoa(int(c.Port))
-	client, err := rpc.DialHTTPPath("tcp", Dest(c.Host, c.Port), rpc.DefaultRPCPath+port_str)
-	if err != nil {
-		log.Fatal("DialHTTP", err)
-		active.Lock()
-		active.m[c.NodeID] = 0
-		active.Unlock()
-	}
-	defer client.Close()
-	err = client.Call("KademliaCore.FindValue", args, &reply)
-	if err != nil {
-		log.Fatal("Call: ", err)
-		active.Lock()
-		active.m[c.NodeID] = 0
-		active.Unlock()
-	}
-
-	active.RLock()
-	a := active.m[c.NodeID]
-	active.RUnlock()
-	if reply.Value == nil {
-		if a == 1 {
-			for _, node := range reply.Nodes {
-				nodeChan <- node
+// The candidates the next round of a lookup asks: the ALPHA closest not yet
+// visited or, with Config.Proximity, ALPHA of the proximityWindow closest,
+// weighing low-latency ones.
+func (k *Kademlia) nextRound(shortlist []ContactDistance, visited map[ID]int) []Contact {
+	window := ALPHA
+	if k.conf.Proximity {
+		window = proximityWindow
+	}
+	candidates := make([]Contact, 0, window)
+	for _, c := range shortlist {
+		if visited[c.contact.NodeID] == 0 {
+			if len(candidates) >= window {
+				break
 			}
+			candidates = append(candidates, c.contact)
 		}
-	} else {
-		keyChan <- reply.Value
 	}
-	waitChan <- 1
+	if len(candidates) <= ALPHA {
+		return candidates
+	}
+	return k.Routes.fastest(candidates, ALPHA)
+}
+
+// The reply of one node queried by a lookup.
+type queryResult struct {
+	contact    Contact
+	nodes      []Contact
+	value      []byte
+	version    Version
+	err        error
+	start, end time.Time
+}
+
+func (k *Kademlia) sendFindValueQuery(c Contact, target ID, resultChan chan queryResult) {
+	args := &FindValueRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: target}
+	reply := new(FindValueResult)
+	res := queryResult{contact: c, start: time.Now()}
+	res.err = k.call(&c, "FindValue", args, reply)
+	res.end = time.Now()
+	if res.err == nil && k.clock.ahead(reply.Version.Timestamp) {
+		res.err = ErrFutureVersion
+	}
+	if res.err == nil {
+		res.nodes = reply.Nodes
+		res.value = reply.Value
+		res.version = reply.Version
+	}
+	resultChan <- res
 }
 
-func sendQuery(c Contact, active *ConcurrMap, waitChan chan int, nodeChan chan Contact) {
-	args := FindNodeRequest{c, NewRandomID(), c.NodeID}
-	var reply FindNodeResult
-	active.Lock()
-	active.m[c.NodeID] = 1
-	active.Unlock()
-
-	port_str := strconv.Itoa(int(c.Port))
-	client, err := rpc.DialHTTPPath("tcp", Dest(c.Host, c.Port), rpc.DefaultRPCPath+port_str)
-	if err != nil {
-		log.Fatal("DialHTTP", err)
-		active.Lock()
-		active.m[c.NodeID] = 0
-		active.Unlock()
-	}
-	defer client.Close()
-	err = client.Call("KademliaCore.FindNode", args, &reply)
-	if err != nil {
-		log.Fatal("Call: ", err)
-		active.Lock()
-		active.m[c.NodeID] = 0
-		active.Unlock()
-	}
-
-	active.RLock()
-	a := active.m[c.NodeID]
-	active.RUnlock()
-	if a == 1 {
-		for _, node := range reply.Nodes {
-			nodeChan <- node
+func (k *Kademlia) sendQuery(c Contact, target ID, resultChan chan queryResult) {
+	args := &FindNodeRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), NodeID: target}
+	reply := new(FindNodeResult)
+	res := queryResult{contact: c, start: time.Now()}
+	res.err = k.call(&c, "FindNode", args, reply)
+	res.end = time.Now()
+	if res.err == nil {
+		res.nodes = reply.Nodes
+	}
+	resultChan <- res
+}
+
+func containsDistance(shortlist []ContactDistance, id ID) bool {
+	for _, value := range shortlist {
+		if value.contact.NodeID == id {
+			return true
 		}
 	}
-	waitChan <- 1
+	return false
 }
 
-func terminated(shortlist []ContactDistance, active *ConcurrMap, closestnode Contact, found_value []byte) bool {
+func withoutDistance(shortlist []ContactDistance, id ID) []ContactDistance {
+	for i, value := range shortlist {
+		if value.contact.NodeID == id {
+			return append(shortlist[:i], shortlist[i+1:]...)
+		}
+	}
+	return shortlist
+}
+
+// A lookup is over once it has a value, or once the K closest nodes it knows
+// of have all answered.
+func terminated(shortlist []ContactDistance, active map[ID]int, found_value []byte) bool {
 	if found_value != nil {
 		return true
 	}
-	if len(shortlist) < K {
-	}
-
-	if shortlist[0].contact.NodeID.Equals(closestnode.NodeID) {
+	if len(shortlist) == 0 {
 		return true
 	}
-	closestnode = shortlist[0].contact
 
 	for i := 0; i < len(shortlist) && i < K; i++ {
-		active.RLock()
-		a := active.m[shortlist[i].contact.NodeID]
-		active.RUnlock()
-		if a == 0 {
+		if active[shortlist[i].contact.NodeID] == 0 {
 			return false
 		}
 	}
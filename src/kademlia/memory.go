@@ -0,0 +1,217 @@
+package kademlia
+
+// Contains an in-process Transport. Nodes attached to the same MemoryNetwork
+// exchange RPCs over channels instead of sockets, so tests can run hundreds of
+// nodes without opening ports. Arguments and replies are still gob encoded to
+// keep the copy semantics of a real network, over one stream per network so
+// that each type is described only once.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrUnreachable = errors.New("node unreachable")
+
+// A set of in-process nodes that can reach one another.
+type MemoryNetwork struct {
+	sync.RWMutex
+	nodes    map[string]*MemoryTransport
+	nextPort int
+	// Link, if set, is consulted before every call. Returning an error drops
+	// the call, which then fails with that error. Otherwise the duration it
+	// returns is reported to the caller as the call's round trip time,
+	// without being waited out. Simulators use it to model latency and loss.
+	Link func(from, to net.Addr, method string) (time.Duration, error)
+
+	codec gobCopier
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[string]*MemoryTransport), nextPort: 1}
+}
+
+// A new transport attached to the network. Each node needs its own.
+func (n *MemoryNetwork) Transport() *MemoryTransport {
+	return &MemoryTransport{network: n}
+}
+
+type MemoryTransport struct {
+	network *MemoryNetwork
+	addr    *net.TCPAddr
+	calls   chan *memoryCall
+	done    chan struct{}
+}
+
+type memoryCall struct {
+	from   net.Addr
+	method string
+	// The caller's arguments, and the reply the method wrote. Each side
+	// copies the other's through the network's codec.
+	args   interface{}
+	reply  interface{}
+	err    error
+	result chan *memoryCall
+}
+
+// Copies values through a gob stream. An encoder sends the description of a
+// type only the first time it encodes one, and compiling that description is
+// most of the cost of a one-off encoding.
+type gobCopier struct {
+	sync.Mutex
+	buf bytes.Buffer
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+// Encode src and decode it into dst, which must be a pointer.
+func (c *gobCopier) copy(dst reflect.Value, src interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.enc == nil {
+		c.enc = gob.NewEncoder(&c.buf)
+		c.dec = gob.NewDecoder(&c.buf)
+	}
+	err := c.enc.Encode(src)
+	if err == nil {
+		err = c.dec.DecodeValue(dst)
+	}
+	if err != nil {
+		// The stream may be out of step; start a new one.
+		c.buf.Reset()
+		c.enc, c.dec = nil, nil
+	}
+	return err
+}
+
+// Serve registers the node at laddr. Addresses are virtual; a port of 0 picks
+// an unused one.
+func (t *MemoryTransport) Serve(laddr string, k *Kademlia) ([]net.Addr, error) {
+	host, portstr, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = net.ParseIP("127.0.0.1")
+	}
+
+	n := t.network
+	n.Lock()
+	defer n.Unlock()
+	if port == 0 {
+		for n.nodes[Dest(ip, uint16(n.nextPort))] != nil {
+			n.nextPort++
+		}
+		port = n.nextPort
+	}
+	addr := &net.TCPAddr{IP: ip, Port: port}
+	if n.nodes[addr.String()] != nil {
+		return nil, errors.New("address already in use: " + addr.String())
+	}
+	t.addr = addr
+	t.calls = make(chan *memoryCall)
+	t.done = make(chan struct{})
+	n.nodes[addr.String()] = t
+
+	go func() {
+		for {
+			select {
+			case call := <-t.calls:
+				go call.serve(&KademliaCore{kademlia: k, remote: call.from}, &n.codec)
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return []net.Addr{addr}, nil
+}
+
+func (t *MemoryTransport) Call(c *Contact, method string, args, reply interface{}) error {
+	_, err := t.timedCall(c, method, args, reply)
+	return err
+}
+
+// Make a call and return its round trip time: the one given by the network's
+// Link if it has one, the time taken otherwise.
+func (t *MemoryTransport) timedCall(c *Contact, method string, args, reply interface{}) (time.Duration, error) {
+	start := time.Now()
+	t.network.RLock()
+	dst := t.network.nodes[Dest(c.Host, c.Port)]
+	link := t.network.Link
+	t.network.RUnlock()
+	if dst == nil {
+		return 0, ErrUnreachable
+	}
+	var rtt time.Duration
+	if link != nil {
+		var err error
+		if rtt, err = link(t.addr, dst.addr, method); err != nil {
+			return rtt, err
+		}
+	}
+	err := t.deliver(dst, method, args, reply)
+	if link == nil {
+		rtt = time.Since(start)
+	}
+	return rtt, err
+}
+
+func (t *MemoryTransport) deliver(dst *MemoryTransport, method string, args, reply interface{}) error {
+	call := &memoryCall{from: t.addr, method: method, args: args, result: make(chan *memoryCall, 1)}
+	select {
+	case dst.calls <- call:
+	case <-dst.done:
+		return ErrUnreachable
+	}
+	call = <-call.result
+	if call.err != nil {
+		return call.err
+	}
+	return t.network.codec.copy(reflect.ValueOf(reply), call.reply)
+}
+
+func (t *MemoryTransport) Close() error {
+	n := t.network
+	n.Lock()
+	defer n.Unlock()
+	if t.addr == nil || n.nodes[t.addr.String()] != t {
+		return nil
+	}
+	delete(n.nodes, t.addr.String())
+	close(t.done)
+	return nil
+}
+
+// Decode the arguments, invoke the KademliaCore method and encode the reply,
+// the way net/rpc would.
+func (call *memoryCall) serve(core *KademliaCore, codec *gobCopier) {
+	defer func() { call.result <- call }()
+	m := reflect.ValueOf(core).MethodByName(call.method)
+	if !m.IsValid() {
+		call.err = errors.New("rpc: can't find method KademliaCore." + call.method)
+		return
+	}
+	args := reflect.New(m.Type().In(0))
+	if call.err = codec.copy(args, call.args); call.err != nil {
+		return
+	}
+	reply := reflect.New(m.Type().In(1).Elem())
+	out := m.Call([]reflect.Value{args.Elem(), reply})
+	if err, _ := out[0].Interface().(error); err != nil {
+		// Errors lose their identity over the network too.
+		call.err = errors.New(err.Error())
+		return
+	}
+	call.reply = reply.Interface()
+}
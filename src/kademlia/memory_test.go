@@ -0,0 +1,116 @@
+package kademlia
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start n nodes on a memory network, each having pinged up to ten of its
+// predecessors and looked itself up.
+func newMemoryNodes(t *testing.T, n int) []*Kademlia {
+	return newMemoryNodesWithConfig(t, n, Config{})
+}
+
+// newMemoryNodes, with nodes configured by conf apart from their transport.
+func newMemoryNodesWithConfig(t *testing.T, n int, conf Config) []*Kademlia {
+	network := NewMemoryNetwork()
+	instanceList := make([]*Kademlia, 0, n)
+	for i := 0; i < n; i++ {
+		conf.Transport = network.Transport()
+		instanceList = append(instanceList, NewKademliaWithConfig("127.0.0.1:0", conf))
+	}
+	for i := 0; i < len(instanceList); i++ {
+		for j := i - 10; j < i; j++ {
+			if j < 0 {
+				continue
+			}
+			self := instanceList[j].Routes.SelfContact
+			if resp := instanceList[i].DoPing(self.Host, self.Port); !strings.HasPrefix(resp, "OK") {
+				t.Fatal("ping failed: ", resp)
+			}
+		}
+		instanceList[i].IterativeFindNode(instanceList[i].NodeID, false)
+	}
+	return instanceList
+}
+
+func TestMemoryIterativeFindNode(t *testing.T) {
+	instanceList := newMemoryNodes(t, 200)
+
+	for _, i := range []int{1, 50, 100, 199} {
+		target := instanceList[i].NodeID
+		result := instanceList[0].IterativeFindNode(target, false)
+		found := false
+		for _, value := range result.contacts {
+			if value.NodeID == target {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Cannot find target %d", i)
+		}
+	}
+}
+
+func TestMemoryIterativeFindValue(t *testing.T) {
+	instanceList := newMemoryNodes(t, 200)
+
+	key := NewRandomID()
+	value := "answer"
+	for _, c := range instanceList[0].IterativeFindNode(key, false).contacts {
+		instanceList[0].DoStore(&c, key, []byte(value))
+	}
+	result := instanceList[150].DoIterativeFindValue(key)
+	if !strings.Contains(result, value) {
+		t.Error("Expected value: ", value)
+		t.Error("Return value: ", result)
+	}
+}
+
+func TestMemoryClose(t *testing.T) {
+	instanceList := newMemoryNodes(t, 2)
+	self := instanceList[1].Routes.SelfContact
+	instanceList[1].Close()
+	if resp := instanceList[0].DoPing(self.Host, self.Port); !strings.HasPrefix(resp, "ERR") {
+		t.Error("ping to closed node succeeded: ", resp)
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	k := NewKademliaWithConfig("127.0.0.1:0", Config{Transport: NewMemoryNetwork().Transport()})
+	k.Close()
+	k.Close()
+	// Let the loops see that the node closed before anything else is ready.
+	time.Sleep(100 * time.Millisecond)
+
+	self := k.Routes.Self()
+	select {
+	case k.contactChan <- &self:
+		t.Error("handleChan still running after Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The kick channel holds one request; a running maintainLoop would take
+	// it and make room for another.
+	k.Routes.kick <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case k.Routes.kick <- struct{}{}:
+		t.Error("maintainLoop still running after Close")
+	default:
+	}
+}
+
+func TestReadFromBucketsCopies(t *testing.T) {
+	instanceList := newMemoryNodes(t, 2)
+	other := instanceList[1].NodeID
+	prefix := other.Xor(instanceList[0].NodeID).PrefixLen()
+	bucket := instanceList[0].ReadFromBuckets(prefix)
+	if len(bucket) != 1 {
+		t.Fatalf("got %d contacts", len(bucket))
+	}
+	bucket[0].Port++
+	if c, err := instanceList[0].FindContact(other); err != nil || c.Port == bucket[0].Port {
+		t.Error("ReadFromBuckets returned the bucket itself")
+	}
+}
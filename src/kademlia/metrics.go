@@ -0,0 +1,253 @@
+package kademlia
+
+// Contains the node's metrics, served at /metrics on Config.MetricsAddr in
+// the Prometheus text format: RPCs in each direction, the routing table, the
+// stored values, lookups and Vanish refreshes. The listener is plain HTTP, so
+// that a standard Prometheus scrape reaches it.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the histogram buckets, as in the Prometheus clients.
+var (
+	durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	hopBuckets      = []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20}
+)
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Write the histogram's series, with labels, if any, given as `key="value"`.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counts and latencies of the RPCs of one method in one direction.
+type rpcMetrics struct {
+	total    uint64
+	errors   uint64
+	duration *histogram
+}
+
+type metrics struct {
+	sync.Mutex
+	rpcIn          map[string]*rpcMetrics
+	rpcOut         map[string]*rpcMetrics
+	storedKeys     int
+	storedBytes    int
+	lookupHops     *histogram
+	lookupDuration *histogram
+	lookups        map[bool]uint64
+	refreshes      map[bool]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rpcIn:          make(map[string]*rpcMetrics),
+		rpcOut:         make(map[string]*rpcMetrics),
+		lookupHops:     newHistogram(hopBuckets),
+		lookupDuration: newHistogram(durationBuckets),
+		lookups:        make(map[bool]uint64),
+		refreshes:      make(map[bool]uint64),
+	}
+}
+
+func (m *metrics) rpc(rpcs map[string]*rpcMetrics, method string, d time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	r := rpcs[method]
+	if r == nil {
+		r = &rpcMetrics{duration: newHistogram(durationBuckets)}
+		rpcs[method] = r
+	}
+	r.total++
+	if err != nil {
+		r.errors++
+	}
+	r.duration.observe(d.Seconds())
+}
+
+// Record an RPC the node served.
+func (m *metrics) served(method string, d time.Duration, err error) {
+	m.rpc(m.rpcIn, method, d, err)
+}
+
+// Record an RPC the node made.
+func (m *metrics) called(method string, d time.Duration, err error) {
+	m.rpc(m.rpcOut, method, d, err)
+}
+
+// Record that the value stored under a key went from old, if the key existed,
+// to value.
+func (m *metrics) stored(existed bool, old, value []byte) {
+	m.Lock()
+	defer m.Unlock()
+	if !existed {
+		m.storedKeys++
+	}
+	m.storedBytes += len(value) - len(old)
+}
+
+// Record that the value stored under a key was dropped.
+func (m *metrics) removed(value []byte) {
+	m.Lock()
+	defer m.Unlock()
+	m.storedKeys--
+	m.storedBytes -= len(value)
+}
+
+// Record a lookup, which succeeded if it found a value or, when not looking
+// for one, any contact.
+func (m *metrics) lookup(hops int, d time.Duration, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.lookups[ok]++
+	m.lookupHops.observe(float64(hops))
+	m.lookupDuration.observe(d.Seconds())
+}
+
+func (m *metrics) refreshed(ok bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.refreshes[ok]++
+}
+
+func writeRPCs(w io.Writer, direction string, rpcs map[string]*rpcMetrics) {
+	methods := make([]string, 0, len(rpcs))
+	for method := range rpcs {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	name := "kademlia_rpc_" + direction
+	fmt.Fprintf(w, "# HELP %s_total RPCs %s, by method.\n# TYPE %s_total counter\n", name, direction, name)
+	for _, method := range methods {
+		fmt.Fprintf(w, "%s_total{method=%q} %d\n", name, method, rpcs[method].total)
+	}
+	fmt.Fprintf(w, "# HELP %s_errors_total RPCs %s that failed, by method.\n# TYPE %s_errors_total counter\n", name, direction, name)
+	for _, method := range methods {
+		fmt.Fprintf(w, "%s_errors_total{method=%q} %d\n", name, method, rpcs[method].errors)
+	}
+	fmt.Fprintf(w, "# HELP %s_duration_seconds Time taken by RPCs %s, by method.\n# TYPE %s_duration_seconds histogram\n", name, direction, name)
+	for _, method := range methods {
+		rpcs[method].duration.write(w, name+"_duration_seconds", fmt.Sprintf("method=%q", method))
+	}
+}
+
+// Write the node's metrics in the Prometheus text format.
+func (k *Kademlia) WriteMetrics(w io.Writer) {
+	k.Routes.RLock()
+	fill := make([]int, len(k.Routes.buckets))
+	contacts := 0
+	for i, bucket := range k.Routes.buckets {
+		fill[i] = len(bucket)
+		contacts += len(bucket)
+	}
+	k.Routes.RUnlock()
+
+	// Render under the lock, which every RPC takes, and write after
+	// releasing it, so that a slow reader does not stall the node.
+	var buf bytes.Buffer
+	k.writeMetrics(&buf, fill, contacts)
+	w.Write(buf.Bytes())
+}
+
+func (k *Kademlia) writeMetrics(w io.Writer, fill []int, contacts int) {
+	m := k.metrics
+	m.Lock()
+	defer m.Unlock()
+	writeRPCs(w, "in", m.rpcIn)
+	writeRPCs(w, "out", m.rpcOut)
+
+	fmt.Fprint(w, "# HELP kademlia_bucket_contacts Contacts in each non-empty k-bucket, by shared prefix length.\n# TYPE kademlia_bucket_contacts gauge\n")
+	for i, n := range fill {
+		if n > 0 {
+			fmt.Fprintf(w, "kademlia_bucket_contacts{bucket=\"%d\"} %d\n", i, n)
+		}
+	}
+	fmt.Fprintf(w, "# HELP kademlia_routing_table_contacts Contacts in the routing table.\n# TYPE kademlia_routing_table_contacts gauge\nkademlia_routing_table_contacts %d\n", contacts)
+	fmt.Fprintf(w, "# HELP kademlia_stored_keys Keys stored at the node.\n# TYPE kademlia_stored_keys gauge\nkademlia_stored_keys %d\n", m.storedKeys)
+	fmt.Fprintf(w, "# HELP kademlia_stored_bytes Bytes of values stored at the node.\n# TYPE kademlia_stored_bytes gauge\nkademlia_stored_bytes %d\n", m.storedBytes)
+
+	fmt.Fprint(w, "# HELP kademlia_lookups_total Lookups, by result.\n# TYPE kademlia_lookups_total counter\n")
+	fmt.Fprintf(w, "kademlia_lookups_total{result=\"failure\"} %d\n", m.lookups[false])
+	fmt.Fprintf(w, "kademlia_lookups_total{result=\"success\"} %d\n", m.lookups[true])
+	fmt.Fprint(w, "# HELP kademlia_lookup_hops Rounds of queries per lookup.\n# TYPE kademlia_lookup_hops histogram\n")
+	m.lookupHops.write(w, "kademlia_lookup_hops", "")
+	fmt.Fprint(w, "# HELP kademlia_lookup_duration_seconds Time taken by lookups.\n# TYPE kademlia_lookup_duration_seconds histogram\n")
+	m.lookupDuration.write(w, "kademlia_lookup_duration_seconds", "")
+
+	fmt.Fprint(w, "# HELP kademlia_vanish_refreshes_total Vanish refreshes, by result.\n# TYPE kademlia_vanish_refreshes_total counter\n")
+	fmt.Fprintf(w, "kademlia_vanish_refreshes_total{result=\"failure\"} %d\n", m.refreshes[false])
+	fmt.Fprintf(w, "kademlia_vanish_refreshes_total{result=\"success\"} %d\n", m.refreshes[true])
+}
+
+// An http.Handler serving WriteMetrics.
+func (k *Kademlia) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		k.WriteMetrics(w)
+	})
+}
+
+// Serve /metrics over plain HTTP on addr.
+func listenMetrics(addr string, k *Kademlia) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", k.MetricsHandler())
+	go http.Serve(l, mux)
+	return l, nil
+}
+
+// The address metrics are served on, or nil unless Config.MetricsAddr is set.
+func (k *Kademlia) MetricsAddr() net.Addr {
+	if k.metricsListener == nil {
+		return nil
+	}
+	return k.metricsListener.Addr()
+}
@@ -0,0 +1,123 @@
+package kademlia
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 7} {
+		h.observe(v)
+	}
+	var buf bytes.Buffer
+	h.write(&buf, "x", `m="a"`)
+	want := `x_bucket{m="a",le="1"} 2
+x_bucket{m="a",le="5"} 3
+x_bucket{m="a",le="+Inf"} 4
+x_sum{m="a"} 11.5
+x_count{m="a"} 4
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s", buf.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	server := NewKademliaWithConfig("127.0.0.1:13300", Config{Insecure: true, MetricsAddr: "127.0.0.1:0"})
+	client := NewKademliaWithConfig("127.0.0.1:13301", Config{Insecure: true})
+	defer server.Close()
+	defer client.Close()
+	c := server.Routes.Self()
+	if resp := client.DoPing(c.Host, c.Port); !strings.HasPrefix(resp, "OK") {
+		t.Fatal(resp)
+	}
+	client.DoStore(&c, NewRandomID(), []byte("value"))
+	client.IterativeFindNode(NewRandomID(), false)
+	server.ReadFromBuckets(0)
+
+	// Peers do not get the metrics; scrapers use the metrics address.
+	resp, err := http.Get("http://127.0.0.1:13300/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("metrics over the peer listener: got %d", resp.StatusCode)
+	}
+	resp, err = http.Get("http://" + server.MetricsAddr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`kademlia_rpc_in_total{method="Ping"} 1`,
+		`kademlia_rpc_in_total{method="Store"} 1`,
+		`kademlia_rpc_in_errors_total{method="Store"} 0`,
+		`kademlia_rpc_in_duration_seconds_count{method="Ping"} 1`,
+		`kademlia_routing_table_contacts 1`,
+		`kademlia_stored_keys 1`,
+		`kademlia_stored_bytes 5`,
+		`kademlia_vanish_refreshes_total{result="success"} 0`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("no %q in server metrics", line)
+		}
+	}
+
+	var buf bytes.Buffer
+	client.WriteMetrics(&buf)
+	for _, line := range []string{
+		`kademlia_rpc_out_total{method="Ping"} 1`,
+		`kademlia_rpc_out_total{method="Store"} 1`,
+		`kademlia_lookups_total{result="success"} 1`,
+		`kademlia_lookup_hops_count 1`,
+		`kademlia_lookup_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("no %q in client metrics", line)
+		}
+	}
+}
+
+// A writer that blocks until released, like a stalled scraper.
+type stalledWriter struct {
+	once     sync.Once
+	started  chan bool
+	released chan bool
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.released
+	return len(p), nil
+}
+
+func TestStalledScraper(t *testing.T) {
+	k := NewKademliaWithConfig("127.0.0.1:0", Config{Transport: NewMemoryNetwork().Transport()})
+	defer k.Close()
+	w := &stalledWriter{started: make(chan bool), released: make(chan bool)}
+	defer close(w.released)
+	go k.WriteMetrics(w)
+	<-w.started
+
+	done := make(chan bool)
+	go func() {
+		k.metrics.rpc(k.metrics.rpcIn, "Ping", time.Millisecond, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("a stalled scraper blocks RPC metrics")
+	}
+}
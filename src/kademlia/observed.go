@@ -0,0 +1,140 @@
+package kademlia
+
+// Contains external address discovery. Every response carries the address the
+// responder saw the request come from. Once enough distinct peers agree, the
+// node advertises that address first, so that a node behind NAT or bound to an
+// unspecified address can still be reached. Peers vote by the subnet of the
+// address they were reached at, as IDs cost nothing to make up but addresses
+// in many subnets do.
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// Distinct subnets that must report the same address by default.
+	DefaultObservedQuorum = 3
+	// Subnets whose latest report is remembered.
+	maxObservations = 32
+)
+
+// Responses that report the requester's address.
+type observedResponse interface {
+	observedAddr() *net.TCPAddr
+}
+
+func (m *PongMessage) observedAddr() *net.TCPAddr          { return &m.Observed }
+func (m *StoreResult) observedAddr() *net.TCPAddr          { return &m.Observed }
+func (m *FindNodeResult) observedAddr() *net.TCPAddr       { return &m.Observed }
+func (m *FindValueResult) observedAddr() *net.TCPAddr      { return &m.Observed }
+func (m *GetVDOResult) observedAddr() *net.TCPAddr         { return &m.Observed }
+func (m *CompareAndSwapResult) observedAddr() *net.TCPAddr { return &m.Observed }
+
+// The address the current request came from, if known.
+func (kc *KademliaCore) observed() net.TCPAddr {
+	addr, ok := kc.remote.(*net.TCPAddr)
+	if !ok || addr == nil {
+		return net.TCPAddr{}
+	}
+	ret := *addr
+	if ip4 := ret.IP.To4(); ip4 != nil {
+		ret.IP = ip4
+	}
+	return ret
+}
+
+// The latest address peers in each subnet reported, and the one most agree on.
+type observations struct {
+	sync.Mutex
+	bySubnet map[string]net.IP
+	// Subnets in bySubnet, oldest report first.
+	order     []string
+	consensus net.IP
+}
+
+func newObservations() *observations {
+	return &observations{bySubnet: make(map[string]net.IP)}
+}
+
+// Record that the peer at from saw us at ip. Returns the consensus address
+// and whether it changed: the address reported from at least quorum subnets
+// and from more subnets than any other. Without such an address the previous
+// consensus stands.
+func (o *observations) add(from net.IP, ip net.IP, quorum int) (net.IP, bool) {
+	o.Lock()
+	defer o.Unlock()
+	voter := subnet(from)
+	if _, ok := o.bySubnet[voter]; ok {
+		for i, value := range o.order {
+			if value == voter {
+				o.order = append(o.order[:i], o.order[i+1:]...)
+				break
+			}
+		}
+	} else if len(o.order) == maxObservations {
+		delete(o.bySubnet, o.order[0])
+		o.order = o.order[1:]
+	}
+	o.bySubnet[voter] = ip
+	o.order = append(o.order, voter)
+
+	votes := make(map[string]int)
+	for _, value := range o.bySubnet {
+		votes[value.String()]++
+	}
+	best, tie := "", false
+	for s, n := range votes {
+		switch {
+		case n > votes[best]:
+			best, tie = s, false
+		case n == votes[best]:
+			tie = true
+		}
+	}
+	if tie || votes[best] < quorum {
+		return o.consensus, false
+	}
+	winner := net.ParseIP(best)
+	if ip4 := winner.To4(); ip4 != nil {
+		winner = ip4
+	}
+	if winner.Equal(o.consensus) {
+		return o.consensus, false
+	}
+	o.consensus = winner
+	return winner, true
+}
+
+// Take note of the address a response from the node reached at host says we
+// have, and advertise the consensus address if it changed.
+func (k *Kademlia) observe(responder ID, host net.IP, res signedMessage) {
+	o, ok := res.(observedResponse)
+	if !ok {
+		return
+	}
+	ip := o.observedAddr().IP
+	if ip == nil || ip.IsUnspecified() {
+		return
+	}
+	if sig := res.signature(); len(sig.PublicKey) != 0 {
+		responder = IDFromPublicKey(sig.PublicKey)
+	}
+	if responder == (ID{}) || responder == k.NodeID || host == nil {
+		return
+	}
+	quorum := k.conf.ObservedQuorum
+	if quorum <= 0 {
+		quorum = DefaultObservedQuorum
+	}
+	if public, changed := k.observations.add(host, ip, quorum); changed {
+		k.Routes.setPublicHost(public, k.localHosts)
+	}
+}
+
+// The external address peers agree the node has, if they do.
+func (k *Kademlia) PublicHost() (net.IP, bool) {
+	k.observations.Lock()
+	defer k.observations.Unlock()
+	return k.observations.consensus, k.observations.consensus != nil
+}
@@ -0,0 +1,89 @@
+package kademlia
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestObservationConsensus(t *testing.T) {
+	o := newObservations()
+	a := net.ParseIP("203.0.113.1")
+	b := net.ParseIP("203.0.113.2")
+	peers := make([]net.IP, 6)
+	for i := range peers {
+		peers[i] = net.IPv4(198, 51, byte(i), 1)
+	}
+
+	o.add(peers[0], a, 3)
+	// Repeated reports from one subnet count once, whichever peer sends them.
+	if _, changed := o.add(peers[0], a, 3); changed {
+		t.Error("consensus from a single peer")
+	}
+	if _, changed := o.add(net.IPv4(198, 51, 0, 2), a, 3); changed {
+		t.Error("consensus from a single subnet")
+	}
+	o.add(peers[1], a, 3)
+	ip, changed := o.add(peers[2], a, 3)
+	if !changed || !ip.Equal(a) {
+		t.Fatal("no consensus with three peers agreeing:", ip)
+	}
+
+	o.add(peers[3], b, 3)
+	o.add(peers[4], b, 3)
+	if ip, changed := o.add(peers[5], b, 3); changed || !ip.Equal(a) {
+		t.Error("a tie changed the consensus to", ip)
+	}
+	// A peer that saw a changes its mind.
+	ip, changed = o.add(peers[0], b, 3)
+	if !changed || !ip.Equal(b) {
+		t.Error("consensus did not follow the majority:", ip)
+	}
+}
+
+func TestObservedAddress(t *testing.T) {
+	node := NewKademlia("[::]:13210")
+	defer node.Close()
+	// Two peers share a subnet; the others each have their own.
+	hosts := []string{"127.0.1.1", "127.0.1.2", "127.0.2.1", "127.0.3.1"}
+	peers := make([]*Kademlia, len(hosts))
+	for i, host := range hosts {
+		peers[i] = NewKademlia(host + ":" + strconv.Itoa(13211+i))
+		defer peers[i].Close()
+	}
+	loopback := net.ParseIP("127.0.0.1")
+
+	pong, err := node.sendPing(&Contact{Host: net.ParseIP(hosts[0]), Port: 13211})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pong.Observed.IP.Equal(loopback) {
+		t.Error("peer observed", pong.Observed.IP)
+	}
+
+	for i := range peers[:3] {
+		node.DoPing(net.ParseIP(hosts[i]), uint16(13211+i))
+	}
+	if _, ok := node.PublicHost(); ok {
+		t.Error("consensus with peers in two subnets")
+	}
+	node.DoPing(net.ParseIP(hosts[3]), 13214)
+	public, ok := node.PublicHost()
+	if !ok || !public.Equal(loopback) {
+		t.Fatal("no consensus on the observed address:", public)
+	}
+	if self := node.Routes.Self(); !self.Host.Equal(loopback) {
+		t.Error("self contact has host", self.Host)
+	}
+
+	// Peers learn the new address from the next request.
+	peers[0].DoPing(loopback, 13210)
+	peers[0].ReadFromBuckets(0)
+	c, err := peers[0].FindContact(node.NodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Host.Equal(loopback) {
+		t.Error("peer has host", c.Host)
+	}
+}
@@ -0,0 +1,126 @@
+package kademlia
+
+// Contains the index of the peers announced over KRPC, whose lists krpc.go
+// stores in the hashtable. It keeps one compact address per IP for each info
+// hash, and each one expires unless announced again. The index holds at most
+// maxPeers in all.
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// How long an announce lasts.
+	peerTTL = 30 * time.Minute
+	// Peers held across all info hashes.
+	maxPeers = 10000
+	// Peers a get_peers reply returns. Each takes 8 bytes bencoded, which
+	// leaves the reply well within a 1280-byte datagram, the least that IPv6
+	// links carry without fragmenting.
+	maxPeerValues = 100
+)
+
+type announcedPeer struct {
+	addr    []byte
+	expires time.Time
+}
+
+type peerStore struct {
+	sync.Mutex
+	// The peers of each info hash, by IP.
+	byHash map[ID]map[string]announcedPeer
+	count  int
+	now    func() time.Time
+}
+
+func newPeerStore(now func() time.Time) *peerStore {
+	return &peerStore{byHash: make(map[ID]map[string]announcedPeer), now: now}
+}
+
+// Record that the peer at the compact address addr serves infoHash, in place
+// of any other port at its IP. Returns false if the store is full.
+func (s *peerStore) add(infoHash ID, addr []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	ip := string(addr[:4])
+	if _, ok := s.byHash[infoHash][ip]; !ok && s.count >= maxPeers {
+		s.expire(now)
+	}
+	peers := s.byHash[infoHash]
+	if _, ok := peers[ip]; !ok {
+		if s.count >= maxPeers {
+			return false
+		}
+		if peers == nil {
+			peers = make(map[string]announcedPeer)
+			s.byHash[infoHash] = peers
+		}
+		s.count++
+	}
+	peers[ip] = announcedPeer{addr, now.Add(peerTTL)}
+	return true
+}
+
+// Up to maxPeerValues of the peers of infoHash, picked at random.
+func (s *peerStore) get(infoHash ID) [][]byte {
+	return pickPeers(s.all(infoHash))
+}
+
+// The live peers of infoHash.
+func (s *peerStore) all(infoHash ID) [][]byte {
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	var ret [][]byte
+	for ip, p := range s.byHash[infoHash] {
+		if !now.Before(p.expires) {
+			s.remove(infoHash, ip)
+			continue
+		}
+		ret = append(ret, p.addr)
+	}
+	return ret
+}
+
+// Whether the peer at the compact address addr serves infoHash and has not
+// expired.
+func (s *peerStore) has(infoHash ID, addr []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	p, ok := s.byHash[infoHash][string(addr[:4])]
+	return ok && bytes.Equal(p.addr, addr) && s.now().Before(p.expires)
+}
+
+// Up to maxPeerValues of peers, picked at random.
+func pickPeers(peers [][]byte) [][]byte {
+	if len(peers) > maxPeerValues {
+		rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+		peers = peers[:maxPeerValues]
+	}
+	return peers
+}
+
+// Drop the expired peers. Must be called with the store locked.
+func (s *peerStore) expire(now time.Time) {
+	for infoHash, peers := range s.byHash {
+		for ip, p := range peers {
+			if !now.Before(p.expires) {
+				s.remove(infoHash, ip)
+			}
+		}
+	}
+}
+
+// Must be called with the store locked.
+func (s *peerStore) remove(infoHash ID, ip string) {
+	peers := s.byHash[infoHash]
+	delete(peers, ip)
+	s.count--
+	if len(peers) == 0 {
+		delete(s.byHash, infoHash)
+	}
+}
@@ -0,0 +1,154 @@
+package kademlia
+
+// Contains proximity neighbor selection (Config.Proximity). Kademlia may pick
+// any node of the right XOR distance for a bucket, so full buckets keep the
+// contacts that answer fastest, and each lookup round weighs the latency of
+// its next candidates against their distance. Round trip times come from the
+// liveness records and from the calls made to contacts outside the table.
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// Lookup rounds pick from this many of the closest unvisited candidates.
+	proximityWindow = 2 * ALPHA
+	// Round trip times of contacts outside the table are kept this long. A
+	// contact turned away from a full bucket is only pinged if its time is
+	// unknown: being pinged makes it consider us for its own table, so two
+	// nodes with full buckets could otherwise ping each other forever.
+	probeInterval = 10 * time.Minute
+	// At most this many of them are kept.
+	maxProbes = 1024
+)
+
+// The round trip time measured for a contact outside the table.
+type probe struct {
+	rtt time.Duration
+	at  time.Time
+}
+
+// Ping contact, which was turned away from the full bucket at prefix_length,
+// unless it was pinged recently, and let it replace the slowest contact there
+// if it answers faster.
+func (table *RoutingTable) preferNearer(prefix_length int, contact Contact) {
+	now := table.now()
+	table.Lock()
+	p, ok := table.probes[contact.NodeID]
+	table.Unlock()
+	if !ok || now.Sub(p.at) > probeInterval {
+		rtt, err := table.ping(&contact)
+		if err != nil {
+			rtt = 0
+		}
+		p = probe{rtt, now}
+		table.Lock()
+		table.addProbe(contact.NodeID, p)
+		table.Unlock()
+	}
+	rtt := p.rtt
+	if rtt <= 0 {
+		return
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	bucket := &table.buckets[prefix_length]
+	slowest := -1
+	var slowestRTT time.Duration
+	for x, value := range *bucket {
+		if value.NodeID.Equals(contact.NodeID) {
+			return
+		}
+		if l := table.liveness[value.NodeID]; l != nil && l.RTT > slowestRTT {
+			slowest, slowestRTT = x, l.RTT
+		}
+	}
+	if slowest < 0 || slowestRTT <= rtt {
+		return
+	}
+
+	removed := (*bucket)[slowest]
+	removedLiveness := table.liveness[removed.NodeID]
+	*bucket = append((*bucket)[:slowest], (*bucket)[slowest+1:]...)
+	delete(table.liveness, removed.NodeID)
+	table.Update(&contact)
+	l := table.liveness[contact.NodeID]
+	if l == nil {
+		// Turned away by the diversity limits; keep the old contact.
+		*bucket = append((*bucket)[:slowest], append([]Contact{removed}, (*bucket)[slowest:]...)...)
+		table.liveness[removed.NodeID] = removedLiveness
+		return
+	}
+	l.LastReply = l.LastSeen
+	l.RTT = rtt
+	delete(table.probes, contact.NodeID)
+}
+
+// Remember the round trip time of a contact outside the table. Must be called
+// with the table locked.
+func (table *RoutingTable) addProbe(id ID, p probe) {
+	if p.at.Sub(table.lastProbePrune) > probeInterval {
+		for id, old := range table.probes {
+			if p.at.Sub(old.at) > probeInterval {
+				delete(table.probes, id)
+			}
+		}
+		table.lastProbePrune = p.at
+	}
+	if _, ok := table.probes[id]; ok || len(table.probes) < maxProbes {
+		table.probes[id] = p
+	}
+}
+
+// The round trip time of the contact with id, or zero if it is unknown. Must
+// be called with the table locked.
+func (table *RoutingTable) rtt(id ID) time.Duration {
+	if l := table.liveness[id]; l != nil && l.RTT > 0 {
+		return l.RTT
+	}
+	if p, ok := table.probes[id]; ok && table.now().Sub(p.at) <= probeInterval {
+		return p.rtt
+	}
+	return 0
+}
+
+// Pick n of candidates, which are sorted by distance. Each one counts as its
+// place in that order plus its round trip time over the mean of the known
+// ones, so a slow candidate gives way to a fast one a place or two further
+// away. Unknown times count as the mean. The ones picked keep their order.
+func (table *RoutingTable) fastest(candidates []Contact, n int) []Contact {
+	rtts := make([]time.Duration, len(candidates))
+	var sum time.Duration
+	known := 0
+	table.RLock()
+	for i, c := range candidates {
+		if rtts[i] = table.rtt(c.NodeID); rtts[i] > 0 {
+			sum += rtts[i]
+			known++
+		}
+	}
+	table.RUnlock()
+	if known == 0 {
+		return candidates[:n]
+	}
+	mean := float64(sum) / float64(known)
+	scores := make([]float64, len(candidates))
+	order := make([]int, len(candidates))
+	for i := range candidates {
+		scores[i] = float64(i) + 1
+		if rtts[i] > 0 {
+			scores[i] = float64(i) + float64(rtts[i])/mean
+		}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] < scores[order[b]] })
+	picked := order[:n]
+	sort.Ints(picked)
+	ret := make([]Contact, n)
+	for i, j := range picked {
+		ret[i] = candidates[j]
+	}
+	return ret
+}
@@ -0,0 +1,88 @@
+package kademlia
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPreferNearer(t *testing.T) {
+	self := Contact{NodeID: NewRandomID(), Host: net.ParseIP("10.0.0.1"), Port: 1}
+	rt := NewRoutingTable(self)
+	rt.proximity = true
+	rtts := make(map[ID]time.Duration)
+	pings := make(map[ID]int)
+	rt.ping = func(c *Contact) (time.Duration, error) {
+		pings[c.NodeID]++
+		return rtts[c.NodeID], nil
+	}
+	contact := func(rtt time.Duration) *Contact {
+		c := &Contact{NodeID: randomIDInBucket(self.NodeID, 0), Host: net.ParseIP("10.0.1.1"), Port: 1}
+		rtts[c.NodeID] = rtt
+		return c
+	}
+
+	var slow *Contact
+	for i := 0; i < K; i++ {
+		c := contact(100 * time.Millisecond)
+		if i == K/2 {
+			c = contact(500 * time.Millisecond)
+			slow = c
+		}
+		rt.Update(c)
+		rt.replied(c.NodeID, rtts[c.NodeID])
+	}
+	in := func(c *Contact) bool {
+		_, ok := rt.Liveness(c.NodeID)
+		return ok
+	}
+
+	near := contact(50 * time.Millisecond)
+	rt.Update(near)
+	rt.RunEvictions()
+	if !in(near) || in(slow) {
+		t.Error("a faster contact did not replace the slowest one")
+	}
+	if l, _ := rt.Liveness(near.NodeID); l.RTT != 50*time.Millisecond {
+		t.Error("replacement has RTT", l.RTT)
+	}
+
+	far := contact(time.Second)
+	for i := 0; i < 2; i++ {
+		rt.Update(far)
+		rt.RunEvictions()
+	}
+	if in(far) {
+		t.Error("a slower contact replaced a faster one")
+	}
+	if pings[far.NodeID] != 1 {
+		t.Errorf("turned away contact pinged %d times", pings[far.NodeID])
+	}
+	if len(rt.buckets[0]) != K {
+		t.Errorf("bucket has %d contacts", len(rt.buckets[0]))
+	}
+}
+
+func TestFastest(t *testing.T) {
+	rt := NewRoutingTable(Contact{NodeID: NewRandomID()})
+	candidates := make([]Contact, 6)
+	for i := range candidates {
+		candidates[i] = Contact{NodeID: NewRandomID()}
+	}
+	// No times known: the closest.
+	if got := rt.fastest(candidates, 3); got[0].NodeID != candidates[0].NodeID || got[2].NodeID != candidates[2].NodeID {
+		t.Error("picked by latency without any known")
+	}
+	// A mean of 100ms. The second is twice as slow as the fourth is fast.
+	for i, ms := range []time.Duration{100, 250, 100, 20, 30, 0} {
+		if ms > 0 {
+			rt.probes[candidates[i].NodeID] = probe{ms * time.Millisecond, time.Now()}
+		}
+	}
+	got := rt.fastest(candidates, 3)
+	for i, want := range []int{0, 2, 3} {
+		if got[i].NodeID != candidates[want].NodeID {
+			t.Fatalf("pick %d is not candidate %d", i, want)
+		}
+	}
+}
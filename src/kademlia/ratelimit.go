@@ -0,0 +1,241 @@
+package kademlia
+
+// Contains admission control for incoming RPCs: a token bucket per source
+// and RPC method, and a cap on the handlers running at once. A source is an
+// IPv4 address, or an IPv6 /64, since one host usually holds a whole /64.
+// Requests over either limit fail with ErrRateLimited before any work is done
+// on them.
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+const (
+	// Idle buckets are dropped after this long.
+	limiterIdle = 10 * time.Minute
+	// The most buckets kept. Once there are this many, full buckets are
+	// dropped, and requests that would need a new bucket are turned away
+	// if none are.
+	maxLimiterBuckets = 1 << 16
+)
+
+// Rate requests per second, with bursts of up to Burst. A zero Rate means no
+// limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Limits on incoming RPCs. The zero value admits everything.
+type Limits struct {
+	// PerIP limits the requests from one source IP, or IPv6 /64, for each method
+	// ("Ping", "Store", "FindNode", "FindValue", "CompareAndSwap", "GetVDO",
+	// and "krpc_" plus a KRPC query's method, such as "krpc_get_peers").
+	// Methods without an entry get DefaultPerIP.
+	PerIP        map[string]RateLimit
+	DefaultPerIP RateLimit
+	// MaxConcurrent caps the handlers running at once across all peers.
+	// Zero means no cap.
+	MaxConcurrent int
+}
+
+// Counts of incoming RPCs by method.
+type LimiterStats struct {
+	Admitted map[string]uint64
+	// Rejected by the per-IP limits.
+	RateLimited map[string]uint64
+	// Rejected because MaxConcurrent handlers were running.
+	Overloaded    map[string]uint64
+	Running       int
+	MaxConcurrent int
+}
+
+type limiterKey struct {
+	source string
+	method string
+}
+
+// The source ip counts against: the address itself for IPv4, its /64 for
+// IPv6.
+func limiterSource(ip net.IP) string {
+	if ip == nil || ip.To4() != nil {
+		return ip.String()
+	}
+	return subnet(ip)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type limiter struct {
+	limits Limits
+	sem    chan struct{}
+
+	sync.Mutex
+	buckets   map[limiterKey]*tokenBucket
+	lastPrune time.Time
+	stats     LimiterStats
+}
+
+func newLimiter(limits Limits) *limiter {
+	l := &limiter{
+		limits:  limits,
+		buckets: make(map[limiterKey]*tokenBucket),
+		stats: LimiterStats{
+			Admitted:      make(map[string]uint64),
+			RateLimited:   make(map[string]uint64),
+			Overloaded:    make(map[string]uint64),
+			MaxConcurrent: limits.MaxConcurrent,
+		},
+	}
+	if limits.MaxConcurrent > 0 {
+		l.sem = make(chan struct{}, limits.MaxConcurrent)
+	}
+	return l
+}
+
+// Admit a request for method from ip. On success, release must be called once
+// the request has been handled.
+func (l *limiter) admit(ip net.IP, method string) (release func(), err error) {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if !l.take(limiterKey{limiterSource(ip), method}, now) {
+		l.stats.RateLimited[method]++
+		return nil, ErrRateLimited
+	}
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			l.stats.Overloaded[method]++
+			return nil, ErrRateLimited
+		}
+	}
+	l.stats.Admitted[method]++
+	l.stats.Running++
+	return func() {
+		l.Lock()
+		l.stats.Running--
+		l.Unlock()
+		if l.sem != nil {
+			<-l.sem
+		}
+	}, nil
+}
+
+// The limit for method and its burst, at least one.
+func (l *limiter) limit(method string) (RateLimit, float64) {
+	limit, ok := l.limits.PerIP[method]
+	if !ok {
+		limit = l.limits.DefaultPerIP
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return limit, burst
+}
+
+// Refill bucket, which has limit and burst, up to now.
+func (bucket *tokenBucket) refill(limit RateLimit, burst float64, now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.Rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+}
+
+// Take a token from the bucket for key. Must be called with l locked.
+func (l *limiter) take(key limiterKey, now time.Time) bool {
+	limit, burst := l.limit(key.method)
+	if limit.Rate <= 0 {
+		return true
+	}
+
+	if now.Sub(l.lastPrune) > limiterIdle {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.last) > limiterIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	bucket := l.buckets[key]
+	if bucket == nil {
+		if len(l.buckets) >= maxLimiterBuckets && !l.dropFull(now) {
+			return false
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.refill(limit, burst, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Drop the buckets that have refilled, which a new bucket would stand in for
+// just as well, and report whether any were. Must be called with l locked.
+func (l *limiter) dropFull(now time.Time) bool {
+	dropped := false
+	for k, bucket := range l.buckets {
+		limit, burst := l.limit(k.method)
+		if bucket.refill(limit, burst, now); bucket.tokens >= burst {
+			delete(l.buckets, k)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+func (l *limiter) snapshot() LimiterStats {
+	l.Lock()
+	defer l.Unlock()
+	ret := l.stats
+	ret.Admitted = copyCounts(l.stats.Admitted)
+	ret.RateLimited = copyCounts(l.stats.RateLimited)
+	ret.Overloaded = copyCounts(l.stats.Overloaded)
+	return ret
+}
+
+func copyCounts(m map[string]uint64) map[string]uint64 {
+	ret := make(map[string]uint64, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Admit the current request for method; see limiter.admit. The handler must
+// pass its result to release, for the metrics.
+func (kc *KademliaCore) admit(method string) (release func(*error), err error) {
+	start := time.Now()
+	var ip net.IP
+	if addr, ok := kc.remote.(*net.TCPAddr); ok && addr != nil {
+		ip = addr.IP
+	}
+	done, err := kc.kademlia.limiter.admit(ip, method)
+	if err != nil {
+		kc.kademlia.metrics.served(method, time.Since(start), err)
+		return nil, err
+	}
+	return func(err *error) {
+		done()
+		kc.kademlia.metrics.served(method, time.Since(start), *err)
+	}, nil
+}
+
+// Counts of the RPCs the node admitted and turned away.
+func (k *Kademlia) LimiterStats() LimiterStats {
+	return k.limiter.snapshot()
+}
@@ -0,0 +1,134 @@
+package kademlia
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(Limits{
+		PerIP:         map[string]RateLimit{"Store": {Rate: 0.001, Burst: 2}},
+		MaxConcurrent: 3,
+	})
+	a := net.ParseIP("10.0.0.1")
+	b := net.ParseIP("10.0.0.2")
+
+	for i := 0; i < 2; i++ {
+		release, err := l.admit(a, "Store")
+		if err != nil {
+			t.Fatal("request within the burst refused:", err)
+		}
+		release()
+	}
+	if _, err := l.admit(a, "Store"); err != ErrRateLimited {
+		t.Error("request over the burst admitted")
+	}
+	// Other IPs and methods have their own budgets.
+	release1, err := l.admit(b, "Store")
+	if err != nil {
+		t.Error("another IP was limited")
+	}
+	release2, err := l.admit(a, "Ping")
+	if err != nil {
+		t.Error("another method was limited")
+	}
+	release3, err := l.admit(a, "Ping")
+	if err != nil {
+		t.Error("unlimited method was limited")
+	}
+	if _, err := l.admit(b, "Ping"); err != ErrRateLimited {
+		t.Error("request over the concurrency cap admitted")
+	}
+	release1()
+	release2()
+	release3()
+	if _, err := l.admit(b, "Ping"); err != nil {
+		t.Error("request refused after handlers finished")
+	}
+
+	stats := l.snapshot()
+	if stats.Admitted["Store"] != 3 || stats.RateLimited["Store"] != 1 ||
+		stats.Admitted["Ping"] != 3 || stats.Overloaded["Ping"] != 1 || stats.Running != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestLimiterSources(t *testing.T) {
+	l := newLimiter(Limits{DefaultPerIP: RateLimit{Rate: 0.001, Burst: 1}})
+	for _, test := range []struct {
+		ip    string
+		admit bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.2", true},
+		{"2001:db8::1", true},
+		// The same /64.
+		{"2001:db8::2", false},
+		{"2001:db8:0:0:ffff::1", false},
+		{"2001:db8:0:1::1", true},
+	} {
+		if _, err := l.admit(net.ParseIP(test.ip), "Ping"); (err == nil) != test.admit {
+			t.Errorf("%s: got %v", test.ip, err)
+		}
+	}
+}
+
+func TestLimiterCap(t *testing.T) {
+	l := newLimiter(Limits{DefaultPerIP: RateLimit{Rate: 1, Burst: 1}})
+	now := time.Now()
+	source := func(i int) limiterKey {
+		return limiterKey{net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String(), "Ping"}
+	}
+	for i := 0; i < maxLimiterBuckets; i++ {
+		if !l.take(source(i), now) {
+			t.Fatal("first request from a source refused")
+		}
+	}
+	if l.take(source(maxLimiterBuckets), now) {
+		t.Error("new source admitted with every bucket empty")
+	}
+	if !l.take(source(0), now.Add(time.Second)) {
+		t.Error("known source refused after refilling")
+	}
+	// The others have refilled too, and make way.
+	if !l.take(source(maxLimiterBuckets), now.Add(time.Second)) {
+		t.Error("new source refused with full buckets to drop")
+	}
+	if len(l.buckets) != 2 {
+		t.Errorf("%d buckets kept", len(l.buckets))
+	}
+}
+
+func TestRateLimitedStore(t *testing.T) {
+	network := NewMemoryNetwork()
+	server := NewKademliaWithConfig("127.0.0.1:1", Config{
+		Transport: network.Transport(),
+		Limits:    Limits{PerIP: map[string]RateLimit{"Store": {Rate: 0.001, Burst: 2}}},
+	})
+	client := NewKademliaWithConfig("127.0.0.1:2", Config{Transport: network.Transport()})
+	c := server.Routes.Self()
+
+	for i := 0; i < 2; i++ {
+		if resp := client.DoStore(&c, NewRandomID(), []byte("value")); !strings.HasPrefix(resp, "OK") {
+			t.Fatal(resp)
+		}
+	}
+	if resp := client.DoStore(&c, NewRandomID(), []byte("value")); resp != "ERR: "+ErrRateLimited.Error() {
+		t.Error("store over the limit returned", resp)
+	}
+	req := &StoreRequest{Sender: client.Routes.Self(), MsgID: NewRandomID(), Key: NewRandomID()}
+	if err := client.call(&c, "Store", req, new(StoreResult)); err != ErrRateLimited {
+		t.Error("call over the limit returned", err)
+	}
+	if resp := client.DoPing(c.Host, c.Port); !strings.HasPrefix(resp, "OK") {
+		t.Error("ping was limited:", resp)
+	}
+	if stats := server.LimiterStats(); stats.RateLimited["Store"] != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+	if s := server.Snapshot(); s.Limiter.RateLimited["Store"] != 2 || s.Limiter.Admitted["Ping"] != 1 {
+		t.Errorf("snapshot has limiter stats %+v", s.Limiter)
+	}
+}
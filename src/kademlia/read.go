@@ -0,0 +1,192 @@
+package kademlia
+
+// Contains quorum reads. IterativeFindNode(key, true) takes the first value
+// any node returns; IterativeFindValue instead asks the closest nodes until a
+// read quorum of them has answered, settles on one value with a Resolver and
+// writes it back, with its version, to the nodes that answered with another
+// value or none.
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+var ErrReadQuorum = errors.New("read quorum not reached")
+
+// What one node answered to a read.
+type Replica struct {
+	Contact Contact
+	// nil if the node has no value for the key.
+	Value   []byte
+	Version Version
+}
+
+// Whether two replicas hold the same value under the same version.
+func (r Replica) same(o Replica) bool {
+	return r.Version == o.Version && bytes.Equal(r.Value, o.Value)
+}
+
+// A Resolver picks the replica whose value a read returns from those that had
+// one, which are sorted closest to the key first. There is at least one.
+type Resolver func(replicas []Replica) Replica
+
+// The replica with the newest version, or the closest of those with it: the
+// last writer wins.
+func LatestResolver(replicas []Replica) Replica {
+	best := 0
+	for i := range replicas {
+		if replicas[i].Version.Newer(replicas[best].Version) {
+			best = i
+		}
+	}
+	return replicas[best]
+}
+
+// The value and version most replicas returned; among equally common ones,
+// those the closest node returned.
+func MajorityResolver(replicas []Replica) Replica {
+	best, bestCount := 0, 0
+	for i := range replicas {
+		count := 0
+		for j := range replicas {
+			if replicas[i].same(replicas[j]) {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = i, count
+		}
+	}
+	return replicas[best]
+}
+
+// The outcome of a quorum read.
+type ReadResult struct {
+	Key ID
+	// How many nodes had to answer.
+	Quorum int
+	// The resolved value, or nil if no node had one, and its version.
+	Value   []byte
+	Version Version
+	// The answers, closest first.
+	Replicas []Replica
+	// Whether every node that answered returned the same value and version.
+	Agreed bool
+	// The nodes that answered with another value or none and were sent the
+	// resolved one.
+	Repaired []Contact
+}
+
+// Read the value under key from the closest nodes until quorum of them have
+// answered; a quorum of 0 or less counts as 1. Their values are settled by
+// resolve, or by LatestResolver if it is nil, and the resolved value is stored
+// at the nodes that disagreed. Returns ErrReadQuorum, along with the
+// result, if too few nodes answered, and ErrValueNotFound if none of them had
+// a value.
+func (k *Kademlia) IterativeFindValue(key ID, quorum int, resolve Resolver) (*ReadResult, error) {
+	if quorum <= 0 {
+		quorum = 1
+	}
+	if resolve == nil {
+		resolve = LatestResolver
+	}
+	ret := &ReadResult{Key: key, Quorum: quorum}
+	found := k.IterativeFindNode(key, false)
+	candidates := make([]Contact, 0, len(found.contacts)+len(found.spare))
+	candidates = append(append(candidates, found.contacts...), found.spare...)
+
+	type reply struct {
+		value   []byte
+		version Version
+		err     error
+	}
+	replies := make([]reply, len(candidates))
+	answers := 0
+	next := 0
+	for answers < quorum && next < len(candidates) {
+		// Ask as many more nodes as answers are missing.
+		end := next + quorum - answers
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		var wg sync.WaitGroup
+		for i := next; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				value, version, _, err := k.FindValue(&candidates[i], key)
+				replies[i] = reply{value, version, err}
+			}(i)
+		}
+		wg.Wait()
+		for i := next; i < end; i++ {
+			if replies[i].err == nil {
+				answers++
+			}
+		}
+		next = end
+	}
+	for i, c := range candidates[:next] {
+		if replies[i].err == nil {
+			ret.Replicas = append(ret.Replicas, Replica{c, replies[i].value, replies[i].version})
+		}
+	}
+
+	withValue := make([]Replica, 0, len(ret.Replicas))
+	for _, r := range ret.Replicas {
+		if r.Value != nil {
+			withValue = append(withValue, r)
+		}
+	}
+	ret.Agreed = true
+	for _, r := range ret.Replicas {
+		if !r.same(ret.Replicas[0]) {
+			ret.Agreed = false
+		}
+	}
+	if len(withValue) > 0 {
+		resolved := resolve(withValue)
+		ret.Value, ret.Version = resolved.Value, resolved.Version
+		ret.Repaired = k.readRepair(key, resolved, ret.Replicas)
+	}
+
+	switch {
+	case len(ret.Replicas) < quorum:
+		return ret, ErrReadQuorum
+	case ret.Value == nil:
+		return ret, ErrValueNotFound
+	}
+	return ret, nil
+}
+
+// Store the resolved value at the replicas that returned another, and return
+// those that took it. A replica that already holds a newer version keeps it,
+// and is not counted.
+func (k *Kademlia) readRepair(key ID, resolved Replica, replicas []Replica) []Contact {
+	stale := make([]Contact, 0)
+	for _, r := range replicas {
+		if !r.same(resolved) {
+			stale = append(stale, r.Contact)
+		}
+	}
+	repaired := make(chan *Contact, len(stale))
+	for _, c := range stale {
+		go func(c Contact) {
+			req := &StoreRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: resolved.Value, Version: resolved.Version}
+			res := new(StoreResult)
+			if k.call(&c, "Store", req, res) != nil || res.Version != resolved.Version {
+				repaired <- nil
+				return
+			}
+			repaired <- &c
+		}(c)
+	}
+	ret := make([]Contact, 0, len(stale))
+	for range stale {
+		if c := <-repaired; c != nil {
+			ret = append(ret, *c)
+		}
+	}
+	return ret
+}
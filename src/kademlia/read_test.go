@@ -0,0 +1,111 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolvers(t *testing.T) {
+	replicas := []Replica{
+		{Value: []byte("a"), Version: Version{Timestamp: 1}},
+		{Value: []byte("b"), Version: Version{Timestamp: 2}},
+		{Value: []byte("b"), Version: Version{Timestamp: 2}},
+		{Value: []byte("c"), Version: Version{Timestamp: 3}},
+	}
+	if got := string(MajorityResolver(replicas).Value); got != "b" {
+		t.Errorf("majority: got %q", got)
+	}
+	// On a tie, the closest replica wins.
+	if got := string(MajorityResolver(replicas[:2]).Value); got != "a" {
+		t.Errorf("majority of a tie: got %q", got)
+	}
+	if got := LatestResolver(replicas); string(got.Value) != "c" || got.Version.Timestamp != 3 {
+		t.Errorf("latest: got %q", got.Value)
+	}
+}
+
+func TestQuorumRead(t *testing.T) {
+	instanceList := newMemoryNodes(t, 40)
+	k := instanceList[0]
+	network := k.transport.(*MemoryTransport).network
+	key := NewRandomID()
+	closest := k.IterativeFindNode(key, false).Contacts()
+	if len(closest) != K {
+		t.Fatalf("found %d nodes", len(closest))
+	}
+	store := func(c Contact, value string, version Version) {
+		req := &StoreRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: []byte(value), Version: version}
+		if err := k.call(&c, "Store", req, new(StoreResult)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two nodes have the new value, five an old one and the rest none; the
+	// newest version wins over the majority.
+	old, latest := k.NewVersion(), k.NewVersion()
+	for _, c := range closest[:5] {
+		store(c, "old", old)
+	}
+	for _, c := range closest[5:7] {
+		store(c, "new", latest)
+	}
+
+	res, err := k.IterativeFindValue(key, K, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Value) != "new" || res.Version != latest || res.Agreed || len(res.Replicas) != K {
+		t.Fatalf("got %q from %d replicas, agreed %v", res.Value, len(res.Replicas), res.Agreed)
+	}
+	if len(res.Repaired) != K-2 {
+		t.Errorf("repaired %d nodes", len(res.Repaired))
+	}
+	for _, node := range instanceList {
+		if node.NodeID == closest[0].NodeID {
+			if keys, found := node.LocalFindValueHelper(key); found != 1 || string(keys.Value) != "new" || keys.Version != latest {
+				t.Error("stale replica not repaired")
+			}
+		}
+	}
+	// After the repair, the replicas agree.
+	res, err = k.IterativeFindValue(key, K, nil)
+	if err != nil || !res.Agreed || len(res.Repaired) != 0 {
+		t.Errorf("got %v, agreed %v, repaired %d", err, res.Agreed, len(res.Repaired))
+	}
+
+	// Replicas with a newer version than the resolved one turn the repair
+	// away.
+	oldest := func(replicas []Replica) Replica {
+		ret := replicas[0]
+		for _, r := range replicas {
+			if ret.Version.Newer(r.Version) {
+				ret = r
+			}
+		}
+		return ret
+	}
+	store(closest[0], "newest", k.NewVersion())
+	res, err = k.IterativeFindValue(key, K, oldest)
+	if err != nil || string(res.Value) != "new" || len(res.Repaired) != 0 {
+		t.Errorf("got %v, %q, repaired %d", err, res.Value, len(res.Repaired))
+	}
+
+	if _, err = k.IterativeFindValue(NewRandomID(), 3, nil); err != ErrValueNotFound {
+		t.Errorf("got %v for a missing key", err)
+	}
+
+	// Without any node answering, the quorum of 1 fails.
+	network.Lock()
+	network.Link = func(from, to net.Addr, method string) (time.Duration, error) {
+		if method == "FindValue" {
+			return 0, errors.New("dropped")
+		}
+		return time.Millisecond, nil
+	}
+	network.Unlock()
+	res, err = k.IterativeFindValue(key, 0, nil)
+	if err != ErrReadQuorum || res.Quorum != 1 || len(res.Replicas) != 0 {
+		t.Errorf("got %v from %d replicas", err, len(res.Replicas))
+	}
+}
@@ -1,26 +1,91 @@
 package kademlia
 
 import (
-	"net/rpc"
+	"net"
 	"sort"
-	"strconv"
 	"sync"
+	"time"
 )
 
 type RoutingTable struct {
+	// Read it with Self; the addresses change as the node discovers its
+	// public one.
 	SelfContact Contact
+	selfMu      sync.RWMutex
 	buckets     [][]Contact
+	// Used to check whether the least recently seen contact of a full bucket
+	// is still alive. If nil, it is always assumed to be.
+	// It returns the round trip time of the ping.
+	ping func(*Contact) (time.Duration, error)
 	sync.RWMutex
+	// Evictions waiting for a ping; see pingToRemove.
+	evictions []eviction
+	evicting  map[ID]bool
+	evictMu   sync.Mutex
+	// Signalled when an eviction is queued.
+	kick chan struct{}
+	// Limits on contacts sharing an address; see checkDiversity.
+	diversity      Diversity
+	diversityStats DiversityStats
+	// Health of each contact in the buckets; see liveness.go.
+	liveness map[ID]*Liveness
+	// Whether full buckets prefer contacts with lower round trip times; see
+	// RunEvictions.
+	proximity bool
+	// Recent pings of contacts turned away from full buckets.
+	probes         map[ID]probe
+	lastProbePrune time.Time
+	// The clock liveness and probes are timed by; see Config.Now.
+	now func() time.Time
+}
+
+// A full bucket's oldest contact, and the contact that replaces it if it is
+// dead.
+type eviction struct {
+	prefix_length int
+	oldest        Contact
+	contact       Contact
 }
 
 func NewRoutingTable(node Contact) (ret *RoutingTable) {
 	ret = new(RoutingTable)
 	ret.buckets = make([][]Contact, IDBits)
 	ret.SelfContact = node
+	ret.evicting = make(map[ID]bool)
+	ret.liveness = make(map[ID]*Liveness)
+	ret.probes = make(map[ID]probe)
+	ret.kick = make(chan struct{}, 1)
+	ret.now = time.Now
 	return
 }
 
+// The node's own contact.
+func (table *RoutingTable) Self() Contact {
+	table.selfMu.RLock()
+	defer table.selfMu.RUnlock()
+	return table.SelfContact
+}
+
+// Advertise public first, followed by the addresses the node listens on.
+func (table *RoutingTable) setPublicHost(public net.IP, local []net.IP) {
+	alt := make([]net.IP, 0, len(local))
+	for _, ip := range local {
+		if !ip.Equal(public) {
+			alt = append(alt, ip)
+		}
+	}
+	table.selfMu.Lock()
+	defer table.selfMu.Unlock()
+	table.SelfContact.Host = public
+	table.SelfContact.AltHosts = alt
+}
+
+// Must be called with the table locked.
 func (table *RoutingTable) Update(contact *Contact) {
+	if _, ok := table.route(contact); !ok {
+		// No use keeping a node we cannot reach.
+		return
+	}
 	prefix_length := contact.NodeID.Xor(table.SelfContact.NodeID).PrefixLen()
 	if prefix_length == 160 {
 		return
@@ -39,64 +104,123 @@ func (table *RoutingTable) Update(contact *Contact) {
 		}
 	}
 	if found == 0 {
-		if len(*bucket) <= K {
+		if table.checkDiversity(prefix_length, contact) != nil {
+			return
+		}
+		if len(*bucket) < K {
 			*bucket = append(*bucket, *contact)
+			table.liveness[contact.NodeID] = &Liveness{LastSeen: table.now()}
+		} else if table.ping == nil {
+			moveToBack(bucket, 0)
 		} else {
-			pingToRemove(bucket, contact, &table.SelfContact)
+			table.pingToRemove(prefix_length, *contact)
 		}
 
 	} else {
+		// Keep the addresses the node gives now, unless they break the
+		// diversity limits.
+		if !sameAddresses(&element, contact) && table.checkDiversity(prefix_length, contact) == nil {
+			element.Host = contact.Host
+			element.AltHosts = contact.AltHosts
+		}
 		*bucket = append((*bucket)[:index], (*bucket)[index+1:]...)
 		*bucket = append(*bucket, element)
+		table.seen(contact.NodeID)
 	}
 }
 
+func moveToBack(bucket *[]Contact, index int) {
+	tmp := (*bucket)[index]
+	*bucket = append((*bucket)[:index], (*bucket)[index+1:]...)
+	*bucket = append(*bucket, tmp)
+}
+
 /***
  * if the least recently used contact has response, then
  * ignore the new element. If the least recently used contact
  * doesn't have response, then delete it and add the new contact.
+ *
+ * The ping is queued for RunEvictions rather than sent here: the pinged node
+ * may be waiting on our table itself, and pinging it while holding the table
+ * deadlocks.
  */
-func pingToRemove(bucket *[]Contact, contact *Contact, self *Contact) {
-	ping := PingMessage{*self, NewRandomID()}
-	var pong PongMessage
-	remove := 0
-
-	port_str := strconv.Itoa(int((*bucket)[0].Port))
-	client, err := rpc.DialHTTPPath("tcp", Dest((*bucket)[0].Host, (*bucket)[0].Port), rpc.DefaultRPCPath+port_str)
-	if err != nil {
-		remove = 1
+func (table *RoutingTable) pingToRemove(prefix_length int, contact Contact) {
+	oldest := table.buckets[prefix_length][0]
+	table.evictMu.Lock()
+	defer table.evictMu.Unlock()
+	if table.evicting[oldest.NodeID] {
+		// Already queued; the new contact is dropped.
+		return
 	}
-	defer client.Close()
-	err = client.Call("KademliaCore.Ping", ping, &pong)
-	if err != nil {
-		remove = 1
+	table.evicting[oldest.NodeID] = true
+	table.evictions = append(table.evictions, eviction{prefix_length, oldest, contact})
+	select {
+	case table.kick <- struct{}{}:
+	default:
 	}
+}
 
-	if remove == 1 {
-		*bucket = (*bucket)[1:]
-		*bucket = append(*bucket, *contact)
-	} else {
-		tmp := (*bucket)[0]
-		*bucket = (*bucket)[1:]
-		*bucket = append(*bucket, tmp)
+// Ping the oldest contacts of full buckets queued by Update, and replace the
+// ones that do not answer. With proximity neighbor selection, a new contact
+// may also replace the slowest live one. Returns once the queue is empty.
+func (table *RoutingTable) RunEvictions() {
+	for {
+		table.evictMu.Lock()
+		if len(table.evictions) == 0 {
+			table.evictMu.Unlock()
+			return
+		}
+		ev := table.evictions[0]
+		table.evictions = table.evictions[1:]
+		table.evictMu.Unlock()
+
+		_, err := table.ping(&ev.oldest)
+
+		table.Lock()
+		bucket := &table.buckets[ev.prefix_length]
+		index := -1
+		for x, value := range *bucket {
+			if value.NodeID.Equals(ev.oldest.NodeID) {
+				index = x
+				break
+			}
+		}
+		if err != nil {
+			if index >= 0 {
+				*bucket = append((*bucket)[:index], (*bucket)[index+1:]...)
+				delete(table.liveness, ev.oldest.NodeID)
+			}
+			if len(*bucket) < K {
+				table.Update(&ev.contact)
+			}
+		} else if index >= 0 {
+			moveToBack(bucket, index)
+		}
+		table.Unlock()
+		if err == nil && table.proximity {
+			table.preferNearer(ev.prefix_length, ev.contact)
+		}
+
+		table.evictMu.Lock()
+		delete(table.evicting, ev.oldest.NodeID)
+		table.evictMu.Unlock()
 	}
 }
 
 type ContactDistance struct {
 	contact Contact
-	Dist    int
+	Dist    ID
 }
 
 type ByDist []ContactDistance
 
 func (d ByDist) Len() int           { return len(d) }
 func (d ByDist) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
-func (d ByDist) Less(i, j int) bool { return d[i].Dist < d[j].Dist }
+func (d ByDist) Less(i, j int) bool { return d[i].Dist.Less(d[j].Dist) }
 
 func calcDist(target ID, bucket []Contact, tempList *[]ContactDistance) {
 	for _, value := range bucket {
-		distID := value.NodeID.Xor(target)
-		dist := distID.ToInt()
+		dist := value.NodeID.Xor(target)
 		cd := &ContactDistance{value, dist}
 		*tempList = append(*tempList, *cd)
 	}
@@ -110,14 +234,14 @@ func (table *RoutingTable) FindClosest(target ID, count int) (ret []Contact) {
 	prefix_len := target.Xor(table.SelfContact.NodeID).PrefixLen()
 	for i := 0; (prefix_len-i >= 0 || prefix_len+i < IDBits) && len(tempList) < count; i++ {
 		if prefix_len == IDBits && prefix_len-i == IDBits {
-			tempList = append(tempList, ContactDistance{table.SelfContact, 0})
+			tempList = append(tempList, ContactDistance{table.Self(), ID{}})
 			continue
 		}
 		if prefix_len-i >= 0 {
 			bucket := table.buckets[prefix_len-i]
 			calcDist(target, bucket, &tempList)
 		}
-		if prefix_len+i < IDBits {
+		if i > 0 && prefix_len+i < IDBits {
 			bucket := table.buckets[prefix_len+i]
 			calcDist(target, bucket, &tempList)
 		}
@@ -11,10 +11,10 @@ func TestRoutingTable(t *testing.T) {
 	for i := 0; i < 20; i++ {
 		Nodes = append(Nodes, NewRandomID())
 	}
-	rt := NewRoutingTable(Contact{Nodes[0], net.ParseIP("127.0.0.1"), uint16(7890)})
+	rt := NewRoutingTable(Contact{NodeID: Nodes[0], Host: net.ParseIP("127.0.0.1"), Port: uint16(7890)})
 
 	for i := 1; i < len(Nodes); i++ {
-		rt.Update(&Contact{Nodes[i], net.ParseIP("127.0.0.1"), uint16(7890 + i)})
+		rt.Update(&Contact{NodeID: Nodes[i], Host: net.ParseIP("127.0.0.1"), Port: uint16(7890 + i)})
 	}
 
 	//	t.Log(rt)
@@ -31,10 +31,10 @@ func TestFindClosest(t *testing.T) {
 	for i := 0; i < 25; i++ {
 		Nodes = append(Nodes, NewRandomID())
 	}
-	rt := NewRoutingTable(Contact{Nodes[0], net.ParseIP("127.0.0.1"), uint16(7890)})
+	rt := NewRoutingTable(Contact{NodeID: Nodes[0], Host: net.ParseIP("127.0.0.1"), Port: uint16(7890)})
 
 	for i := 1; i < len(Nodes); i++ {
-		rt.Update(&Contact{Nodes[i], net.ParseIP("127.0.0.1"), uint16(7890 + i)})
+		rt.Update(&Contact{NodeID: Nodes[i], Host: net.ParseIP("127.0.0.1"), Port: uint16(7890 + i)})
 	}
 
 	target := Nodes[1]
@@ -59,9 +59,9 @@ func TestUpdate(t testing.T) {
 		nodeid = append("0", nodeid[1:])
 		Nodes = append(Nodes, nodeid.IDFromString)
 	}
-	rt := NewRoutingTable(Contact{Nodes[0], net.ParseIP("127.0.0.1"), uint16(7890)})
+	rt := NewRoutingTable(Contact{NodeID: Nodes[0], Host: net.ParseIP("127.0.0.1"), Port: uint16(7890)})
 	for i := 1; i < len(Nodes); i++ {
-		rt.Update(&Contact{Nodes[i], net.ParseIP("127.0.0.1"), uint16(7890 + i)})
+		rt.Update(&Contact{NodeID: Nodes[i], Host: net.ParseIP("127.0.0.1"), Port: uint16(7890 + i)})
 	}
 
 	if len(rt.buckets[0]) != 20 {
@@ -6,10 +6,24 @@ package kademlia
 
 import (
 	"net"
+	"time"
 )
 
 type KademliaCore struct {
 	kademlia *Kademlia
+	// The node ID the connection was authenticated as, if any.
+	peer *ID
+	// Where the connection comes from.
+	remote net.Addr
+}
+
+// Check an incoming request. Over TLS, the sender must also be the peer that
+// authenticated the connection.
+func (kc *KademliaCore) verify(sender *Contact, msg signedMessage) error {
+	if kc.peer != nil && *kc.peer != sender.NodeID {
+		return ErrPeerMismatch
+	}
+	return kc.kademlia.verifyRequest(sender, msg)
 }
 
 // Host identification.
@@ -17,6 +31,9 @@ type Contact struct {
 	NodeID ID
 	Host   net.IP
 	Port   uint16
+	// Other addresses the node listens on at Port, such as an IPv6 address
+	// next to an IPv4 Host.
+	AltHosts []net.IP
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -25,20 +42,38 @@ type Contact struct {
 type PingMessage struct {
 	Sender Contact
 	MsgID  ID
+	Sig    Signature
 }
 
 type PongMessage struct {
 	MsgID  ID
 	Sender Contact
+	// The address the request came from.
+	Observed net.TCPAddr
+	Sig      Signature
 }
 
-func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
-	// TODO: Finish implementation
+func (m *PingMessage) signature() *Signature { return &m.Sig }
+func (m *PingMessage) messageID() ID         { return m.MsgID }
+func (m *PongMessage) signature() *Signature { return &m.Sig }
+func (m *PongMessage) messageID() ID         { return m.MsgID }
+
+func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) (err error) {
+	release, err := kc.admit("Ping")
+	if err != nil {
+		return err
+	}
+	defer release(&err)
+	if err := kc.verify(&ping.Sender, &ping); err != nil {
+		return err
+	}
 	pong.MsgID = CopyID(ping.MsgID)
 	// Specify the sender
-	pong.Sender = kc.kademlia.Routes.SelfContact
+	pong.Sender = kc.kademlia.Routes.Self()
+	pong.Observed = kc.observed()
 	// Update contact, etc
-	kc.kademlia.contactChan <- &ping.Sender
+	kc.kademlia.update(&ping.Sender)
+	kc.kademlia.sign(pong)
 	return nil
 }
 
@@ -50,18 +85,50 @@ type StoreRequest struct {
 	MsgID  ID
 	Key    ID
 	Value  []byte
+	// The node keeps the value unless it has a newer version.
+	Version Version
+	Sig     Signature
 }
 
 type StoreResult struct {
 	MsgID ID
 	Err   error
+	// The version the node holds after the store, which is newer than the
+	// request's if it kept its value.
+	Version  Version
+	Observed net.TCPAddr
+	Sig      Signature
 }
 
-func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) error {
-	set := &KeySet{req.Key, req.Value, make(chan int)}
+func (m *StoreRequest) signature() *Signature { return &m.Sig }
+func (m *StoreRequest) messageID() ID         { return m.MsgID }
+func (m *StoreResult) signature() *Signature  { return &m.Sig }
+func (m *StoreResult) messageID() ID          { return m.MsgID }
+
+func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) (err error) {
+	release, err := kc.admit("Store")
+	if err != nil {
+		return err
+	}
+	defer release(&err)
+	if err := kc.verify(&req.Sender, &req); err != nil {
+		return err
+	}
+	if kc.kademlia.clock.ahead(req.Version.Timestamp) {
+		return ErrFutureVersion
+	}
+	set := &KeySet{req.Key, req.Value, req.Version, make(chan int)}
 	res.MsgID = CopyID(req.MsgID)
-	kc.kademlia.contactChan <- &req.Sender
-	kc.kademlia.keyChan <- set
+	res.Observed = kc.observed()
+	kc.kademlia.update(&req.Sender)
+	select {
+	case kc.kademlia.keyChan <- set:
+	case <-kc.kademlia.done:
+		return ErrClosed
+	}
+	<-set.resultChan
+	res.Version = set.Version
+	kc.kademlia.sign(res)
 	return nil
 }
 
@@ -72,22 +139,55 @@ type FindNodeRequest struct {
 	Sender Contact
 	MsgID  ID
 	NodeID ID
+	Sig    Signature
 }
 
 type FindNodeResult struct {
-	MsgID ID
-	Nodes []Contact
-	Err   error
+	MsgID    ID
+	Nodes    []Contact
+	Err      error
+	Observed net.TCPAddr
+	Sig      Signature
 }
 
-func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) error {
-	contacts := kc.kademlia.Routes.FindClosest(req.NodeID, K)
+func (m *FindNodeRequest) signature() *Signature { return &m.Sig }
+func (m *FindNodeRequest) messageID() ID         { return m.MsgID }
+func (m *FindNodeResult) signature() *Signature  { return &m.Sig }
+func (m *FindNodeResult) messageID() ID          { return m.MsgID }
+
+func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) (err error) {
+	release, err := kc.admit("FindNode")
+	if err != nil {
+		return err
+	}
+	defer release(&err)
+	if err := kc.verify(&req.Sender, &req); err != nil {
+		return err
+	}
+	contacts := kc.kademlia.Routes.FindClosest(req.NodeID, K+1)
 	res.MsgID = CopyID(req.MsgID)
-	res.Nodes = make([]Contact, len(contacts))
-	copy(res.Nodes, contacts)
+	res.Observed = kc.observed()
+	res.Nodes = withoutContact(contacts, req.Sender.NodeID, K)
+	kc.kademlia.update(&req.Sender)
+	kc.kademlia.sign(res)
 	return nil
 }
 
+// The first count contacts other than id. The requester of a lookup has no use
+// for its own contact, and whether it is in our table yet depends on timing.
+func withoutContact(contacts []Contact, id ID, count int) []Contact {
+	ret := make([]Contact, 0, count)
+	for _, c := range contacts {
+		if len(ret) == count {
+			break
+		}
+		if !c.NodeID.Equals(id) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // FIND_VALUE
 ///////////////////////////////////////////////////////////////////////////////
@@ -95,30 +195,117 @@ type FindValueRequest struct {
 	Sender Contact
 	MsgID  ID
 	Key    ID
+	Sig    Signature
 }
 
 // If Value is nil, it should be ignored, and Nodes means the same as in a
 // FindNodeResult.
 type FindValueResult struct {
-	MsgID ID
-	Value []byte
-	Nodes []Contact
-	Err   error
+	MsgID    ID
+	Value    []byte
+	Version  Version
+	Nodes    []Contact
+	Err      error
+	Observed net.TCPAddr
+	Sig      Signature
 }
 
-func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) error {
+func (m *FindValueRequest) signature() *Signature { return &m.Sig }
+func (m *FindValueRequest) messageID() ID         { return m.MsgID }
+func (m *FindValueResult) signature() *Signature  { return &m.Sig }
+func (m *FindValueResult) messageID() ID          { return m.MsgID }
+
+func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) (err error) {
+	release, err := kc.admit("FindValue")
+	if err != nil {
+		return err
+	}
+	defer release(&err)
+	if err := kc.verify(&req.Sender, &req); err != nil {
+		return err
+	}
 	res.MsgID = CopyID(req.MsgID)
+	res.Observed = kc.observed()
 	keys, found := kc.kademlia.LocalFindValueHelper(req.Key)
 	res.Value = make([]byte, len(keys.Value))
 	if found == 1 {
 		copy(res.Value, keys.Value)
+		res.Version = keys.Version
+		kc.kademlia.update(&req.Sender)
+		kc.kademlia.sign(res)
 		return nil
 	}
 
 	res.Value = nil
 
-	res.Nodes = kc.kademlia.Routes.FindClosest(req.Key, K)
+	res.Nodes = withoutContact(kc.kademlia.Routes.FindClosest(req.Key, K+1), req.Sender.NodeID, K)
+	kc.kademlia.update(&req.Sender)
 
+	kc.kademlia.sign(res)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// COMPARE_AND_SWAP
+///////////////////////////////////////////////////////////////////////////////
+
+// A Store that only takes effect if the node holds what Expected says, and if
+// Version is newer than the version it holds.
+type CompareAndSwapRequest struct {
+	Sender   Contact
+	MsgID    ID
+	Key      ID
+	Value    []byte
+	Version  Version
+	Expected Expectation
+	// If positive, how long the node keeps the value; if negative, the node
+	// stores it already expired, which removes the value but keeps its
+	// version.
+	TTL time.Duration
+	Sig Signature
+}
+
+type CompareAndSwapResult struct {
+	MsgID ID
+	Err   error
+	// Whether the node stored the value.
+	Swapped bool
+	// The version the node holds after the call, the zero Version if it has
+	// no value.
+	Current  Version
+	Observed net.TCPAddr
+	Sig      Signature
+}
+
+func (m *CompareAndSwapRequest) signature() *Signature { return &m.Sig }
+func (m *CompareAndSwapRequest) messageID() ID         { return m.MsgID }
+func (m *CompareAndSwapResult) signature() *Signature  { return &m.Sig }
+func (m *CompareAndSwapResult) messageID() ID          { return m.MsgID }
+
+func (kc *KademliaCore) CompareAndSwap(req CompareAndSwapRequest, res *CompareAndSwapResult) (err error) {
+	release, err := kc.admit("CompareAndSwap")
+	if err != nil {
+		return err
+	}
+	defer release(&err)
+	if err := kc.verify(&req.Sender, &req); err != nil {
+		return err
+	}
+	if kc.kademlia.clock.ahead(req.Version.Timestamp) {
+		return ErrFutureVersion
+	}
+	set := &swapSet{KeySet{req.Key, req.Value, req.Version, make(chan int)}, req.Expected, req.TTL}
+	res.MsgID = CopyID(req.MsgID)
+	res.Observed = kc.observed()
+	kc.kademlia.update(&req.Sender)
+	select {
+	case kc.kademlia.swapChan <- set:
+	case <-kc.kademlia.done:
+		return ErrClosed
+	}
+	res.Swapped = <-set.resultChan == 1
+	res.Current = set.Version
+	kc.kademlia.sign(res)
 	return nil
 }
 
@@ -130,25 +317,43 @@ type GetVDORequest struct {
 	Sender Contact
 	MsgID  ID
 	VdoID  ID
+	Sig    Signature
 }
 type GetVDOResult struct {
-	MsgID ID
-	VDO   VanashingDataObject
+	MsgID    ID
+	VDO      VanashingDataObject
+	Observed net.TCPAddr
+	Sig      Signature
 }
 
-func (kc *KademliaCore) GetVDO(req GetVDORequest, res *GetVDOResult) error {
+func (m *GetVDORequest) signature() *Signature { return &m.Sig }
+func (m *GetVDORequest) messageID() ID         { return m.MsgID }
+func (m *GetVDOResult) signature() *Signature  { return &m.Sig }
+func (m *GetVDOResult) messageID() ID          { return m.MsgID }
+
+func (kc *KademliaCore) GetVDO(req GetVDORequest, res *GetVDOResult) (err error) {
+	release, err := kc.admit("GetVDO")
+	if err != nil {
+		return err
+	}
+	defer release(&err)
+	if err := kc.verify(&req.Sender, &req); err != nil {
+		return err
+	}
 	// fill in
 	// kc.kademlia.Routes.Update(&req.Sender)
 	// avoid data race
-	kc.kademlia.contactChan <- &req.Sender
+	kc.kademlia.update(&req.Sender)
 
 	kc.kademlia.VDOmap.RLock()
 	output, _ := kc.kademlia.VDOmap.m[req.VdoID]
 	kc.kademlia.VDOmap.RUnlock()
 
 	res.MsgID = CopyID(req.MsgID)
+	res.Observed = kc.observed()
 	res.VDO = output
 
+	kc.kademlia.sign(res)
 	return nil
 
 }
@@ -0,0 +1,120 @@
+package kademlia
+
+// Contains Snapshot, a copy of what a node knows about itself and its
+// neighbourhood, for the shell's routing_table, stats and neighbors commands
+// and for debugging.
+
+import (
+	"time"
+)
+
+// A node's state at one moment.
+type Snapshot struct {
+	Self    Contact
+	Started time.Time
+	Taken   time.Time
+	// The non-empty buckets, by increasing shared prefix length.
+	Buckets []BucketSnapshot
+	// The K contacts closest to the node, closest first.
+	Neighbors []Contact
+	// RPCs served and made, by method.
+	RPCsIn, RPCsOut map[string]RPCStats
+	StoredKeys      int
+	StoredBytes     int
+	VDOs            int
+	Lookups         uint64
+	FailedLookups   uint64
+	Diversity       DiversityStats
+	Limiter         LimiterStats
+}
+
+type BucketSnapshot struct {
+	PrefixLength int
+	Contacts     []ContactSnapshot
+}
+
+// A routing table contact and its liveness record.
+type ContactSnapshot struct {
+	Contact
+	Liveness Liveness
+}
+
+type RPCStats struct {
+	Total, Errors uint64
+}
+
+// How long the node had been running when the snapshot was taken.
+func (s *Snapshot) Uptime() time.Duration {
+	return s.Taken.Sub(s.Started)
+}
+
+// The contacts in the routing table.
+func (s *Snapshot) Contacts() int {
+	n := 0
+	for _, bucket := range s.Buckets {
+		n += len(bucket.Contacts)
+	}
+	return n
+}
+
+// The fraction of lookups that succeeded, or 1 if there were none.
+func (s *Snapshot) LookupSuccessRate() float64 {
+	if s.Lookups == 0 {
+		return 1
+	}
+	return float64(s.Lookups-s.FailedLookups) / float64(s.Lookups)
+}
+
+// Take a snapshot of the node.
+func (k *Kademlia) Snapshot() *Snapshot {
+	s := &Snapshot{Self: k.Routes.Self(), Started: k.started, Taken: k.conf.Now()}
+
+	k.Routes.RLock()
+	for i, bucket := range k.Routes.buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		b := BucketSnapshot{PrefixLength: i, Contacts: make([]ContactSnapshot, 0, len(bucket))}
+		for _, c := range bucket {
+			cs := ContactSnapshot{Contact: c}
+			if l := k.Routes.liveness[c.NodeID]; l != nil {
+				cs.Liveness = *l
+			}
+			b.Contacts = append(b.Contacts, cs)
+		}
+		s.Buckets = append(s.Buckets, b)
+	}
+	k.Routes.RUnlock()
+	s.Diversity = k.Routes.DiversityStats()
+	s.Limiter = k.LimiterStats()
+
+	s.Neighbors = make([]Contact, 0, K)
+	for _, c := range k.Routes.FindClosest(k.NodeID, K+1) {
+		if c.NodeID != k.NodeID && len(s.Neighbors) < K {
+			s.Neighbors = append(s.Neighbors, c)
+		}
+	}
+
+	m := k.metrics
+	m.Lock()
+	s.RPCsIn = rpcStats(m.rpcIn)
+	s.RPCsOut = rpcStats(m.rpcOut)
+	s.StoredKeys = m.storedKeys
+	s.StoredBytes = m.storedBytes
+	s.Lookups = m.lookups[true] + m.lookups[false]
+	s.FailedLookups = m.lookups[false]
+	m.Unlock()
+
+	k.VDOmap.RLock()
+	s.VDOs = len(k.VDOmap.m)
+	k.VDOmap.RUnlock()
+	return s
+}
+
+func rpcStats(rpcs map[string]*rpcMetrics) map[string]RPCStats {
+	ret := make(map[string]RPCStats, len(rpcs))
+	for method, r := range rpcs {
+		ret[method] = RPCStats{r.total, r.errors}
+	}
+	return ret
+}
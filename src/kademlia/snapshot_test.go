@@ -0,0 +1,65 @@
+package kademlia
+
+import (
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	instanceList := newMemoryNodes(t, 30)
+	k := instanceList[0]
+	c := instanceList[1].Routes.Self()
+	k.DoStore(&c, NewRandomID(), []byte("value"))
+	instanceList[1].DoStore(&k.Routes.SelfContact, NewRandomID(), []byte("abc"))
+	k.IterativeFindNode(NewRandomID(), true)
+	// Updates go through the handler goroutine; once a read through it
+	// returns, the lookup's updates are in the table.
+	k.ReadFromBuckets(0)
+
+	s := k.Snapshot()
+	if s.Self.NodeID != k.NodeID || s.Uptime() <= 0 {
+		t.Errorf("self %v, uptime %v", s.Self.NodeID.AsString(), s.Uptime())
+	}
+	contacts := 0
+	for i := 0; i < IDBits; i++ {
+		contacts += len(k.ReadFromBuckets(i))
+	}
+	if s.Contacts() != contacts {
+		t.Errorf("%d contacts, want %d", s.Contacts(), contacts)
+	}
+	for i, bucket := range s.Buckets {
+		if i > 0 && bucket.PrefixLength <= s.Buckets[i-1].PrefixLength {
+			t.Errorf("bucket %d after %d", bucket.PrefixLength, s.Buckets[i-1].PrefixLength)
+		}
+		for _, c := range bucket.Contacts {
+			if c.NodeID.Xor(k.NodeID).PrefixLen() != bucket.PrefixLength {
+				t.Errorf("%v in bucket %d", c.NodeID.AsString(), bucket.PrefixLength)
+			}
+			if c.Liveness.LastSeen.IsZero() {
+				t.Errorf("%v never seen", c.NodeID.AsString())
+			}
+		}
+	}
+
+	if len(s.Neighbors) != K {
+		t.Errorf("%d neighbors, want %d", len(s.Neighbors), K)
+	}
+	for i, c := range s.Neighbors {
+		if c.NodeID == k.NodeID {
+			t.Error("self among the neighbors")
+		}
+		if i > 0 && c.NodeID.Xor(k.NodeID).Less(s.Neighbors[i-1].NodeID.Xor(k.NodeID)) {
+			t.Error("neighbors out of order")
+		}
+	}
+
+	if s.RPCsOut["Store"].Total != 1 || s.RPCsIn["Store"].Total != 1 || s.RPCsIn["Store"].Errors != 0 {
+		t.Errorf("Store RPCs: out %+v, in %+v", s.RPCsOut["Store"], s.RPCsIn["Store"])
+	}
+	if s.StoredKeys != 1 || s.StoredBytes != 3 {
+		t.Errorf("stored %d keys, %d bytes", s.StoredKeys, s.StoredBytes)
+	}
+	// The node looked itself up, then failed to find a value.
+	if s.Lookups != 2 || s.FailedLookups != 1 || s.LookupSuccessRate() != 0.5 {
+		t.Errorf("%d lookups, %d failed", s.Lookups, s.FailedLookups)
+	}
+}
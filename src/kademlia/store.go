@@ -0,0 +1,111 @@
+package kademlia
+
+// Contains replicated writes: IterativeStore stores a value at the K nodes
+// closest to its key, waits for their answers and reports which of them took
+// it. A node that fails is replaced by the next closest candidate the lookup
+// found, so that a few dead nodes do not cost replicas.
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrWriteQuorum = errors.New("write quorum not reached")
+
+// A replica that could not be written.
+type ReplicaError struct {
+	Contact Contact
+	Err     error
+}
+
+// The outcome of a replicated write.
+type WriteResult struct {
+	Key ID
+	// The version the value was written with.
+	Version Version
+	// How many replicas had to acknowledge the write.
+	Quorum int
+	// The nodes that stored the value, closest first.
+	Stored []Contact
+	// The nodes that failed, in the order they were tried.
+	Failed []ReplicaError
+}
+
+// Whether enough replicas acknowledged the write.
+func (ret *WriteResult) OK() bool {
+	return len(ret.Stored) >= ret.Quorum
+}
+
+// Store value at the K nodes closest to key, under a new version, and wait for
+// them to answer. A node that has a newer version keeps it but still counts as
+// storing the write, which it orders before its own. The write succeeds if at
+// least quorum of them acknowledge it; a quorum of 0 or less counts as 1.
+// Returns ErrWriteQuorum, along with the result, otherwise.
+func (k *Kademlia) IterativeStore(key ID, value []byte, quorum int) (*WriteResult, error) {
+	if quorum <= 0 {
+		quorum = 1
+	}
+	ret := &WriteResult{Key: key, Version: k.NewVersion(), Quorum: quorum}
+	ret.Stored, ret.Failed = k.replicate(k.IterativeFindNode(key, false), func(c Contact) error {
+		req := &StoreRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: value, Version: ret.Version}
+		return k.call(&c, "Store", req, new(StoreResult))
+	})
+	sortByDistance(ret.Stored, key)
+	if !ret.OK() {
+		return ret, ErrWriteQuorum
+	}
+	return ret, nil
+}
+
+// Call send at the K closest nodes a lookup found, all at once, and return the
+// nodes for which it succeeded and the failures. Each node that fails is
+// replaced by the next closest candidate.
+func (k *Kademlia) replicate(found *IterativeResult, send func(c Contact) error) ([]Contact, []ReplicaError) {
+	var done []Contact
+	var failed []ReplicaError
+	spare := found.spare
+	batch := found.contacts
+	for len(batch) > 0 {
+		ok, failures := sendAll(batch, send)
+		done, failed = append(done, ok...), append(failed, failures...)
+		// Try the next closest candidates in place of the failed nodes.
+		n := len(failures)
+		if n > len(spare) {
+			n = len(spare)
+		}
+		batch, spare = spare[:n], spare[n:]
+	}
+	return done, failed
+}
+
+// Call send at each of contacts, all at once, and return the nodes for which
+// it succeeded and the failures.
+func sendAll(contacts []Contact, send func(c Contact) error) ([]Contact, []ReplicaError) {
+	type reply struct {
+		contact Contact
+		err     error
+	}
+	var done []Contact
+	var failed []ReplicaError
+	replies := make(chan reply, len(contacts))
+	for _, c := range contacts {
+		go func(c Contact) {
+			replies <- reply{c, send(c)}
+		}(c)
+	}
+	for range contacts {
+		r := <-replies
+		if r.err != nil {
+			failed = append(failed, ReplicaError{r.contact, r.err})
+		} else {
+			done = append(done, r.contact)
+		}
+	}
+	return done, failed
+}
+
+func sortByDistance(contacts []Contact, key ID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].NodeID.Xor(key).Less(contacts[j].NodeID.Xor(key))
+	})
+}
@@ -0,0 +1,79 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Make Store calls to the nodes at the given addresses, or to all if addrs is
+// nil, fail.
+func dropStores(network *MemoryNetwork, addrs map[string]bool) {
+	dropCalls(network, "Store", addrs)
+}
+
+// Make calls of method, or of any method if it is "", to the nodes at the given
+// addresses, or to all if addrs is nil, fail.
+func dropCalls(network *MemoryNetwork, name string, addrs map[string]bool) {
+	network.Lock()
+	defer network.Unlock()
+	network.Link = func(from, to net.Addr, method string) (time.Duration, error) {
+		if (name == "" || method == name) && (addrs == nil || addrs[to.String()]) {
+			return 0, errors.New("dropped")
+		}
+		return time.Millisecond, nil
+	}
+}
+
+func TestIterativeStore(t *testing.T) {
+	instanceList := newMemoryNodes(t, 40)
+	k := instanceList[0]
+	network := k.transport.(*MemoryTransport).network
+	key := NewRandomID()
+	closest := k.IterativeFindNode(key, false).Contacts()
+	if len(closest) != K {
+		t.Fatalf("found %d nodes", len(closest))
+	}
+
+	// The three closest nodes fail; the next closest stand in for them.
+	bad := make(map[string]bool)
+	for _, c := range closest[:3] {
+		bad[Dest(c.Host, c.Port)] = true
+	}
+	dropStores(network, bad)
+	res, err := k.IterativeStore(key, []byte("value"), K)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Stored) != K || len(res.Failed) != 3 || !res.OK() {
+		t.Fatalf("stored at %d, %d failed", len(res.Stored), len(res.Failed))
+	}
+	for i, c := range res.Stored {
+		if bad[Dest(c.Host, c.Port)] {
+			t.Errorf("stored at failed node %v", c.NodeID.AsString())
+		}
+		if i > 0 && c.NodeID.Xor(key).Less(res.Stored[i-1].NodeID.Xor(key)) {
+			t.Error("stored nodes out of order")
+		}
+	}
+	for _, f := range res.Failed {
+		if !bad[Dest(f.Contact.Host, f.Contact.Port)] || f.Err == nil {
+			t.Errorf("unexpected failure at %v: %v", f.Contact.NodeID.AsString(), f.Err)
+		}
+	}
+	for _, node := range instanceList {
+		if node.NodeID == res.Stored[K-1].NodeID {
+			if _, found := node.LocalFindValueHelper(key); found != 1 {
+				t.Error("value missing at a node that acknowledged it")
+			}
+		}
+	}
+
+	// Without any node storing it, the quorum of 1 fails.
+	dropStores(network, nil)
+	res, err = k.IterativeStore(NewRandomID(), []byte("value"), 0)
+	if err != ErrWriteQuorum || res.Quorum != 1 || len(res.Stored) != 0 || res.OK() {
+		t.Errorf("got %v, stored at %d", err, len(res.Stored))
+	}
+}
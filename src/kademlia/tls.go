@@ -0,0 +1,86 @@
+package kademlia
+
+// Contains the encrypted transport. Each node presents a self-signed
+// certificate for its ed25519 identity key, so the certificate of a peer is
+// pinned by its node ID: the SHA-1 hash of the certificate's public key must
+// equal the ID we expect to be talking to.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"time"
+)
+
+var ErrPeerMismatch = errors.New("peer certificate does not match node ID")
+
+func selfSignedCertificate(ident *Identity) (tls.Certificate, error) {
+	id := ident.NodeID()
+	tmpl := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(id[:]),
+		Subject:      pkix.Name{CommonName: id.AsString()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, ident.PublicKey, ident.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: ident.PrivateKey}, nil
+}
+
+// The node ID a peer's certificate is pinned to. The TLS handshake has already
+// proven that the peer holds the matching private key.
+func peerIDFromCerts(rawCerts [][]byte) (ID, error) {
+	if len(rawCerts) == 0 {
+		return ID{}, ErrPeerMismatch
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return ID{}, err
+	}
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return ID{}, ErrPeerMismatch
+	}
+	return IDFromPublicKey(pub), nil
+}
+
+func serverTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := peerIDFromCerts(rawCerts)
+			return err
+		},
+	}
+}
+
+// The client configuration for dialing expected. If expected is the zero ID,
+// any peer with a well-formed certificate is accepted.
+func clientTLSConfig(cert tls.Certificate, expected ID) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		// The chain is checked by VerifyPeerCertificate instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			id, err := peerIDFromCerts(rawCerts)
+			if err != nil {
+				return err
+			}
+			if expected != (ID{}) && id != expected {
+				return ErrPeerMismatch
+			}
+			return nil
+		},
+	}
+}
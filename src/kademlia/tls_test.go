@@ -0,0 +1,40 @@
+package kademlia
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTLSPing(t *testing.T) {
+	instance1 := NewKademlia("localhost:13000")
+	instance2 := NewKademlia("localhost:13001")
+	host2, port2, _ := StringToIpPort("localhost:13001")
+	if resp := instance1.DoPing(host2, port2); !strings.HasPrefix(resp, "OK") {
+		t.Fatal("ping over TLS failed: ", resp)
+	}
+	if _, err := instance1.FindContact(instance2.NodeID); err != nil {
+		t.Error("Instance 2's contact not found in Instance 1's contact list")
+	}
+}
+
+func TestTLSPeerMismatch(t *testing.T) {
+	instance1 := NewKademlia("localhost:13002")
+	NewKademlia("localhost:13003")
+	host2, port2, _ := StringToIpPort("localhost:13003")
+
+	// A contact that claims another node ID for instance 2's address.
+	impostor := &Contact{NodeID: NewRandomID(), Host: host2, Port: port2}
+	resp := instance1.DoStore(impostor, NewRandomID(), []byte("secret"))
+	if !strings.HasPrefix(resp, "ERR") {
+		t.Error("store to mismatched peer succeeded: ", resp)
+	}
+}
+
+func TestInsecureAgainstTLS(t *testing.T) {
+	instance1 := NewKademliaWithConfig("localhost:13004", Config{Insecure: true})
+	NewKademlia("localhost:13005")
+	host2, port2, _ := StringToIpPort("localhost:13005")
+	if resp := instance1.DoPing(host2, port2); !strings.HasPrefix(resp, "ERR") {
+		t.Error("plain HTTP ping to TLS node succeeded: ", resp)
+	}
+}
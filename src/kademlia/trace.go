@@ -0,0 +1,116 @@
+package kademlia
+
+// Contains lookup tracing: a record of every query a lookup made, who named
+// each queried node and how long it took, for finding out why a lookup
+// failed.
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// A lookup, query by query.
+type LookupTrace struct {
+	Target     ID
+	FindValue  bool
+	Start, End time.Time
+	// In the order the lookup merged them: by round, then by query order.
+	Queries []TraceQuery
+	// The contacts the lookup returned.
+	Shortlist []Contact
+	// The value found, or nil.
+	Value []byte
+}
+
+// One query of a lookup.
+type TraceQuery struct {
+	Contact Contact
+	// Round counts from 0.
+	Round int
+	// The node whose reply named Contact, or the zero ID if it came from the
+	// routing table.
+	Parent     ID
+	Start, End time.Time
+	// The contacts the node returned.
+	Contacts   []Contact
+	FoundValue bool
+	Err        error
+}
+
+// Like IterativeFindNode, but also returns a trace of the lookup.
+func (k *Kademlia) TraceLookup(target ID, findvalue bool) (*IterativeResult, *LookupTrace) {
+	trace := new(LookupTrace)
+	return k.lookup(target, findvalue, trace), trace
+}
+
+func (trace *LookupTrace) addQuery(round int, parent ID, res queryResult) {
+	trace.Queries = append(trace.Queries, TraceQuery{
+		Contact:    res.contact,
+		Round:      round,
+		Parent:     parent,
+		Start:      res.start,
+		End:        res.end,
+		Contacts:   res.nodes,
+		FoundValue: res.value != nil,
+		Err:        res.err,
+	})
+}
+
+func (trace *LookupTrace) finish(target ID, findvalue bool, start time.Time, ret *IterativeResult) {
+	trace.Target = target
+	trace.FindValue = findvalue
+	trace.Start = start
+	trace.End = time.Now()
+	trace.Shortlist = ret.contacts
+	trace.Value = ret.value
+}
+
+// Print the queries as a tree, each under the node that named it, with the
+// times they started and took relative to the start of the lookup.
+func (trace *LookupTrace) WriteTree(w io.Writer) {
+	kind := "find_node"
+	if trace.FindValue {
+		kind = "find_value"
+	}
+	rounds := 0
+	if n := len(trace.Queries); n > 0 {
+		rounds = trace.Queries[n-1].Round + 1
+	}
+	fmt.Fprintf(w, "%s %s: %d queries in %d rounds, %v\n", kind, trace.Target.AsString(),
+		len(trace.Queries), rounds, trace.End.Sub(trace.Start).Round(time.Microsecond))
+
+	children := make(map[ID][]int)
+	for i, q := range trace.Queries {
+		children[q.Parent] = append(children[q.Parent], i)
+	}
+	var walk func(parent ID, depth int)
+	walk = func(parent ID, depth int) {
+		for _, i := range children[parent] {
+			q := trace.Queries[i]
+			fmt.Fprintf(w, "%*s%s %s round %d +%v %v: ", 2*depth+2, "", q.Contact.NodeID.AsString(),
+				Dest(q.Contact.Host, q.Contact.Port), q.Round,
+				q.Start.Sub(trace.Start).Round(time.Microsecond), q.End.Sub(q.Start).Round(time.Microsecond))
+			switch {
+			case q.Err != nil:
+				fmt.Fprintf(w, "ERR: %v\n", q.Err)
+			case q.FoundValue:
+				fmt.Fprint(w, "value\n")
+			default:
+				fmt.Fprintf(w, "%d contacts\n", len(q.Contacts))
+			}
+			walk(q.Contact.NodeID, depth+1)
+		}
+	}
+	walk(ID{}, 0)
+
+	if trace.Value != nil {
+		fmt.Fprintf(w, "value found, %d bytes\n", len(trace.Value))
+	} else if trace.FindValue {
+		fmt.Fprint(w, "value not found\n")
+	}
+	fmt.Fprintf(w, "closest %d:\n", len(trace.Shortlist))
+	for _, c := range trace.Shortlist {
+		fmt.Fprintf(w, "  %s %s\n", c.NodeID.AsString(), Dest(c.Host, c.Port))
+	}
+}
@@ -0,0 +1,69 @@
+package kademlia
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTraceLookup(t *testing.T) {
+	network := NewMemoryNetwork()
+	nodes := make([]*Kademlia, 30)
+	for i := range nodes {
+		nodes[i] = NewKademliaWithConfig("127.0.0.1:"+strconv.Itoa(i+1), Config{Transport: network.Transport()})
+		if i > 0 {
+			if err := nodes[i].Bootstrap([]string{"127.0.0.1:1"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	key := NewRandomID()
+	nodes[5].DoIterativeStore(key, []byte("value"))
+	src := nodes[len(nodes)-1]
+	dead := src.Routes.FindClosest(key, 1)[0]
+	for _, k := range nodes {
+		if k.NodeID == dead.NodeID {
+			k.Close()
+		}
+	}
+
+	res, trace := src.TraceLookup(key, false)
+	if trace.Target != key || len(trace.Shortlist) != len(res.Contacts()) {
+		t.Fatal("trace does not match the result")
+	}
+	queried := 0
+	for _, round := range res.Rounds() {
+		queried += len(round)
+	}
+	if len(trace.Queries) != queried {
+		t.Fatalf("%d queries traced, %d made", len(trace.Queries), queried)
+	}
+	seen := map[ID]bool{{}: true}
+	failed := false
+	for _, q := range trace.Queries {
+		if !seen[q.Parent] {
+			t.Errorf("query to %s named by unqueried %s", q.Contact.NodeID.AsString(), q.Parent.AsString())
+		}
+		if q.End.Before(q.Start) || q.Start.Before(trace.Start) {
+			t.Error("query times out of order")
+		}
+		seen[q.Contact.NodeID] = true
+		if q.Contact.NodeID == dead.NodeID {
+			failed = q.Err != nil
+		}
+	}
+	if !failed {
+		t.Error("failed query to a closed node not traced")
+	}
+
+	_, trace = src.TraceLookup(key, true)
+	if string(trace.Value) != "value" {
+		t.Fatal("value not found")
+	}
+	var buf bytes.Buffer
+	trace.WriteTree(&buf)
+	if !strings.HasPrefix(buf.String(), "find_value "+key.AsString()) || !strings.Contains(buf.String(), ": value\n") {
+		t.Errorf("tree:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,195 @@
+package kademlia
+
+// Contains the Transport abstraction over which nodes exchange the
+// KademliaCore RPCs, and its default implementation: net/rpc with gob encoding
+// over HTTP, normally wrapped in TLS. Peers reach nothing else on it; the JSON
+// API has a listener of its own.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"time"
+)
+
+// Transport moves RPCs between nodes. Methods are named after the
+// KademliaCore methods: "Ping", "Store", "FindNode", "FindValue",
+// "CompareAndSwap" and "GetVDO".
+type Transport interface {
+	// Serve starts delivering RPCs arriving at laddr to k, and returns the
+	// addresses it listens on, all with the same port. A host name may stand
+	// for several addresses, and an unspecified address for all of them.
+	Serve(laddr string, k *Kademlia) ([]net.Addr, error)
+	// Call invokes method on the node at c. If c.NodeID is not the zero ID,
+	// the transport may refuse to talk to a node with any other ID.
+	Call(c *Contact, method string, args, reply interface{}) error
+	// Close stops serving.
+	Close() error
+}
+
+// Transports that know the round trip time of a call better than the wall
+// clock does, such as a simulated network, implement timedTransport.
+type timedTransport interface {
+	timedCall(c *Contact, method string, args, reply interface{}) (time.Duration, error)
+}
+
+// Status line sent in reply to an RPC CONNECT, the same one net/rpc uses.
+const rpcConnected = "200 Connected to Go RPC"
+
+const (
+	// How long to wait for a connection to a peer.
+	DialTimeout = 5 * time.Second
+	// How long a call, from dialing to the reply, may take by default.
+	CallTimeout = 10 * time.Second
+)
+
+var ErrCallTimeout = errors.New("call timed out")
+
+// HTTPTransport speaks net/rpc over HTTP CONNECT. Unless Insecure is set,
+// connections use TLS with certificates pinned to node IDs. Calls give up
+// after Timeout, or CallTimeout if it is zero.
+type HTTPTransport struct {
+	Insecure  bool
+	Timeout   time.Duration
+	cert      tls.Certificate
+	listeners []net.Listener
+	mux       *http.ServeMux
+}
+
+func (t *HTTPTransport) Serve(laddr string, k *Kademlia) ([]net.Addr, error) {
+	if !t.Insecure {
+		cert, err := selfSignedCertificate(k.identity)
+		if err != nil {
+			return nil, err
+		}
+		t.cert = cert
+	}
+	hosts, port, err := listenHosts(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mux = http.NewServeMux()
+	addrs := make([]net.Addr, 0, len(hosts))
+	for _, host := range hosts {
+		// The first listener picks the port if laddr leaves it to the system.
+		l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+		if err != nil && len(addrs) > 0 {
+			// A name may resolve to a family the machine does not have.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		addr := l.Addr().(*net.TCPAddr)
+		if len(addrs) == 0 {
+			port = strconv.Itoa(addr.Port)
+			t.mux.Handle(rpcPath(uint16(addr.Port)), &rpcHandler{k})
+		}
+		addrs = append(addrs, addr)
+		if !t.Insecure {
+			l = tls.NewListener(l, serverTLSConfig(t.cert))
+		}
+		t.listeners = append(t.listeners, l)
+		// Run RPC server forever.
+		go http.Serve(l, t.mux)
+	}
+	return addrs, nil
+}
+
+func (t *HTTPTransport) Call(c *Contact, method string, args, reply interface{}) error {
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = CallTimeout
+	}
+	client, err := t.dial(c, time.Now().Add(timeout))
+	if err == nil {
+		defer client.Close()
+		err = client.Call("KademliaCore."+method, args, reply)
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return ErrCallTimeout
+	}
+	return err
+}
+
+func (t *HTTPTransport) Close() error {
+	var err error
+	for _, l := range t.listeners {
+		if e := l.Close(); e != nil {
+			err = e
+		}
+	}
+	t.listeners = nil
+	return err
+}
+
+// Dial the RPC endpoint of c, for a connection that ends at deadline.
+func (t *HTTPTransport) dial(c *Contact, deadline time.Time) (*rpc.Client, error) {
+	dialer := &net.Dialer{Timeout: DialTimeout, Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if t.Insecure {
+		conn, err = dialer.Dial("tcp", Dest(c.Host, c.Port))
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", Dest(c.Host, c.Port), clientTLSConfig(t.cert, c.NodeID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	io.WriteString(conn, "CONNECT "+rpcPath(c.Port)+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != rpcConnected {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Serves net/rpc over HTTP CONNECT, like rpc.Server.ServeHTTP, but registers
+// a fresh KademliaCore for each connection so that the handlers know which
+// peer they are talking to.
+type rpcHandler struct {
+	kademlia *Kademlia
+}
+
+func (h *rpcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	core := &KademliaCore{kademlia: h.kademlia}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		core.remote = addr
+	}
+	if req.TLS != nil {
+		raw := make([][]byte, 0, len(req.TLS.PeerCertificates))
+		for _, cert := range req.TLS.PeerCertificates {
+			raw = append(raw, cert.Raw)
+		}
+		id, err := peerIDFromCerts(raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		core.peer = &id
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+rpcConnected+"\n\n")
+	server := rpc.NewServer()
+	server.Register(core)
+	server.ServeConn(conn)
+}
@@ -0,0 +1,44 @@
+package kademlia
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCallTimeout(t *testing.T) {
+	transport := &HTTPTransport{Insecure: true, Timeout: 200 * time.Millisecond}
+	conf := Config{Insecure: true, Transport: transport, ManualMaintenance: true, MaxFailures: 2}
+	k := NewKademliaWithConfig("localhost:13006", conf)
+
+	// A peer that accepts connections and never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:13007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host, port, _ := StringToIpPort("127.0.0.1:13007")
+	c := Contact{NodeID: NewRandomID(), Host: host, Port: port}
+	k.Routes.Update(&c)
+	start := time.Now()
+	ping := &PingMessage{Sender: k.Routes.Self(), MsgID: NewRandomID()}
+	if err := k.call(&c, "Ping", ping, new(PongMessage)); err != ErrCallTimeout {
+		t.Fatal("call to a silent peer: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Error("call took ", elapsed)
+	}
+	if l, ok := k.Routes.Liveness(c.NodeID); !ok || l.Failures != 1 {
+		t.Errorf("liveness after a timeout: %+v", l)
+	}
+}
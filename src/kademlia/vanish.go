@@ -141,6 +141,8 @@ func Refresh(kadem *Kademlia, vdoid ID, timeout int) {
 		map_value := make(map[byte][]byte)
 		if len(keysLocation) < int(temp_vdo.Threshold) {
 			fmt.Println("ERR: Could not obtain a sufficient number of shared keys")
+			kadem.metrics.refreshed(false)
+			kadem.VDOmap.Unlock()
 			return
 		}
 
@@ -166,6 +168,8 @@ func Refresh(kadem *Kademlia, vdoid ID, timeout int) {
 
 		if number_valid_location < int(temp_vdo.Threshold) {
 			fmt.Println("ERR: Could not obtain a sufficient number of valid nodes")
+			kadem.metrics.refreshed(false)
+			kadem.VDOmap.Unlock()
 			return
 		}
 
@@ -177,6 +181,8 @@ func Refresh(kadem *Kademlia, vdoid ID, timeout int) {
 
 		map_K, err := sss.Split(temp_vdo.NumberKeys, temp_vdo.Threshold, real_key)
 		if err != nil {
+			kadem.metrics.refreshed(false)
+			kadem.VDOmap.Unlock()
 			return
 		} else {
 
@@ -201,6 +207,7 @@ func Refresh(kadem *Kademlia, vdoid ID, timeout int) {
 			}
 		}
 		kadem.VDOmap.m[vdoid] = temp_vdo
+		kadem.metrics.refreshed(true)
 
 		kadem.VDOmap.Unlock()
 	}
@@ -0,0 +1,160 @@
+package kademlia
+
+// Contains value versions. Every stored value carries the time its publisher
+// wrote it, on the publisher's hybrid logical clock, and the publisher's ID. A
+// node keeps the value it has unless a store brings a newer version, so that
+// concurrent writers and delayed replicas settle on the last writer.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadVersion    = errors.New("want a version as timestamp@publisher")
+	ErrFutureVersion = errors.New("version too far in the future")
+)
+
+// How far ahead of a node's clock a version may be by default.
+const DefaultMaxClockSkew = time.Minute
+
+type Version struct {
+	// Nanoseconds since the epoch on the publisher's hybrid logical clock.
+	Timestamp int64
+	// Orders writes made at the same timestamp by different publishers.
+	Publisher ID
+}
+
+// Whether v was written after o. The zero Version, that of values stored by
+// older nodes, is older than any other.
+func (v Version) Newer(o Version) bool {
+	if v.Timestamp != o.Timestamp {
+		return v.Timestamp > o.Timestamp
+	}
+	return o.Publisher.Less(v.Publisher)
+}
+
+func (v Version) IsZero() bool {
+	return v == Version{}
+}
+
+// The wall-clock time of the write.
+func (v Version) Time() time.Time {
+	return time.Unix(0, v.Timestamp)
+}
+
+// The version as timestamp@publisher, which ParseVersion reads back.
+func (v Version) String() string {
+	return fmt.Sprintf("%d@%s", v.Timestamp, v.Publisher.AsString())
+}
+
+func ParseVersion(s string) (Version, error) {
+	var ret Version
+	i := strings.IndexByte(s, '@')
+	if i < 0 {
+		return ret, ErrBadVersion
+	}
+	timestamp, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return ret, ErrBadVersion
+	}
+	publisher, err := ParseID(s[i+1:])
+	if err != nil {
+		return ret, ErrBadVersion
+	}
+	return Version{timestamp, publisher}, nil
+}
+
+// The version for the end of a value line in command output, or "" for the
+// zero version.
+func versionSuffix(v Version) string {
+	if v.IsZero() {
+		return ""
+	}
+	return " (version " + v.String() + ")"
+}
+
+// A new version for a value this node publishes now.
+func (k *Kademlia) NewVersion() Version {
+	return Version{k.clock.Now(), k.NodeID}
+}
+
+// A value as a node stores it.
+type storedValue struct {
+	Value   []byte
+	Version Version
+	// When the value expires, or the zero time if it does not. An expired
+	// value is not found, but its version still orders later writes.
+	Expires time.Time
+}
+
+func (v storedValue) expired(now time.Time) bool {
+	return !v.Expires.IsZero() && !now.Before(v.Expires)
+}
+
+// Drop the values that expired longer ago than twice the maximum clock skew,
+// and return how many. Until then, an expired value's version still turns
+// away writes that were delayed, or stamped by a clock running behind, and
+// expect what it replaced. Runs in handleChan.
+func (k *Kademlia) sweep() int {
+	cutoff := k.conf.Now().Add(-2 * k.conf.MaxClockSkew)
+	swept := 0
+	for key, v := range k.hashtable {
+		if v.expired(cutoff) {
+			delete(k.hashtable, key)
+			k.metrics.removed(v.Value)
+			swept++
+		}
+	}
+	return swept
+}
+
+// A hybrid logical clock: wall-clock nanoseconds that never go backwards and
+// move past every timestamp the node sees, so that a write made after reading
+// a value gets a newer version even if the writer's clock lags the reader's.
+// Timestamps more than maxSkew ahead of the wall clock are not believed: a
+// version stamped at the end of time would win every write and stop the clock.
+type hlc struct {
+	sync.Mutex
+	last    int64
+	now     func() time.Time
+	maxSkew time.Duration
+}
+
+func newHLC(now func() time.Time, maxSkew time.Duration) *hlc {
+	return &hlc{now: now, maxSkew: maxSkew}
+}
+
+// Whether ts is further ahead of the wall clock than clocks may drift apart.
+func (c *hlc) ahead(ts int64) bool {
+	return ts > c.now().Add(c.maxSkew).UnixNano()
+}
+
+// A timestamp later than any the clock returned or observed.
+func (c *hlc) Now() int64 {
+	c.Lock()
+	defer c.Unlock()
+	ts := c.now().UnixNano()
+	if ts <= c.last {
+		ts = c.last + 1
+	}
+	c.last = ts
+	return ts
+}
+
+// Note a timestamp seen on a value, so that later ones are greater, unless it
+// is too far ahead.
+func (c *hlc) Observe(ts int64) {
+	if c.ahead(ts) {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if ts > c.last {
+		c.last = ts
+	}
+}
@@ -0,0 +1,116 @@
+package kademlia
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionOrder(t *testing.T) {
+	a, b := NewRandomID(), NewRandomID()
+	if b.Less(a) {
+		a, b = b, a
+	}
+	older, newer := Version{1, b}, Version{2, a}
+	if !newer.Newer(older) || older.Newer(newer) {
+		t.Error("later timestamp is not newer")
+	}
+	// At the same timestamp, the greater publisher ID wins.
+	if !(Version{1, b}).Newer(Version{1, a}) || (Version{1, a}).Newer(Version{1, a}) {
+		t.Error("tie between publishers")
+	}
+	if !older.Newer(Version{}) || !(Version{}).IsZero() || older.IsZero() {
+		t.Error("zero version")
+	}
+
+	if got, err := ParseVersion(newer.String()); err != nil || got != newer {
+		t.Errorf("round trip of %v: got %v, %v", newer, got, err)
+	}
+	for _, s := range []string{"", "12", "12@abcd", "x@" + a.AsString(), "@" + a.AsString()} {
+		if _, err := ParseVersion(s); err != ErrBadVersion {
+			t.Errorf("%q: got %v", s, err)
+		}
+	}
+}
+
+func TestHLC(t *testing.T) {
+	wall := time.Unix(100, 0)
+	c := newHLC(func() time.Time { return wall }, time.Minute)
+	first := c.Now()
+	// The wall clock stands still, then goes backwards.
+	second := c.Now()
+	wall = wall.Add(-time.Second)
+	third := c.Now()
+	if first != wall.Add(time.Second).UnixNano() || second <= first || third <= second {
+		t.Errorf("got %d, %d, %d", first, second, third)
+	}
+	// A timestamp from a node whose clock runs ahead.
+	ahead := wall.Add(30 * time.Second).UnixNano()
+	c.Observe(ahead)
+	if got := c.Now(); got <= ahead {
+		t.Errorf("got %d after observing %d", got, ahead)
+	}
+	// One further ahead than clocks drift is ignored.
+	c.Observe(math.MaxInt64)
+	if got := c.Now(); got > wall.Add(time.Minute).UnixNano() {
+		t.Errorf("got %d after observing the end of time", got)
+	}
+}
+
+func TestStoreKeepsNewest(t *testing.T) {
+	instanceList := newMemoryNodes(t, 2)
+	k, peer := instanceList[0], instanceList[1].Routes.SelfContact
+	key := NewRandomID()
+	store := func(value string, version Version) Version {
+		req := &StoreRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: []byte(value), Version: version}
+		res := new(StoreResult)
+		if err := k.call(&peer, "Store", req, res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Version
+	}
+	older, newer := k.NewVersion(), k.NewVersion()
+	if got := store("new", newer); got != newer {
+		t.Errorf("store answered %v", got)
+	}
+	// A delayed write arrives after a newer one.
+	if got := store("old", older); got != newer {
+		t.Errorf("stale store answered %v", got)
+	}
+	value, version, _, err := k.FindValue(&peer, key)
+	if err != nil || string(value) != "new" || version != newer {
+		t.Errorf("got %q at %v, %v", value, version, err)
+	}
+	if res := k.IterativeFindNode(key, true); string(res.Value()) != "new" || res.Version() != newer {
+		t.Errorf("lookup got %q at %v", res.Value(), res.Version())
+	}
+}
+
+func TestFutureVersion(t *testing.T) {
+	instanceList := newMemoryNodes(t, 2)
+	k, peer := instanceList[0], instanceList[1]
+	contact := peer.Routes.SelfContact
+	key := NewRandomID()
+	forever := Version{math.MaxInt64, k.NodeID}
+	req := &StoreRequest{Sender: k.Routes.Self(), MsgID: NewRandomID(), Key: key, Value: []byte("forever"), Version: forever}
+	if err := k.call(&contact, "Store", req, new(StoreResult)); err == nil || err.Error() != ErrFutureVersion.Error() {
+		t.Errorf("store got %v", err)
+	}
+	if resp := k.DoStore(&contact, key, []byte("now")); !strings.HasPrefix(resp, "OK") {
+		t.Error(resp)
+	}
+
+	// A replica that holds such a version anyway is not believed.
+	other := NewRandomID()
+	peer.keyChan <- &KeySet{Key: other, Value: []byte("forever"), Version: forever}
+	if _, _, _, err := k.FindValue(&contact, other); err != ErrFutureVersion {
+		t.Errorf("find value got %v", err)
+	}
+	if res := k.IterativeFindNode(other, true); res.Value() != nil {
+		t.Errorf("lookup got %q at %v", res.Value(), res.Version())
+	}
+	if v := k.NewVersion(); v.Time().After(time.Now().Add(time.Minute)) {
+		t.Errorf("clock moved to %v", v)
+	}
+}
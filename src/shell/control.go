@@ -0,0 +1,87 @@
+package shell
+
+// Contains the control socket, through which kademlia-ctl runs shell commands
+// on a running node. Each connection carries JSON objects, one per line: a
+// controlRequest from the client, answered by a controlResponse.
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+import (
+	"kademlia"
+)
+
+type controlRequest struct {
+	Line string `json:"line"`
+	// Whether to answer as in --json mode.
+	JSON bool `json:"json"`
+}
+
+type controlResponse struct {
+	Output string `json:"output"`
+	OK     bool   `json:"ok"`
+}
+
+// Listen on the unix socket at path, replacing a socket left behind by a node
+// that is gone, and serve commands on it.
+func listenControl(path string, k *kademlia.Kademlia) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New(path + ": another node is listening")
+	}
+	os.Remove(path)
+	// Anyone who can connect controls the node, so the socket must not be
+	// open to others even for the moment before the chmod.
+	mask := syscall.Umask(0077)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(conn, k)
+		}
+	}()
+	return l, nil
+}
+
+// Run the commands arriving on conn until the client closes it or quits.
+func serveControl(conn net.Conn, k *kademlia.Kademlia) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req controlRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		line := strings.TrimSpace(req.Line)
+		if line == "" {
+			enc.Encode(controlResponse{OK: true})
+			continue
+		}
+		debugf("control: %s\n", line)
+		resp, ok := runCommand(k, line, req.JSON)
+		if resp == "quit" {
+			return
+		}
+		if err := enc.Encode(controlResponse{resp, ok}); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package shell
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestControlSocket(t *testing.T) {
+	k := newTestNodes(t, 1)[0]
+	path := filepath.Join(t.TempDir(), "control.sock")
+	// A socket file left behind by a node that is gone.
+	if err := ioutil.WriteFile(path, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	mask := syscall.Umask(0022)
+	defer syscall.Umask(mask)
+	l, err := listenControl(path, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if mask := syscall.Umask(0022); mask != 0022 {
+		t.Errorf("umask left at %#o", mask)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, %v", info.Mode(), err)
+	}
+	if _, err := listenControl(path, k); err == nil || !strings.Contains(err.Error(), "another node is listening") {
+		t.Errorf("second listener: got %v", err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	whoami := executeLine(k, "whoami")
+	for _, test := range []struct {
+		req  controlRequest
+		want controlResponse
+	}{
+		{controlRequest{Line: "whoami"}, controlResponse{whoami, true}},
+		{controlRequest{Line: "  "}, controlResponse{"", true}},
+		{controlRequest{Line: "bogus"}, controlResponse{"ERR: Unknown command", false}},
+		{controlRequest{Line: "whoami", JSON: true}, controlResponse{`{"command":"whoami","ok":true,"output":"` + whoami + `"}`, true}},
+	} {
+		if err := enc.Encode(test.req); err != nil {
+			t.Fatal(err)
+		}
+		var res controlResponse
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res != test.want {
+			t.Errorf("%+v: got %+v, want %+v", test.req, res, test.want)
+		}
+	}
+	// quit ends the connection, not the node.
+	if err := enc.Encode(controlRequest{Line: "quit"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(new(controlResponse)); err != io.EOF {
+		t.Errorf("after quit: got %v", err)
+	}
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatal("node stopped serving after quit: ", err)
+	}
+	conn.Close()
+}
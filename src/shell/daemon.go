@@ -0,0 +1,111 @@
+package shell
+
+// Contains what the node needs to run unattended: reading flags from a
+// config file, log levels, a persistent identity in the data directory and
+// waiting for a signal to stop.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+import (
+	"kademlia"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelError
+)
+
+var logLevels = map[string]int{"debug": levelDebug, "info": levelInfo, "error": levelError}
+
+// Messages below this level are not logged.
+var logLevel = levelInfo
+
+func debugf(format string, v ...interface{}) {
+	if logLevel <= levelDebug {
+		log.Printf(format, v...)
+	}
+}
+
+func infof(format string, v ...interface{}) {
+	if logLevel <= levelInfo {
+		log.Printf(format, v...)
+	}
+}
+
+func setLogLevel(name string) error {
+	level, ok := logLevels[name]
+	if !ok {
+		return errors.New("unknown log level " + name + ", want debug, info or error")
+	}
+	logLevel = level
+	return nil
+}
+
+// Set the flags named in the config file at path, one "name = value" per line,
+// unless they were given on the command line. Blank lines and lines starting
+// with # are skipped.
+func readConfig(flags *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: want name = value", path, n+1)
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if name == "config" || flags.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %s", path, n+1, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n+1, err)
+		}
+	}
+	return nil
+}
+
+// The identity kept in dir, created on first use so that the node keeps its
+// ID across restarts.
+func loadIdentity(dir string) (*kademlia.Identity, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "identity")
+	ident, err := kademlia.LoadIdentity(path)
+	if !os.IsNotExist(err) {
+		return ident, err
+	}
+	if ident, err = kademlia.NewIdentity(nil); err != nil {
+		return nil, err
+	}
+	return ident, ident.Save(path)
+}
+
+// Block until the process is asked to stop.
+func waitForSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	infof("stopping on %v\n", <-sig)
+}
@@ -0,0 +1,48 @@
+package shell
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	flags := flag.NewFlagSet("main", flag.ContinueOnError)
+	opts := defineFlags(flags)
+	if err := flags.Parse([]string{"-log-level", "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := dir + "/node.conf"
+	config := "# a node\n\nlisten = 127.0.0.1:7890\n  json=true\nlog-level = error\nrate-limit = 5/10\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := readConfig(flags, path); err != nil {
+		t.Fatal(err)
+	}
+	// The command line wins over the file.
+	if opts.listen != "127.0.0.1:7890" || !opts.jsonOutput || opts.level != "debug" || opts.rateLimit != "5/10" {
+		t.Errorf("got %+v", opts)
+	}
+
+	for config, want := range map[string]string{
+		"listen\n":           path + ":1: want name = value",
+		"\nbogus = 1\n":      path + ":2: unknown setting bogus",
+		"config = other\n":   path + ":1: unknown setting config",
+		"json = sometimes\n": path + `:1: parse error`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		flags := flag.NewFlagSet("main", flag.ContinueOnError)
+		defineFlags(flags)
+		if err := readConfig(flags, path); err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%q: got %v, want %s", config, err, want)
+		}
+	}
+	if err := readConfig(flags, dir+"/missing"); err == nil {
+		t.Error("missing file read")
+	}
+}
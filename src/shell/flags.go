@@ -0,0 +1,145 @@
+package shell
+
+// Contains the command line flags and how the ones that set node options
+// become a kademlia.Config.
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+)
+
+import (
+	"kademlia"
+)
+
+var ErrBadRateLimit = errors.New("want a rate limit as rate or rate/burst, in requests per second")
+
+// The values of the command line flags.
+type options struct {
+	listen, seedList, dataDir, configFile, level string
+	daemon, jsonOutput                           bool
+	apiAddr, metricsAddr, control, script        string
+	insecure, krpc, proximity                    bool
+	rateLimit, methodRateLimits, diversity       string
+	maxConcurrent                                int
+}
+
+func defineFlags(flags *flag.FlagSet) *options {
+	o := new(options)
+	flags.StringVar(&o.listen, "listen", "", "serve on `host:port`")
+	flags.StringVar(&o.seedList, "seeds", "", "comma-separated `host:port` addresses of nodes to join through")
+	flags.StringVar(&o.dataDir, "data-dir", "", "keep the node's identity, and by default its control socket, in `dir`")
+	flags.StringVar(&o.configFile, "config", "", "read flags from `file`, one \"name = value\" per line; flags on the command line win")
+	flags.StringVar(&o.level, "log-level", "info", "log `level`: debug, info or error")
+	flags.BoolVar(&o.daemon, "daemon", false, "run without reading commands from stdin, until interrupted")
+	flags.StringVar(&o.apiAddr, "api", "", "serve the JSON API over HTTP on the loopback `host:port`")
+	flags.StringVar(&o.metricsAddr, "metrics", "", "serve Prometheus metrics over HTTP on `host:port`")
+	flags.StringVar(&o.control, "control", "", "serve shell commands on the unix socket at `path` (default data-dir/control.sock)")
+	flags.StringVar(&o.script, "script", "", "run the commands in `file`, one per line, and exit; - reads them from stdin")
+	flags.BoolVar(&o.jsonOutput, "json", false, "print the result of each command as a JSON object")
+	flags.BoolVar(&o.insecure, "insecure", false, "talk to peers over plain HTTP instead of TLS")
+	flags.BoolVar(&o.krpc, "krpc", false, "also serve the BitTorrent Mainline DHT protocol over UDP on the same port")
+	flags.BoolVar(&o.proximity, "proximity", false, "prefer contacts with low round trip times in buckets and lookups")
+	flags.StringVar(&o.diversity, "diversity", "", "cap the contacts sharing an address as `limit=n,...`; limits are ip, subnet, ip-per-bucket, subnet-per-bucket and lookup-subnet")
+	flags.StringVar(&o.rateLimit, "rate-limit", "", "limit each IP to `rate[/burst]` RPCs per second of each method")
+	flags.StringVar(&o.methodRateLimits, "method-rate-limits", "", "limits per IP for single methods, overriding -rate-limit, as `Method=rate[/burst],...`")
+	flags.IntVar(&o.maxConcurrent, "max-concurrent", 0, "handle at most `n` incoming RPCs at once; 0 means no limit")
+	flags.StringVar(&keyspace.Namespace, "namespace", "", "derive the keys of put and get from names in `namespace`")
+	return o
+}
+
+// The node options the flags give, apart from the identity.
+func (o *options) nodeConfig() (kademlia.Config, error) {
+	conf := kademlia.Config{
+		APIAddr:     o.apiAddr,
+		MetricsAddr: o.metricsAddr,
+		Insecure:    o.insecure,
+		KRPC:        o.krpc,
+		Proximity:   o.proximity,
+	}
+	var err error
+	if conf.Limits, err = parseLimits(o.rateLimit, o.methodRateLimits, o.maxConcurrent); err != nil {
+		return conf, err
+	}
+	conf.Diversity, err = parseDiversity(o.diversity)
+	return conf, err
+}
+
+// A rate limit as "rate" or "rate/burst"; the burst defaults to one request.
+func parseRateLimit(s string) (kademlia.RateLimit, error) {
+	var ret kademlia.RateLimit
+	rate, burst := s, ""
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		rate, burst = s[:i], s[i+1:]
+	}
+	var err error
+	if ret.Rate, err = strconv.ParseFloat(rate, 64); err != nil || ret.Rate < 0 {
+		return ret, ErrBadRateLimit
+	}
+	if burst != "" {
+		if ret.Burst, err = strconv.Atoi(burst); err != nil || ret.Burst < 1 {
+			return ret, ErrBadRateLimit
+		}
+	}
+	return ret, nil
+}
+
+// The limits on incoming RPCs the -rate-limit, -method-rate-limits and
+// -max-concurrent flags give. perMethod is a comma-separated list of
+// Method=rate[/burst].
+func parseLimits(perIP, perMethod string, maxConcurrent int) (kademlia.Limits, error) {
+	var ret kademlia.Limits
+	var err error
+	if perIP != "" {
+		if ret.DefaultPerIP, err = parseRateLimit(perIP); err != nil {
+			return ret, err
+		}
+	}
+	if perMethod != "" {
+		ret.PerIP = make(map[string]kademlia.RateLimit)
+		for _, entry := range strings.Split(perMethod, ",") {
+			i := strings.IndexByte(entry, '=')
+			if i <= 0 {
+				return ret, errors.New("want Method=rate[/burst], got " + entry)
+			}
+			if ret.PerIP[entry[:i]], err = parseRateLimit(entry[i+1:]); err != nil {
+				return ret, err
+			}
+		}
+	}
+	if maxConcurrent < 0 {
+		return ret, errors.New("-max-concurrent must not be negative")
+	}
+	ret.MaxConcurrent = maxConcurrent
+	return ret, nil
+}
+
+// The limits the -diversity flag gives, as a comma-separated list of
+// limit=n.
+func parseDiversity(s string) (kademlia.Diversity, error) {
+	var ret kademlia.Diversity
+	if s == "" {
+		return ret, nil
+	}
+	limits := map[string]*int{
+		"ip":                &ret.PerIP,
+		"subnet":            &ret.PerSubnet,
+		"ip-per-bucket":     &ret.PerIPPerBucket,
+		"subnet-per-bucket": &ret.PerSubnetPerBucket,
+		"lookup-subnet":     &ret.LookupPerSubnet,
+	}
+	for _, entry := range strings.Split(s, ",") {
+		i := strings.IndexByte(entry, '=')
+		if i <= 0 || limits[entry[:i]] == nil {
+			return ret, errors.New("want limit=n with limit one of ip, subnet, ip-per-bucket, subnet-per-bucket and lookup-subnet, got " + entry)
+		}
+		n, err := strconv.Atoi(entry[i+1:])
+		if err != nil || n < 0 {
+			return ret, errors.New("bad diversity limit " + entry)
+		}
+		*limits[entry[:i]] = n
+	}
+	return ret, nil
+}
@@ -0,0 +1,70 @@
+package shell
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+import (
+	"kademlia"
+)
+
+func TestNodeConfig(t *testing.T) {
+	flags := flag.NewFlagSet("main", flag.ContinueOnError)
+	opts := defineFlags(flags)
+	err := flags.Parse([]string{
+		"-insecure", "-krpc", "-proximity",
+		"-api", "127.0.0.1:8000", "-metrics", ":9100",
+		"-diversity", "ip=2,subnet=8,ip-per-bucket=1,subnet-per-bucket=2,lookup-subnet=3",
+		"-rate-limit", "5/10", "-method-rate-limits", "Store=1", "-max-concurrent", "64",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := opts.nodeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := kademlia.Config{
+		Insecure:    true,
+		KRPC:        true,
+		Proximity:   true,
+		APIAddr:     "127.0.0.1:8000",
+		MetricsAddr: ":9100",
+		Diversity:   kademlia.Diversity{PerIP: 2, PerSubnet: 8, PerIPPerBucket: 1, PerSubnetPerBucket: 2, LookupPerSubnet: 3},
+		Limits: kademlia.Limits{
+			DefaultPerIP:  kademlia.RateLimit{Rate: 5, Burst: 10},
+			PerIP:         map[string]kademlia.RateLimit{"Store": {Rate: 1}},
+			MaxConcurrent: 64,
+		},
+	}
+	if !reflect.DeepEqual(conf, want) {
+		t.Errorf("got %+v\nwant %+v", conf, want)
+	}
+
+	// Without flags, the defaults of kademlia.Config.
+	opts = defineFlags(flag.NewFlagSet("main", flag.ContinueOnError))
+	if conf, err := opts.nodeConfig(); err != nil || !reflect.DeepEqual(conf, kademlia.Config{}) {
+		t.Errorf("no flags: got %+v, %v", conf, err)
+	}
+}
+
+func TestParseFlagValues(t *testing.T) {
+	for _, s := range []string{"x", "-1", "1/0", "1/x", "1/2/3"} {
+		if _, err := parseRateLimit(s); err != ErrBadRateLimit {
+			t.Errorf("rate limit %q: got %v", s, err)
+		}
+	}
+	if _, err := parseLimits("", "Store", 0); err == nil {
+		t.Error("method limit without a rate accepted")
+	}
+	if _, err := parseLimits("", "", -1); err == nil {
+		t.Error("negative -max-concurrent accepted")
+	}
+	for _, s := range []string{"ip", "ip=", "ip=-1", "ports=2", "=2", "ip=1,"} {
+		if _, err := parseDiversity(s); err == nil {
+			t.Errorf("diversity %q accepted", s)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package shell
+
+// Contains the non-interactive side of the shell: running a file of commands
+// (--script) and printing results as JSON objects (--json). In JSON mode, the
+// commands that have an operation in the node's JSON API run through it and
+// print its response; the others print their text output.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+import (
+	"kademlia"
+)
+
+// The result of a command in JSON mode.
+type jsonResult struct {
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	// The text output of commands without an API operation.
+	Output string `json:"output,omitempty"`
+	*kademlia.APIResponse
+}
+
+// Run one command, and return its output and whether it succeeded. The
+// output is "quit" for the quit command.
+func runCommand(k *kademlia.Kademlia, line string, jsonOutput bool) (string, bool) {
+	if !jsonOutput {
+		resp := executeLine(k, line)
+		return resp, !failed(resp)
+	}
+	return executeJSON(k, line)
+}
+
+// Whether the text output of a command reports a failure.
+func failed(resp string) bool {
+	return strings.HasPrefix(resp, "ERR") || strings.HasPrefix(resp, "usage:")
+}
+
+func executeJSON(k *kademlia.Kademlia, line string) (string, bool) {
+	toks, err := SplitLine(line)
+	if err == nil && len(toks) == 0 {
+		return "", true
+	}
+	var result jsonResult
+	var op string
+	var req *kademlia.APIRequest
+	if err == nil {
+		result.Command = toks[0]
+		op, req, err = apiCommand(toks)
+	}
+	switch {
+	case err != nil:
+		result.APIResponse = &kademlia.APIResponse{Error: err.Error()}
+	case op != "":
+		var status int
+		result.APIResponse, status = k.RunAPI(op, req)
+		result.OK = status == 200
+	default:
+		resp := executeLine(k, line)
+		if resp == "quit" {
+			return resp, true
+		}
+		result.OK = !failed(resp)
+		if result.OK {
+			result.Output = strings.TrimPrefix(resp, "OK: ")
+		} else {
+			result.APIResponse = &kademlia.APIResponse{Error: strings.TrimPrefix(resp, "ERR: ")}
+		}
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		return `{"command":` + strconv.Quote(result.Command) + `,"ok":false,"error":"cannot encode the result"}`, false
+	}
+	return string(out), result.OK
+}
+
+// The API operation and request for a command, or "" if the command has no
+// operation or has the wrong number of arguments, which executeLine reports.
+func apiCommand(toks []string) (string, *kademlia.APIRequest, error) {
+	req := new(kademlia.APIRequest)
+	switch {
+	case toks[0] == "ping" && len(toks) == 2:
+		if strings.Contains(toks[1], ":") {
+			req.Address = toks[1]
+		} else {
+			req.NodeID = toks[1]
+		}
+		return "ping", req, nil
+	case toks[0] == "store" && len(toks) == 4:
+		value, err := parseValue(toks[3])
+		if err != nil {
+			return "", nil, err
+		}
+		req.NodeID, req.Key, req.Value = toks[1], toks[2], value
+		return "store", req, nil
+	case toks[0] == "find_node" && len(toks) == 3:
+		req.NodeID, req.Key = toks[1], toks[2]
+		return "find_node", req, nil
+	case toks[0] == "find_value" && len(toks) == 3:
+		req.NodeID, req.Key = toks[1], toks[2]
+		return "find_value", req, nil
+	case toks[0] == "iterativeFindNode" && len(toks) == 2:
+		req.Key = toks[1]
+		return "iterative_find_node", req, nil
+	case toks[0] == "iterativeStore" && (len(toks) == 3 || len(toks) == 4):
+		value, err := parseValue(toks[2])
+		if err != nil {
+			return "", nil, err
+		}
+		quorum, ok := parseQuorum(toks, 3)
+		if !ok {
+			return "", nil, errors.New("usage: iterativeStore [key] [value] [quorum]")
+		}
+		req.Key, req.Value, req.Quorum = toks[1], value, quorum
+		return "iterative_store", req, nil
+	case toks[0] == "iterativeFindValue" && len(toks) >= 2:
+		quorum, output, ok := parseRead(toks, 2)
+		if !ok {
+			return "", nil, errors.New("usage: iterativeFindValue [key] [quorum] [hex | base64 | @path]")
+		}
+		if output != "" {
+			// Leave writing the value out to executeLine.
+			return "", nil, nil
+		}
+		req.Key, req.Quorum = toks[1], quorum
+		return "iterative_find_value", req, nil
+	case toks[0] == "vanish" && len(toks) == 6:
+		numberKeys, err3 := strconv.ParseUint(toks[3], 10, 8)
+		threshold, err4 := strconv.ParseUint(toks[4], 10, 8)
+		timeout, err5 := strconv.Atoi(toks[5])
+		if err3 != nil || err4 != nil || err5 != nil {
+			return "", nil, errors.New("usage: vanish [VDO ID] [data] [numberKeys] [threshold] [timeout]")
+		}
+		value, err := parseValue(toks[2])
+		if err != nil {
+			return "", nil, err
+		}
+		req.VDOID, req.Value = toks[1], value
+		req.NumberKeys, req.Threshold, req.Timeout = byte(numberKeys), byte(threshold), timeout
+		return "vanish", req, nil
+	case toks[0] == "put" && (len(toks) == 3 || len(toks) == 4):
+		value, err := parseValue(toks[2])
+		if err != nil {
+			return "", nil, err
+		}
+		quorum, ok := parseQuorum(toks, 3)
+		if !ok {
+			return "", nil, errors.New("usage: put [name] [value] [quorum]")
+		}
+		req.Key, req.Value, req.Quorum = keyspace.Key(toks[1]).AsString(), value, quorum
+		return "iterative_store", req, nil
+	case toks[0] == "cas" && (len(toks) == 4 || len(toks) == 5):
+		value, err := parseValue(toks[3])
+		if err != nil {
+			return "", nil, err
+		}
+		quorum, ok := parseQuorum(toks, 4)
+		if !ok {
+			return "", nil, errors.New("usage: cas [name] [none | version | sha1:hash] [value] [quorum]")
+		}
+		if len(toks) == 4 {
+			quorum = 0
+		}
+		req.Key, req.Value, req.Quorum = keyspace.Key(toks[1]).AsString(), value, quorum
+		expected, err := parseExpectation(toks[2])
+		if err != nil {
+			return "", nil, err
+		}
+		if !expected.Version.IsZero() {
+			req.Expected = expected.Version.String()
+		}
+		req.ExpectedHash = expected.Hash
+		return "compare_and_swap", req, nil
+	case toks[0] == "get" && len(toks) >= 2:
+		quorum, output, ok := parseRead(toks, 2)
+		if !ok {
+			return "", nil, errors.New("usage: get [name] [quorum] [hex | base64 | @path]")
+		}
+		if output != "" {
+			return "", nil, nil
+		}
+		req.Key, req.Quorum = keyspace.Key(toks[1]).AsString(), quorum
+		return "iterative_find_value", req, nil
+	case toks[0] == "routing_table" && len(toks) == 1:
+		return "routing_table", req, nil
+	case toks[0] == "unvanish" && len(toks) == 3:
+		req.NodeID, req.VDOID = toks[1], toks[2]
+		return "unvanish", req, nil
+	}
+	return "", nil, nil
+}
+
+// Run the commands in, one per line, writing their output to out, until one
+// fails or quit. Blank lines and lines starting with # are skipped. Returns
+// whether all the commands succeeded.
+func runScript(k *kademlia.Kademlia, in io.Reader, out io.Writer, jsonOutput bool) bool {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		resp, ok := runCommand(k, line, jsonOutput)
+		if resp == "quit" {
+			return true
+		}
+		if resp != "" {
+			fmt.Fprintf(out, "%v\n", resp)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(out, "ERR: %v\n", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package shell
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+import (
+	"kademlia"
+)
+
+// n nodes on a memory network, each knowing the ones before it.
+func newTestNodes(t *testing.T, n int) []*kademlia.Kademlia {
+	network := kademlia.NewMemoryNetwork()
+	nodes := make([]*kademlia.Kademlia, n)
+	for i := range nodes {
+		k := kademlia.NewKademliaWithConfig("127.0.0.1:0", kademlia.Config{Transport: network.Transport()})
+		t.Cleanup(func() { k.Close() })
+		nodes[i] = k
+		for _, peer := range nodes[:i] {
+			self := peer.Routes.Self()
+			if resp := k.DoPing(self.Host, self.Port); !strings.HasPrefix(resp, "OK") {
+				t.Fatal(resp)
+			}
+		}
+	}
+	return nodes
+}
+
+func TestRunScript(t *testing.T) {
+	k := newTestNodes(t, 1)[0]
+	whoami := executeLine(k, "whoami")
+	for _, test := range []struct {
+		script string
+		ok     bool
+		out    []string
+	}{
+		{"whoami\n\n# a comment\n  whoami  \n", true, []string{whoami, whoami}},
+		{"whoami\nbogus\nwhoami\n", false, []string{whoami, "ERR: Unknown command"}},
+		{"whoami extra\nwhoami\n", false, []string{"usage: whoami"}},
+		{"whoami\nquit\nbogus\n", true, []string{whoami}},
+		{"'unterminated\n", false, []string{"ERR: unterminated quote"}},
+		{"", true, nil},
+	} {
+		var out bytes.Buffer
+		ok := runScript(k, strings.NewReader(test.script), &out, false)
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if out.Len() == 0 {
+			lines = nil
+		}
+		if ok != test.ok || strings.Join(lines, "|") != strings.Join(test.out, "|") {
+			t.Errorf("%q: got %v, %q; want %v, %q", test.script, ok, lines, test.ok, test.out)
+		}
+	}
+}
+
+func TestExecuteJSON(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+	k, peer := nodes[1], nodes[0].NodeID.AsString()
+	key := kademlia.NewRandomID().AsString()
+	for _, test := range []struct {
+		line   string
+		ok     bool
+		output string
+		value  string
+		err    string
+	}{
+		{"store " + peer + " " + key + " hex:68656c6c6f", true, "", "", ""},
+		{"find_value " + peer + " " + key, true, "", "hello", ""},
+		{"whoami", true, strings.TrimPrefix(executeLine(k, "whoami"), "OK: "), "", ""},
+		{"store " + peer + " " + key + " hex:zz", false, "", "", "bad hex value"},
+		{"bogus", false, "", "", "Unknown command"},
+		{`whoami "`, false, "", "", "unterminated quote"},
+	} {
+		out, ok := executeJSON(k, test.line)
+		var res struct {
+			Command string `json:"command"`
+			OK      bool   `json:"ok"`
+			Output  string `json:"output"`
+			Value   []byte `json:"value"`
+			Error   string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Errorf("%q: %v in %s", test.line, err, out)
+			continue
+		}
+		if ok != test.ok || res.OK != test.ok || res.Output != test.output || string(res.Value) != test.value || res.Error != test.err {
+			t.Errorf("%q: got %v, %s", test.line, ok, out)
+		}
+	}
+	if out, ok := executeJSON(k, "  "); out != "" || !ok {
+		t.Errorf("blank line: got %v, %q", ok, out)
+	}
+}
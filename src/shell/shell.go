@@ -0,0 +1,865 @@
+// Weihao Ming	wml431
+// Fan Wu				fwz766
+// Weian Yang		wys234
+// Finish extra credit
+
+package shell
+
+// Contains the node's command line and the commands of its interactive shell.
+// The main program only calls Main, which leaves the rest testable here.
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"kademlia"
+)
+
+// Main runs a node with the options given on the command line, then its
+// shell, a script or nothing until interrupted.
+func Main() {
+	// By default, Go seeds its RNG with 1. This would cause every program to
+	// generate the same sequence of IDs. Use the current nano time to
+	// random numbers
+	rand.Seed(time.Now().UnixNano())
+
+	opts := defineFlags(flag.CommandLine)
+	flag.Parse()
+	if opts.configFile != "" {
+		if err := readConfig(flag.CommandLine, opts.configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := setLogLevel(opts.level); err != nil {
+		log.Fatal(err)
+	}
+
+	// The bind address and the seeds to join through may also be given as
+	// arguments. Without seeds, this is the first node of a network.
+	args := flag.Args()
+	listenStr := opts.listen
+	if listenStr == "" && len(args) > 0 {
+		listenStr, args = args[0], args[1:]
+	}
+	if listenStr == "" {
+		log.Fatal("usage: main [flags] listen_addr [seed_addr ...]\n")
+	}
+	seeds := args
+	if opts.seedList != "" {
+		seeds = append(seeds, strings.Split(opts.seedList, ",")...)
+	}
+
+	conf, err := opts.nodeConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.dataDir != "" {
+		ident, err := loadIdentity(opts.dataDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf.Identity = ident
+	}
+
+	// Create the Kademlia instance
+	if !opts.jsonOutput && !opts.daemon {
+		fmt.Printf("kademlia starting up!\n")
+	}
+	kadem := kademlia.NewKademliaWithConfig(listenStr, conf)
+	defer kadem.Close()
+	infof("node %v listening on %v\n", kadem.NodeID.AsString(), listenStr)
+
+	if len(seeds) > 0 {
+		if err := kadem.Bootstrap(seeds); err != nil {
+			// Another seed can still be tried with join.
+			infof("bootstrap: %v\n", err)
+		} else {
+			infof("bootstrap: joined through %v\n", strings.Join(seeds, ", "))
+		}
+	}
+
+	controlPath := opts.control
+	if controlPath == "" && opts.dataDir != "" {
+		controlPath = filepath.Join(opts.dataDir, "control.sock")
+	}
+	if controlPath != "" {
+		l, err := listenControl(controlPath, kadem)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(controlPath)
+		defer l.Close()
+		infof("control socket at %v\n", controlPath)
+	}
+
+	switch {
+	case opts.script != "":
+		in := os.Stdin
+		if opts.script != "-" {
+			f, err := os.Open(opts.script)
+			if err != nil {
+				log.Fatal(err)
+			}
+			in = f
+		}
+		if !runScript(kadem, in, os.Stdout, opts.jsonOutput) {
+			os.Remove(controlPath)
+			os.Exit(1)
+		}
+	case opts.daemon:
+		waitForSignal()
+	default:
+		runShell(kadem, opts.jsonOutput)
+	}
+}
+
+// Run commands typed on stdin until quit or the end of the input.
+func runShell(k *kademlia.Kademlia, jsonOutput bool) {
+	in := bufio.NewReader(os.Stdin)
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		resp, _ := runCommand(k, line, jsonOutput)
+		if resp == "quit" {
+			return
+		} else if resp != "" {
+			fmt.Printf("%v\n", resp)
+		}
+	}
+}
+
+// The keyspace of the put, get and key commands.
+var keyspace kademlia.Keyspace
+
+// The leases the acquire command took, by lock name, for renew and release.
+// Commands from the control socket run concurrently, so a lease is marked
+// busy while a command works on it, and the mutex is only held to look at the
+// map, not across calls to other nodes.
+var leases = struct {
+	sync.Mutex
+	m map[string]*heldLease
+}{m: make(map[string]*heldLease)}
+
+type heldLease struct {
+	lease *kademlia.Lease
+	busy  bool
+}
+
+// Mark the lease called name busy and return it, or return an error response.
+func claimLease(name string) (*heldLease, string) {
+	leases.Lock()
+	defer leases.Unlock()
+	held := leases.m[name]
+	if held == nil {
+		return nil, "ERR: not holding " + name
+	}
+	if held.busy {
+		return nil, "ERR: " + name + " is busy"
+	}
+	held.busy = true
+	return held, ""
+}
+
+// Unmark a lease claimed for name, or forget it if it is no longer held.
+func unclaimLease(name string, held *heldLease, keep bool) {
+	leases.Lock()
+	defer leases.Unlock()
+	held.busy = false
+	if !keep {
+		delete(leases.m, name)
+	}
+}
+
+func executeLine(k *kademlia.Kademlia, line string) (response string) {
+	toks, err := SplitLine(line)
+	if err != nil {
+		return "ERR: " + err.Error()
+	} else if len(toks) == 0 {
+		return ""
+	}
+	switch {
+	case toks[0] == "quit":
+		response = "quit"
+	case toks[0] == "whoami":
+		if len(toks) > 1 {
+			response = "usage: whoami"
+			return
+		}
+		// The address is the one peers agree they see, once they do.
+		self := k.Routes.Self()
+		response = k.NodeID.AsString() + " " + kademlia.Dest(self.Host, self.Port)
+
+	case toks[0] == "join":
+		if len(toks) < 2 {
+			response = "usage: join host:port [host:port ...]"
+			return
+		}
+		if err := k.Bootstrap(toks[1:]); err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: joined"
+
+	case toks[0] == "print_contact":
+		if len(toks) < 2 || len(toks) > 2 {
+			response = "usage: print_contact [nodeID]"
+			return
+		}
+		id, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Not a valid node ID (" + toks[1] + ")"
+			return
+		}
+		c, err := k.FindContact(id)
+		if err != nil {
+			response = "ERR: Unknown contact node ID"
+			return
+		}
+		response = "OK: NodeID=" + toks[1] + "\n"
+		response += "      Host=" + c.Host.String() + "\n"
+		response += "      Port=" + strconv.Itoa(int(c.Port))
+		if l, ok := k.Routes.Liveness(id); ok {
+			response += "\n      LastSeen=" + formatTime(l.LastSeen)
+			response += "\n      LastReply=" + formatTime(l.LastReply)
+			response += "\n      Failures=" + strconv.Itoa(l.Failures)
+			response += "\n      RTT=" + l.RTT.String()
+		}
+	case toks[0] == "routing_table":
+		if len(toks) != 1 {
+			response = "usage: routing_table"
+			return
+		}
+		s := k.Snapshot()
+		response = fmt.Sprintf("OK: %d contacts in %d buckets", s.Contacts(), len(s.Buckets))
+		for _, bucket := range s.Buckets {
+			response += fmt.Sprintf("\n  bucket %d (%d):", bucket.PrefixLength, len(bucket.Contacts))
+			for _, c := range bucket.Contacts {
+				response += "\n    " + c.NodeID.AsString() + " " + kademlia.Dest(c.Host, c.Port)
+				response += " seen=" + formatAgo(c.Liveness.LastSeen)
+				response += " reply=" + formatAgo(c.Liveness.LastReply)
+				response += " rtt=" + c.Liveness.RTT.String()
+				response += " failures=" + strconv.Itoa(c.Liveness.Failures)
+			}
+		}
+
+	case toks[0] == "stats":
+		if len(toks) != 1 {
+			response = "usage: stats"
+			return
+		}
+		s := k.Snapshot()
+		response = "OK: Uptime=" + s.Uptime().Round(time.Second).String() + "\n"
+		response += "      Contacts=" + strconv.Itoa(s.Contacts()) + "\n"
+		response += "      Buckets=" + strconv.Itoa(len(s.Buckets)) + "\n"
+		response += "      StoredKeys=" + strconv.Itoa(s.StoredKeys) + "\n"
+		response += "      StoredBytes=" + strconv.Itoa(s.StoredBytes) + "\n"
+		response += "      VDOs=" + strconv.Itoa(s.VDOs) + "\n"
+		response += "      Lookups=" + strconv.FormatUint(s.Lookups, 10) + "\n"
+		response += fmt.Sprintf("      LookupSuccessRate=%.1f%%\n", 100*s.LookupSuccessRate())
+		response += "      RPCsIn=" + formatRPCs(s.RPCsIn) + "\n"
+		response += "      RPCsOut=" + formatRPCs(s.RPCsOut) + "\n"
+		response += "      RejectedIP=" + strconv.FormatUint(s.Diversity.RejectedIP, 10) + "\n"
+		response += "      RejectedSubnet=" + strconv.FormatUint(s.Diversity.RejectedSubnet, 10) + "\n"
+		response += "      RateLimited=" + formatCounts(s.Limiter.RateLimited) + "\n"
+		response += "      Overloaded=" + formatCounts(s.Limiter.Overloaded)
+
+	case toks[0] == "neighbors":
+		if len(toks) != 1 {
+			response = "usage: neighbors"
+			return
+		}
+		s := k.Snapshot()
+		response = fmt.Sprintf("OK: %d neighbors", len(s.Neighbors))
+		for _, c := range s.Neighbors {
+			response += fmt.Sprintf("\n  %s %s distance=%d", c.NodeID.AsString(), kademlia.Dest(c.Host, c.Port),
+				kademlia.IDBits-c.NodeID.Xor(k.NodeID).PrefixLen())
+		}
+
+	case toks[0] == "ping":
+		// Do a ping
+		//
+		// Check if toks[1] is a valid NodeID, if not, try pinging host:port
+		// print an error if neither is valid
+		//
+		// Following lines need to be expanded
+
+		if len(toks) < 2 || len(toks) > 2 {
+			response = "usage: ping [nodeID | host:port]"
+			return
+		}
+		id, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			hostname, portstr, err := net.SplitHostPort(toks[1])
+			if err != nil {
+				response = "ERR: Not a valid Node ID or host:port address"
+				return
+			}
+			port, err := strconv.Atoi(portstr)
+			if err != nil {
+				response = "ERR: Not a valid Node ID or host:port address"
+				return
+			}
+			host, err := k.ResolveHost(hostname)
+			if err != nil {
+				response = "ERR: Could not find the provided hostname"
+				return
+			}
+			response = k.DoPing(host, uint16(port))
+			return
+		}
+		c, err := k.FindContact(id)
+		if err != nil {
+			response = "ERR: Not a valid Node ID or host:port address"
+			return
+		}
+		response = k.DoPing(c.Host, c.Port)
+
+	case toks[0] == "local_find_value":
+		// print a local variable
+		if len(toks) < 2 || len(toks) > 3 || len(toks) == 3 && !isOutput(toks[2]) {
+			response = "usage: local_find_value [key] [hex | base64 | @path]"
+			return
+		}
+		key, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		if len(toks) == 2 {
+			response = k.LocalFindValue(key)
+			return
+		}
+		keys, found := k.LocalFindValueHelper(key)
+		if found != 1 {
+			response = "ERR: cannot find key"
+			return
+		}
+		response = withVersion(printValue("OK: value --> ", keys.Value, toks[2]), keys.Version)
+
+	case toks[0] == "store":
+		// Store key, value pair at NodeID
+		if len(toks) < 4 || len(toks) > 4 {
+			response = "usage: store [nodeID] [key] [value]"
+			return
+		}
+		nodeId, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid node ID (" + toks[1] + ")"
+			return
+		}
+		contact, err := k.FindContact(nodeId)
+		if err != nil {
+			response = "ERR: Unable to find contact with node ID (" + toks[1] + ")"
+			return
+		}
+		key, err := kademlia.ParseID(toks[2])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[2] + ")"
+			return
+		}
+		value, err := parseValue(toks[3])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+
+		response = k.DoStore(contact, key, value)
+
+	case toks[0] == "find_node":
+		// perform a find_node RPC
+		if len(toks) < 3 || len(toks) > 3 {
+			response = "usage: find_node [nodeID] [key]"
+			return
+		}
+
+		nodeId, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid node ID (" + toks[1] + ")"
+			return
+		}
+		contact, err := k.FindContact(nodeId)
+		if err != nil {
+			response = "ERR: Unable to find contact with node ID (" + toks[1] + ")"
+			return
+		}
+		key, err := kademlia.ParseID(toks[2])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[2] + ")"
+			return
+		}
+		response = k.DoFindNode(contact, key)
+
+	case toks[0] == "find_value":
+		// perform a find_value RPC
+		if len(toks) < 3 || len(toks) > 4 || len(toks) == 4 && !isOutput(toks[3]) {
+			response = "usage: find_value [nodeID] [key] [hex | base64 | @path]"
+			return
+		}
+
+		nodeId, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid node ID (" + toks[1] + ")"
+			return
+		}
+		contact, err := k.FindContact(nodeId)
+		if err != nil {
+			response = "ERR: Unable to find contact with node ID (" + toks[1] + ")"
+			return
+		}
+		key, err := kademlia.ParseID(toks[2])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[2] + ")"
+			return
+		}
+		if len(toks) == 3 {
+			response = k.DoFindValue(contact, key)
+			return
+		}
+		value, version, _, err := k.FindValue(contact, key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		if value == nil {
+			response = "ERR: cannot find key"
+			return
+		}
+		response = withVersion(printValue("OK: value --> ", value, toks[3]), version)
+
+	case toks[0] == "iterativeFindNode":
+		// perform an iterative find node
+		if len(toks) < 2 || len(toks) > 2 {
+			response = "usage: iterativeFindNode [nodeID]"
+			return
+		}
+		id, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid node ID(" + toks[1] + ")"
+			return
+		}
+		response = k.DoIterativeFindNode(id)
+
+	case toks[0] == "iterativeStore":
+		// perform an iterative store
+		quorum, ok := parseQuorum(toks, 3)
+		if !ok {
+			response = "usage: iterativeStore [key] [value] [quorum]"
+			return
+		}
+		key, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		value, err := parseValue(toks[2])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = formatWrite(k.IterativeStore(key, value, quorum))
+
+	case toks[0] == "iterativeFindValue":
+		// performa an iterative find value
+		quorum, output, ok := parseRead(toks, 2)
+		if !ok {
+			response = "usage: iterativeFindValue [key] [quorum] [hex | base64 | @path]"
+			return
+		}
+		key, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		if quorum > 0 {
+			res, err := k.IterativeFindValue(key, quorum, nil)
+			response = formatRead("Key: "+key.AsString()+" --> Value: ", output, res, err)
+			return
+		}
+		if len(toks) == 2 {
+			response = k.DoIterativeFindValue(key)
+			return
+		}
+		res := k.IterativeFindNode(key, true)
+		if res.Value() == nil {
+			response = "ERR: Cannot find value"
+			return
+		}
+		response = withVersion(printValue("Key: "+key.AsString()+" --> Value: ", res.Value(), output), res.Version())
+
+	case toks[0] == "key":
+		if len(toks) != 2 {
+			response = "usage: key [name]"
+			return
+		}
+		response = "OK: " + keyspace.Key(toks[1]).AsString()
+
+	case toks[0] == "put":
+		// Store a value under a name, at the nodes closest to its key
+		quorum, ok := parseQuorum(toks, 3)
+		if !ok {
+			response = "usage: put [name] [value] [quorum]"
+			return
+		}
+		value, err := parseValue(toks[2])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = formatWrite(k.IterativeStore(keyspace.Key(toks[1]), value, quorum))
+
+	case toks[0] == "cas":
+		// Store a value under a name only where it still is as expected
+		quorum, ok := parseQuorum(toks, 4)
+		if !ok {
+			response = "usage: cas [name] [none | version | sha1:hash] [value] [quorum]"
+			return
+		}
+		if len(toks) == 4 {
+			// A majority of the nodes.
+			quorum = 0
+		}
+		expected, err := parseExpectation(toks[2])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		value, err := parseValue(toks[3])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = formatSwap(k.IterativeCompareAndSwap(keyspace.Key(toks[1]), value, expected, quorum))
+
+	case toks[0] == "acquire":
+		// Take a lock, for the leader election of other processes
+		if len(toks) != 3 {
+			response = "usage: acquire [name] [ttl]"
+			return
+		}
+		ttl, err := time.ParseDuration(toks[2])
+		if err != nil || ttl <= 0 {
+			response = "ERR: Provided an invalid ttl (" + toks[2] + ")"
+			return
+		}
+		leases.Lock()
+		if leases.m[toks[1]] != nil {
+			leases.Unlock()
+			response = "ERR: already holding " + toks[1]
+			return
+		}
+		held := &heldLease{busy: true}
+		leases.m[toks[1]] = held
+		leases.Unlock()
+		lease, err := k.Acquire(toks[1], ttl)
+		if err != nil {
+			response = "ERR: " + err.Error()
+		} else {
+			held.lease = lease
+			response = formatLease(lease)
+		}
+		unclaimLease(toks[1], held, err == nil)
+
+	case toks[0] == "renew":
+		if len(toks) != 2 {
+			response = "usage: renew [name]"
+			return
+		}
+		held, msg := claimLease(toks[1])
+		if held == nil {
+			response = msg
+			return
+		}
+		err := k.Renew(held.lease)
+		if err != nil {
+			response = "ERR: " + err.Error()
+		} else {
+			response = formatLease(held.lease)
+		}
+		unclaimLease(toks[1], held, err == nil)
+
+	case toks[0] == "release":
+		if len(toks) != 2 {
+			response = "usage: release [name]"
+			return
+		}
+		held, msg := claimLease(toks[1])
+		if held == nil {
+			response = msg
+			return
+		}
+		// Whatever the nodes say, the lease is no longer this node's.
+		unclaimLease(toks[1], held, false)
+		if err := k.Release(held.lease); err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: released " + toks[1]
+
+	case toks[0] == "get":
+		quorum, output, ok := parseRead(toks, 2)
+		if !ok {
+			response = "usage: get [name] [quorum] [hex | base64 | @path]"
+			return
+		}
+		if quorum > 0 {
+			res, err := k.IterativeFindValue(keyspace.Key(toks[1]), quorum, nil)
+			response = formatRead("OK: value --> ", output, res, err)
+			return
+		}
+		res := k.IterativeFindNode(keyspace.Key(toks[1]), true)
+		if res.Value() == nil {
+			response = "ERR: Cannot find value"
+			return
+		}
+		response = withVersion(printValue("OK: value --> ", res.Value(), output), res.Version())
+
+	case toks[0] == "trace_lookup":
+		if len(toks) != 2 {
+			response = "usage: trace_lookup [key]"
+			return
+		}
+		key, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		_, trace := k.TraceLookup(key, true)
+		var buf bytes.Buffer
+		trace.WriteTree(&buf)
+		response = "OK: " + strings.TrimSuffix(buf.String(), "\n")
+
+	case toks[0] == "vanish":
+		if len(toks) < 6 || len(toks) > 6 {
+			response = "usage: vanish [VDO ID] [data] [numberKeys] [threshold] [timeout]"
+			return
+		}
+		key, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid VDO ID (" + toks[1] + ")"
+			return
+		}
+		toks_3, err3 := strconv.ParseUint(toks[3], 10, 8)
+		toks_4, err4 := strconv.ParseUint(toks[4], 10, 8)
+		toks_5, err5 := strconv.Atoi(toks[5])
+		if err3 != nil || err4 != nil || err5 != nil {
+			response = "usage: vanish [VDO ID] [data] [numberKeys] [threshold] [timeout]"
+			return
+		}
+		data, err := parseValue(toks[2])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		vdo := kademlia.VanishData(k, key, data, byte(toks_3), byte(toks_4))
+		response = k.DoStoreVDO(vdo, toks_5)
+
+	case toks[0] == "unvanish":
+		if len(toks) < 3 || len(toks) > 4 || len(toks) == 4 && !isOutput(toks[3]) {
+			response = "usage: unvanish [Node ID] [VDO ID] [hex | base64 | @path]"
+			return
+		}
+		nodeid, err := kademlia.ParseID(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid NODE ID (" + toks[1] + ")"
+			return
+		}
+		vdoid, err := kademlia.ParseID(toks[2])
+		if err != nil {
+			response = "ERR: Provided an invalid VDO ID (" + toks[2] + ")"
+			return
+		}
+		if len(toks) == 3 {
+			response = k.DoGetVDO(nodeid, vdoid)
+			return
+		}
+		data, err := k.Unvanish(nodeid, vdoid)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = printValue("", data, toks[3])
+	default:
+		response = "ERR: Unknown command"
+	}
+	return
+}
+
+// A value printed after prefix as output asks, or where it was written.
+func printValue(prefix string, value []byte, output string) string {
+	s, err := formatValue(value, output)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	if strings.HasPrefix(output, "@") {
+		return "OK: " + s
+	}
+	return prefix + s
+}
+
+// The optional write quorum after the n arguments of a command, 1 if it is
+// missing, and whether the arguments are valid.
+func parseQuorum(toks []string, n int) (int, bool) {
+	if len(toks) == n {
+		return 1, true
+	} else if len(toks) != n+1 {
+		return 0, false
+	}
+	quorum, err := strconv.Atoi(toks[n])
+	return quorum, err == nil && quorum > 0
+}
+
+// A value line with its version appended, unless it is an error or the value
+// has none.
+func withVersion(response string, version kademlia.Version) string {
+	if strings.HasPrefix(response, "ERR") || version.IsZero() {
+		return response
+	}
+	return response + " (version " + version.String() + ")"
+}
+
+// The optional read quorum and output after the n arguments of a command, in
+// that order, and whether the arguments are valid. The quorum is 0 if it is
+// missing.
+func parseRead(toks []string, n int) (int, string, bool) {
+	if len(toks) < n {
+		return 0, "", false
+	}
+	quorum, output, rest := 0, "", toks[n:]
+	if len(rest) > 0 {
+		if q, err := strconv.Atoi(rest[0]); err == nil {
+			if q <= 0 {
+				return 0, "", false
+			}
+			quorum, rest = q, rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		if !isOutput(rest[0]) {
+			return 0, "", false
+		}
+		output, rest = rest[0], rest[1:]
+	}
+	return quorum, output, len(rest) == 0
+}
+
+// The outcome of a quorum read: the value, then whether the replicas agreed
+// and which of them were repaired.
+func formatRead(prefix, output string, res *kademlia.ReadResult, err error) string {
+	if err != nil {
+		return fmt.Sprintf("ERR: %v: %d of %d nodes answered", err, len(res.Replicas), res.Quorum)
+	}
+	response := withVersion(printValue(prefix, res.Value, output), res.Version)
+	if res.Agreed {
+		return response + fmt.Sprintf("\n  %d replicas agreed", len(res.Replicas))
+	}
+	response += fmt.Sprintf("\n  %d replicas disagreed, repaired %d", len(res.Replicas), len(res.Repaired))
+	for _, c := range res.Repaired {
+		response += "\n  " + c.NodeID.AsString() + " " + kademlia.Dest(c.Host, c.Port)
+	}
+	return response
+}
+
+// The outcome of a replicated write, with a line for each failed replica.
+func formatWrite(res *kademlia.WriteResult, err error) string {
+	var response string
+	if err != nil {
+		response = fmt.Sprintf("ERR: %v: %s stored at %d nodes, need %d", err, res.Key.AsString(), len(res.Stored), res.Quorum)
+	} else {
+		response = fmt.Sprintf("OK: %s stored at %d nodes (version %v)", res.Key.AsString(), len(res.Stored), res.Version)
+	}
+	for _, f := range res.Failed {
+		response += "\n  " + f.Contact.NodeID.AsString() + " " + kademlia.Dest(f.Contact.Host, f.Contact.Port) + ": " + f.Err.Error()
+	}
+	return response
+}
+
+// The outcome of a compare-and-swap, with a line for each node that did not
+// apply it.
+func formatSwap(res *kademlia.SwapResult, err error) string {
+	var response string
+	if err != nil {
+		response = fmt.Sprintf("ERR: %v: %s swapped at %d nodes, need %d", err, res.Key.AsString(), len(res.Swapped), res.Quorum)
+	} else {
+		response = fmt.Sprintf("OK: %s swapped at %d nodes (version %v)", res.Key.AsString(), len(res.Swapped), res.Version)
+	}
+	for _, c := range res.Conflicts {
+		current := "none"
+		if !c.Current.IsZero() {
+			current = c.Current.String()
+		}
+		response += "\n  " + c.Contact.NodeID.AsString() + " " + kademlia.Dest(c.Contact.Host, c.Contact.Port) + ": holds " + current
+	}
+	for _, f := range res.Failed {
+		response += "\n  " + f.Contact.NodeID.AsString() + " " + kademlia.Dest(f.Contact.Host, f.Contact.Port) + ": " + f.Err.Error()
+	}
+	return response
+}
+
+// A lease the node holds, with its fencing token.
+func formatLease(lease *kademlia.Lease) string {
+	return fmt.Sprintf("OK: holding %s until %s at %d nodes (token %v)", lease.Name, lease.Expires.Format(time.RFC3339), len(lease.Replicas), lease.Token)
+}
+
+// How long ago t was, or "never" for the zero time.
+func formatAgo(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Millisecond).String()
+}
+
+// RPC counts as "Method:total/errors", sorted by method.
+func formatRPCs(rpcs map[string]kademlia.RPCStats) string {
+	methods := make([]string, 0, len(rpcs))
+	for method := range rpcs {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	ret := make([]string, 0, len(methods))
+	for _, method := range methods {
+		ret = append(ret, fmt.Sprintf("%s:%d/%d", method, rpcs[method].Total, rpcs[method].Errors))
+	}
+	return strings.Join(ret, " ")
+}
+
+// Counts as "Method:count", sorted by method.
+func formatCounts(counts map[string]uint64) string {
+	methods := make([]string, 0, len(counts))
+	for method := range counts {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	ret := make([]string, 0, len(methods))
+	for _, method := range methods {
+		ret = append(ret, fmt.Sprintf("%s:%d", method, counts[method]))
+	}
+	return strings.Join(ret, " ")
+}
+
+// A time for the CLI, or "never" for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339) + " (" + time.Since(t).Round(time.Millisecond).String() + " ago)"
+}
@@ -0,0 +1,37 @@
+package shell
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLeaseCommands(t *testing.T) {
+	k := newTestNodes(t, 25)[0]
+	for _, test := range []struct {
+		line, prefix string
+	}{
+		{"renew shell-lock", "ERR: not holding"},
+		{"acquire shell-lock 1m", "OK"},
+		{"acquire shell-lock 1m", "ERR: already holding"},
+		{"renew shell-lock", "OK"},
+		{"release shell-lock", "OK: released"},
+		{"release shell-lock", "ERR: not holding"},
+		{"acquire shell-lock 1m", "OK"},
+	} {
+		if resp := executeLine(k, test.line); !strings.HasPrefix(resp, test.prefix) {
+			t.Fatalf("%s: got %q, want %s", test.line, resp, test.prefix)
+		}
+	}
+
+	// Another command is working on the lease.
+	held, _ := claimLease("shell-lock")
+	for _, line := range []string{"renew shell-lock", "release shell-lock"} {
+		if resp := executeLine(k, line); resp != "ERR: shell-lock is busy" {
+			t.Errorf("%s on a busy lease: %q", line, resp)
+		}
+	}
+	unclaimLease("shell-lock", held, true)
+	if resp := executeLine(k, "release shell-lock"); !strings.HasPrefix(resp, "OK") {
+		t.Error(resp)
+	}
+}
@@ -0,0 +1,152 @@
+package shell
+
+// Contains how command lines are split into arguments and how values are
+// written in them, so that commands can carry any bytes.
+//
+// Arguments are separated by spaces. Double quotes group words and take Go
+// escapes such as \n, \" and \x00; single quotes group words literally. A
+// value argument may be
+//
+//	hex:68656c6c6f     the bytes in hex
+//	base64:aGVsbG8=    the bytes in standard base64
+//	@path              the contents of a file
+//	text:@hello        the rest of the argument, as is
+//
+// and is otherwise taken as is. Commands that print a value take an optional
+// last argument to print it as hex or base64, or to write it to @path.
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+import (
+	"kademlia"
+)
+
+var errUnterminatedQuote = errors.New("unterminated quote")
+
+// Split line into arguments, as the shell does.
+func SplitLine(line string) ([]string, error) {
+	var toks []string
+	var tok strings.Builder
+	inTok := false
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == '"':
+			// Find the closing quote, skipping escaped ones.
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, errUnterminatedQuote
+			}
+			s, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, errors.New("bad quoted string " + line[i:j+1])
+			}
+			tok.WriteString(s)
+			inTok = true
+			i = j + 1
+		case c == '\'':
+			j := strings.IndexByte(line[i+1:], '\'')
+			if j < 0 {
+				return nil, errUnterminatedQuote
+			}
+			tok.WriteString(line[i+1 : i+1+j])
+			inTok = true
+			i += j + 2
+		case c < 0x80 && unicode.IsSpace(rune(c)):
+			if inTok {
+				toks = append(toks, tok.String())
+				tok.Reset()
+				inTok = false
+			}
+			i++
+		default:
+			tok.WriteByte(c)
+			inTok = true
+			i++
+		}
+	}
+	if inTok {
+		toks = append(toks, tok.String())
+	}
+	return toks, nil
+}
+
+// The bytes a value argument stands for.
+func parseValue(arg string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(arg, "hex:"):
+		value, err := hex.DecodeString(arg[len("hex:"):])
+		if err != nil {
+			return nil, errors.New("bad hex value")
+		}
+		return value, nil
+	case strings.HasPrefix(arg, "base64:"):
+		value, err := base64.StdEncoding.DecodeString(arg[len("base64:"):])
+		if err != nil {
+			return nil, errors.New("bad base64 value")
+		}
+		return value, nil
+	case strings.HasPrefix(arg, "@"):
+		return ioutil.ReadFile(arg[1:])
+	case strings.HasPrefix(arg, "text:"):
+		return []byte(arg[len("text:"):]), nil
+	}
+	return []byte(arg), nil
+}
+
+// What a cas command expects the nodes to hold: "none" for no value, a
+// version as timestamp@publisher, or "sha1:" and the hex hash of the value.
+func parseExpectation(arg string) (kademlia.Expectation, error) {
+	var ret kademlia.Expectation
+	switch {
+	case arg == "none":
+		return ret, nil
+	case strings.HasPrefix(arg, "sha1:"):
+		hash, err := hex.DecodeString(arg[len("sha1:"):])
+		if err != nil || len(hash) != len(kademlia.HashValue(nil)) {
+			return ret, errors.New("bad sha1 hash")
+		}
+		ret.Hash = hash
+		return ret, nil
+	}
+	version, err := kademlia.ParseVersion(arg)
+	ret.Version = version
+	return ret, err
+}
+
+// Whether arg is an output argument of a command that prints a value.
+func isOutput(arg string) bool {
+	return arg == "hex" || arg == "base64" || strings.HasPrefix(arg, "@")
+}
+
+// Print value as output asks: raw if it is "", in hex or base64, or to the
+// file at @path, in which case the result says so.
+func formatValue(value []byte, output string) (string, error) {
+	switch {
+	case output == "":
+		return string(value), nil
+	case output == "hex":
+		return hex.EncodeToString(value), nil
+	case output == "base64":
+		return base64.StdEncoding.EncodeToString(value), nil
+	case strings.HasPrefix(output, "@"):
+		if err := ioutil.WriteFile(output[1:], value, 0644); err != nil {
+			return "", err
+		}
+		return "wrote " + strconv.Itoa(len(value)) + " bytes to " + output[1:], nil
+	}
+	return "", errors.New("unknown output " + output + ", want hex, base64 or @path")
+}
@@ -0,0 +1,100 @@
+package shell
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		want []string
+		err  bool
+	}{
+		{"", nil, false},
+		{"   \t ", nil, false},
+		{"store  key\tvalue ", []string{"store", "key", "value"}, false},
+		{`put "a name" 'it''s'`, []string{"put", "a name", "its"}, false},
+		{`put "say \"hi\"\n" '\n'`, []string{"put", "say \"hi\"\n", `\n`}, false},
+		{`put "" ''`, []string{"put", "", ""}, false},
+		{`put ab"c d"e`, []string{"put", "abc de"}, false},
+		{`put "\x00\xff"`, []string{"put", "\x00\xff"}, false},
+		{`put "open`, nil, true},
+		{`put 'open`, nil, true},
+		{`put "bad \q"`, nil, true},
+	} {
+		got, err := SplitLine(test.line)
+		if (err != nil) != test.err || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, %v; want %q", test.line, got, err, test.want)
+		}
+	}
+
+	// What kademlia-ctl sends for its arguments.
+	args := []string{"put", "a b", `"'\`, "\x00\xff\n", ""}
+	var line string
+	for _, arg := range args {
+		line += strconv.Quote(arg) + " "
+	}
+	if got, err := SplitLine(line); err != nil || !reflect.DeepEqual(got, args) {
+		t.Errorf("%s: got %q, %v", line, got, err)
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "value")
+	if err := ioutil.WriteFile(path, []byte("from a file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		arg  string
+		want string
+		err  bool
+	}{
+		{"hello", "hello", false},
+		{"", "", false},
+		{"hex:68656c6c6f", "hello", false},
+		{"hex:", "", false},
+		{"hex:6", "", true},
+		{"hex:zz", "", true},
+		{"base64:aGVsbG8=", "hello", false},
+		{"base64:aGVsbG8", "", true},
+		{"@" + path, "from a file", false},
+		{"@" + path + ".missing", "", true},
+		{"text:@hello", "@hello", false},
+		{"text:hex:00", "hex:00", false},
+	} {
+		got, err := parseValue(test.arg)
+		if (err != nil) != test.err || string(got) != test.want {
+			t.Errorf("%q: got %q, %v; want %q", test.arg, got, err, test.want)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "value")
+	value := []byte("hi\x00")
+	for _, test := range []struct {
+		output string
+		want   string
+		err    bool
+	}{
+		{"", "hi\x00", false},
+		{"hex", "686900", false},
+		{"base64", "aGkA", false},
+		{"@" + path, "wrote 3 bytes to " + path, false},
+		{"@" + path + "/in/no/dir", "", true},
+		{"octal", "", true},
+	} {
+		got, err := formatValue(value, test.output)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("%q: got %q, %v; want %q", test.output, got, err, test.want)
+		}
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(data, value) {
+		t.Errorf("file holds %q, %v", data, err)
+	}
+}
@@ -0,0 +1,96 @@
+package simulator
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// A LatencyModel draws the one-way delay of a message from one node to
+// another.
+type LatencyModel interface {
+	Latency(from, to net.Addr, r *rand.Rand) time.Duration
+}
+
+// Every message takes the same time.
+type ConstantLatency time.Duration
+
+func (l ConstantLatency) Latency(from, to net.Addr, r *rand.Rand) time.Duration {
+	return time.Duration(l)
+}
+
+// Delays are uniformly distributed in [Min, Max).
+type UniformLatency struct {
+	Min, Max time.Duration
+}
+
+func (l UniformLatency) Latency(from, to net.Addr, r *rand.Rand) time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + time.Duration(r.Int63n(int64(l.Max-l.Min)))
+}
+
+// Delays are normally distributed, truncated at Min.
+type NormalLatency struct {
+	Mean, StdDev, Min time.Duration
+}
+
+func (l NormalLatency) Latency(from, to net.Addr, r *rand.Rand) time.Duration {
+	d := l.Mean + time.Duration(r.NormFloat64()*float64(l.StdDev))
+	if d < l.Min {
+		d = l.Min
+	}
+	return d
+}
+
+// Nodes sit at points of a unit square given by a hash of their addresses. A
+// message takes Base, plus PerUnit for each unit of distance between the two
+// nodes, plus up to Jitter. Unlike in the other models, the delay between two
+// nodes stays about the same from one message to the next, as proximity
+// neighbor selection expects.
+type CoordinateLatency struct {
+	Base, PerUnit, Jitter time.Duration
+}
+
+func (l CoordinateLatency) Latency(from, to net.Addr, r *rand.Rand) time.Duration {
+	x1, y1 := position(from)
+	x2, y2 := position(to)
+	d := l.Base + time.Duration(math.Hypot(x1-x2, y1-y2)*float64(l.PerUnit))
+	if l.Jitter > 0 {
+		d += time.Duration(r.Int63n(int64(l.Jitter)))
+	}
+	return d
+}
+
+// The point of the unit square where addr sits.
+func position(addr net.Addr) (x, y float64) {
+	h := fnv.New64a()
+	h.Write([]byte(addr.String()))
+	sum := h.Sum64()
+	return float64(sum>>32) / (1 << 32), float64(sum&0xffffffff) / (1 << 32)
+}
+
+// splitMix is a tiny rand.Source64 used to give every message its own
+// reproducible random stream without the cost of seeding math/rand.
+type splitMix struct {
+	state uint64
+}
+
+func (s *splitMix) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *splitMix) Seed(seed int64) {
+	s.state = uint64(seed)
+}
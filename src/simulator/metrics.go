@@ -0,0 +1,100 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Metrics collected over a run.
+type Metrics struct {
+	Lookups         int
+	LookupSuccesses int
+	// Number of lookups by hop count (rounds of queries).
+	Hops map[int]int
+	// Virtual duration of every lookup, in order.
+	LookupTimes []time.Duration
+	Samples     []Sample
+}
+
+// A snapshot of the network taken every Config.SampleInterval.
+type Sample struct {
+	Time  time.Duration
+	Nodes int
+	// Lookups since the previous sample.
+	Lookups         int
+	LookupSuccesses int
+	// Fraction of Vanish shares with at least one live replica.
+	ShareSurvival float64
+	// Fraction of VDOs that still have Threshold live shares.
+	VDOSurvival float64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{Hops: make(map[int]int)}
+}
+
+func (m *Metrics) SuccessRate() float64 {
+	if m.Lookups == 0 {
+		return 0
+	}
+	return float64(m.LookupSuccesses) / float64(m.Lookups)
+}
+
+func (m *Metrics) MeanHops() float64 {
+	if m.Lookups == 0 {
+		return 0
+	}
+	total := 0
+	for hops, n := range m.Hops {
+		total += hops * n
+	}
+	return float64(total) / float64(m.Lookups)
+}
+
+func (m *Metrics) MeanLookupTime() time.Duration {
+	if len(m.LookupTimes) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range m.LookupTimes {
+		total += d
+	}
+	return total / time.Duration(len(m.LookupTimes))
+}
+
+// The q-quantile (0 <= q <= 1) of lookup times.
+func (m *Metrics) LookupTimeQuantile(q float64) time.Duration {
+	if len(m.LookupTimes) == 0 {
+		return 0
+	}
+	times := make([]time.Duration, len(m.LookupTimes))
+	copy(times, m.LookupTimes)
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[int(q*float64(len(times)-1))]
+}
+
+// Print a human-readable summary.
+func (m *Metrics) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "lookups: %d  success rate: %.3f\n", m.Lookups, m.SuccessRate())
+	fmt.Fprintf(w, "hops: mean %.2f\n", m.MeanHops())
+	hops := make([]int, 0, len(m.Hops))
+	for h := range m.Hops {
+		hops = append(hops, h)
+	}
+	sort.Ints(hops)
+	for _, h := range hops {
+		fmt.Fprintf(w, "  %2d: %d\n", h, m.Hops[h])
+	}
+	fmt.Fprintf(w, "lookup time: mean %v  p50 %v  p99 %v\n",
+		m.MeanLookupTime(), m.LookupTimeQuantile(0.5), m.LookupTimeQuantile(0.99))
+	fmt.Fprintf(w, "%10s %7s %8s %8s %8s\n", "time", "nodes", "lookups", "shares", "vdos")
+	for _, s := range m.Samples {
+		rate := 0.0
+		if s.Lookups > 0 {
+			rate = float64(s.LookupSuccesses) / float64(s.Lookups)
+		}
+		fmt.Fprintf(w, "%10v %7d %8.3f %8.3f %8.3f\n", s.Time, s.Nodes, rate, s.ShareSurvival, s.VDOSurvival)
+	}
+}
@@ -0,0 +1,441 @@
+// Package simulator evaluates Kademlia at scale. It runs real kademlia.Kademlia
+// nodes over a kademlia.MemoryNetwork and drives them from a discrete-event
+// loop with a virtual clock: joins, leaves and lookups happen as Poisson
+// processes, messages get delays and losses from a seeded random source, and
+// each event runs to completion before the clock moves on. Two runs with the
+// same Config produce the same Metrics.
+//
+// Nodes tell time by the virtual clock too, through kademlia.Config.Now, so
+// signatures, liveness and expiry follow simulated time.
+//
+// Events take no virtual time themselves. The virtual duration of a lookup is
+// computed afterwards from the delays drawn for its queries: each round lasts
+// as long as its slowest reply, or RPCTimeout for a lost one.
+package simulator
+
+import (
+	"container/heap"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"kademlia"
+)
+
+var ErrDropped = errors.New("message lost")
+
+// The wall time the virtual clock starts at.
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type Config struct {
+	Seed int64
+	// Nodes in the network before the clock starts.
+	Nodes int
+	// Virtual time to simulate.
+	Duration time.Duration
+	Latency  LatencyModel
+	// Probability that any one call is lost.
+	LossRate float64
+	// Time a lost call takes to fail.
+	RPCTimeout time.Duration
+	// Mean joins, leaves and lookups per virtual second.
+	JoinRate   float64
+	LeaveRate  float64
+	LookupRate float64
+	// VDOs published at the start, each split into NumberKeys shares of
+	// which Threshold are needed to recover it.
+	VDOs       int
+	NumberKeys byte
+	Threshold  byte
+	// Time between samples.
+	SampleInterval time.Duration
+	// Node options. Identity, Transport, ManualMaintenance and Now are set
+	// by the simulator.
+	Node kademlia.Config
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Seed:           1,
+		Nodes:          10000,
+		Duration:       time.Hour,
+		Latency:        UniformLatency{10 * time.Millisecond, 100 * time.Millisecond},
+		RPCTimeout:     time.Second,
+		JoinRate:       0.1,
+		LeaveRate:      0.1,
+		LookupRate:     1,
+		VDOs:           10,
+		NumberKeys:     10,
+		Threshold:      5,
+		SampleInterval: 5 * time.Minute,
+		// Signatures cost most of the CPU time of a run and change nothing
+		// it measures.
+		Node: kademlia.Config{Unsigned: true, AllowUnsigned: true},
+	}
+}
+
+type Simulator struct {
+	conf    Config
+	rng     *rand.Rand
+	network *kademlia.MemoryNetwork
+	queue   eventQueue
+	// Number of events run so far; keys the randomness of each message.
+	seq      uint64
+	nodes    []*kademlia.Kademlia
+	byAddr   map[string]*kademlia.Kademlia
+	nextAddr int
+	vdos     [][]share
+	metrics  *Metrics
+	lastSamp Sample
+
+	// Shared with the network and the nodes, which use them from many
+	// goroutines.
+	mu      sync.Mutex
+	now     time.Duration
+	touched map[string]bool
+	rtt     map[linkKey]time.Duration
+	calls   map[callKey]int
+}
+
+type linkKey struct {
+	from, to string
+}
+
+type callKey struct {
+	linkKey
+	method string
+}
+
+// A Vanish share and the nodes it was stored on.
+type share struct {
+	key      kademlia.ID
+	replicas []string
+}
+
+func New(conf Config) *Simulator {
+	s := &Simulator{
+		conf:    conf,
+		rng:     rand.New(rand.NewSource(conf.Seed)),
+		network: kademlia.NewMemoryNetwork(),
+		byAddr:  make(map[string]*kademlia.Kademlia),
+		metrics: newMetrics(),
+		touched: make(map[string]bool),
+		rtt:     make(map[linkKey]time.Duration),
+		calls:   make(map[callKey]int),
+	}
+	if s.conf.Latency == nil {
+		s.conf.Latency = ConstantLatency(0)
+	}
+	s.network.Link = s.link
+	return s
+}
+
+// Run the simulation and return its metrics.
+func (s *Simulator) Run() *Metrics {
+	for i := 0; i < s.conf.Nodes; i++ {
+		s.step(s.join)
+	}
+	for i := 0; i < s.conf.VDOs; i++ {
+		s.step(s.publish)
+	}
+	s.schedule(0, evSample)
+	s.scheduleNext(evJoin, s.conf.JoinRate)
+	s.scheduleNext(evLeave, s.conf.LeaveRate)
+	s.scheduleNext(evLookup, s.conf.LookupRate)
+
+	for s.queue.Len() > 0 {
+		ev := heap.Pop(&s.queue).(*event)
+		if ev.at > s.conf.Duration {
+			break
+		}
+		s.mu.Lock()
+		s.now = ev.at
+		s.mu.Unlock()
+		switch ev.kind {
+		case evJoin:
+			s.step(s.join)
+			s.scheduleNext(evJoin, s.conf.JoinRate)
+		case evLeave:
+			s.step(s.leave)
+			s.scheduleNext(evLeave, s.conf.LeaveRate)
+		case evLookup:
+			s.step(s.lookup)
+			s.scheduleNext(evLookup, s.conf.LookupRate)
+		case evSample:
+			s.sample()
+			if s.conf.SampleInterval > 0 {
+				s.schedule(s.now+s.conf.SampleInterval, evSample)
+			}
+		}
+	}
+	return s.metrics
+}
+
+// The current virtual time as the nodes see it.
+func (s *Simulator) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Epoch.Add(s.now)
+}
+
+// The live nodes, in join order.
+func (s *Simulator) Nodes() []*kademlia.Kademlia {
+	return s.nodes
+}
+
+// Run one event to completion, including the routing table updates it sets
+// off in other nodes.
+func (s *Simulator) step(f func()) {
+	s.seq++
+	s.mu.Lock()
+	s.rtt = make(map[linkKey]time.Duration)
+	s.calls = make(map[callKey]int)
+	s.mu.Unlock()
+
+	f()
+
+	for {
+		s.mu.Lock()
+		touched := make([]string, 0, len(s.touched))
+		for addr := range s.touched {
+			touched = append(touched, addr)
+		}
+		s.touched = make(map[string]bool)
+		s.mu.Unlock()
+		if len(touched) == 0 {
+			return
+		}
+		sort.Strings(touched)
+		for _, addr := range touched {
+			// Routing table updates go through the node's handler goroutine,
+			// so once a read returns, all earlier updates are done.
+			if k := s.byAddr[addr]; k != nil {
+				k.ReadFromBuckets(0)
+				k.Maintain()
+			}
+		}
+	}
+}
+
+// Called by the network before every message.
+func (s *Simulator) link(from, to net.Addr, method string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := callKey{linkKey{from.String(), to.String()}, method}
+	n := s.calls[key]
+	s.calls[key]++
+	s.touched[key.from] = true
+	s.touched[key.to] = true
+
+	h := fnv.New64a()
+	h.Write([]byte(strconv.FormatInt(s.conf.Seed, 10) + " " + strconv.FormatUint(s.seq, 10) + " " +
+		key.from + " " + key.to + " " + method + " " + strconv.Itoa(n)))
+	r := rand.New(&splitMix{h.Sum64()})
+	if r.Float64() < s.conf.LossRate {
+		s.rtt[key.linkKey] = s.conf.RPCTimeout
+		return s.conf.RPCTimeout, ErrDropped
+	}
+	rtt := s.conf.Latency.Latency(from, to, r) + s.conf.Latency.Latency(to, from, r)
+	s.rtt[key.linkKey] = rtt
+	return rtt, nil
+}
+
+func (s *Simulator) newNode() *kademlia.Kademlia {
+	ident, err := kademlia.NewIdentity(s.rng)
+	if err != nil {
+		panic(err)
+	}
+	n := s.nextAddr
+	s.nextAddr++
+	ip := net.IPv4(10, byte(n>>16), byte(n>>8), byte(n))
+	conf := s.conf.Node
+	conf.Identity = ident
+	conf.Transport = s.network.Transport()
+	conf.ManualMaintenance = true
+	conf.Now = s.Now
+	k := kademlia.NewKademliaWithConfig(kademlia.Dest(ip, 4000), conf)
+	s.byAddr[kademlia.Dest(ip, 4000)] = k
+	return k
+}
+
+func (s *Simulator) randomNode() *kademlia.Kademlia {
+	return s.nodes[s.rng.Intn(len(s.nodes))]
+}
+
+// A new node pings a random live node and looks itself up.
+func (s *Simulator) join() {
+	k := s.newNode()
+	if len(s.nodes) > 0 {
+		seed := s.randomNode().Routes.Self()
+		k.DoPing(seed.Host, seed.Port)
+		// Wait for the seed to reach the routing table.
+		k.ReadFromBuckets(0)
+		k.IterativeFindNode(k.NodeID, false)
+	}
+	s.nodes = append(s.nodes, k)
+}
+
+// A random node leaves, taking its data with it.
+func (s *Simulator) leave() {
+	if len(s.nodes) <= 1 {
+		return
+	}
+	i := s.rng.Intn(len(s.nodes))
+	k := s.nodes[i]
+	k.Close()
+	delete(s.byAddr, kademlia.Dest(k.Routes.Self().Host, k.Routes.Self().Port))
+	s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+}
+
+// A random node looks up another random node.
+func (s *Simulator) lookup() {
+	if len(s.nodes) < 2 {
+		return
+	}
+	src := s.randomNode()
+	dst := s.randomNode()
+	for dst == src {
+		dst = s.randomNode()
+	}
+	res := src.IterativeFindNode(dst.NodeID, false)
+
+	s.metrics.Lookups++
+	for _, c := range res.Contacts() {
+		if c.NodeID == dst.NodeID {
+			s.metrics.LookupSuccesses++
+			break
+		}
+	}
+	s.metrics.Hops[len(res.Rounds())]++
+	s.metrics.LookupTimes = append(s.metrics.LookupTimes, s.lookupTime(src, res))
+}
+
+func (s *Simulator) lookupTime(src *kademlia.Kademlia, res *kademlia.IterativeResult) (total time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := kademlia.Dest(src.Routes.Self().Host, src.Routes.Self().Port)
+	for _, round := range res.Rounds() {
+		var slowest time.Duration
+		for _, c := range round {
+			d, ok := s.rtt[linkKey{from, kademlia.Dest(c.Host, c.Port)}]
+			if !ok {
+				// Never delivered: the node is gone.
+				d = s.conf.RPCTimeout
+			}
+			if d > slowest {
+				slowest = d
+			}
+		}
+		total += slowest
+	}
+	return
+}
+
+// A random node stores the shares of a VDO at the K closest nodes to each
+// share's location, as Vanish does.
+func (s *Simulator) publish() {
+	src := s.randomNode()
+	locations := kademlia.CalculateSharedKeyLocations(s.rng.Int63(), int64(s.conf.NumberKeys))
+	shares := make([]share, 0, len(locations))
+	for i, key := range locations {
+		value := []byte{byte(i + 1)}
+		sh := share{key: key}
+		for _, c := range src.IterativeFindNode(key, false).Contacts() {
+			c := c
+			if resp := src.DoStore(&c, key, value); strings.HasPrefix(resp, "OK") {
+				sh.replicas = append(sh.replicas, kademlia.Dest(c.Host, c.Port))
+			}
+		}
+		shares = append(shares, sh)
+	}
+	s.vdos = append(s.vdos, shares)
+}
+
+func (s *Simulator) sample() {
+	smp := Sample{
+		Time:            s.now,
+		Nodes:           len(s.nodes),
+		Lookups:         s.metrics.Lookups - s.lastSamp.Lookups,
+		LookupSuccesses: s.metrics.LookupSuccesses - s.lastSamp.LookupSuccesses,
+	}
+	total, alive, vdosAlive := 0, 0, 0
+	for _, shares := range s.vdos {
+		n := 0
+		for _, sh := range shares {
+			for _, addr := range sh.replicas {
+				if s.byAddr[addr] != nil {
+					n++
+					break
+				}
+			}
+		}
+		total += len(shares)
+		alive += n
+		if n >= int(s.conf.Threshold) {
+			vdosAlive++
+		}
+	}
+	if total > 0 {
+		smp.ShareSurvival = float64(alive) / float64(total)
+		smp.VDOSurvival = float64(vdosAlive) / float64(len(s.vdos))
+	}
+	s.metrics.Samples = append(s.metrics.Samples, smp)
+	s.lastSamp = Sample{Lookups: s.metrics.Lookups, LookupSuccesses: s.metrics.LookupSuccesses}
+}
+
+const (
+	evJoin = iota
+	evLeave
+	evLookup
+	evSample
+)
+
+type event struct {
+	at   time.Duration
+	seq  int
+	kind int
+}
+
+func (s *Simulator) schedule(at time.Duration, kind int) {
+	heap.Push(&s.queue, &event{at, s.queue.pushed, kind})
+	s.queue.pushed++
+}
+
+// Schedule the next event of a Poisson process with the given rate per
+// virtual second.
+func (s *Simulator) scheduleNext(kind int, rate float64) {
+	if rate <= 0 {
+		return
+	}
+	gap := time.Duration(s.rng.ExpFloat64() / rate * float64(time.Second))
+	s.schedule(s.now+gap, kind)
+}
+
+// A min-heap of events by time, ties broken by scheduling order.
+type eventQueue struct {
+	events []*event
+	pushed int
+}
+
+func (q *eventQueue) Len() int { return len(q.events) }
+func (q *eventQueue) Less(i, j int) bool {
+	if q.events[i].at != q.events[j].at {
+		return q.events[i].at < q.events[j].at
+	}
+	return q.events[i].seq < q.events[j].seq
+}
+func (q *eventQueue) Swap(i, j int)      { q.events[i], q.events[j] = q.events[j], q.events[i] }
+func (q *eventQueue) Push(x interface{}) { q.events = append(q.events, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	ev := q.events[len(q.events)-1]
+	q.events = q.events[:len(q.events)-1]
+	return ev
+}
@@ -0,0 +1,128 @@
+package simulator
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func smallConfig() Config {
+	conf := DefaultConfig()
+	conf.Nodes = 150
+	conf.Duration = 10 * time.Minute
+	conf.SampleInterval = 2 * time.Minute
+	conf.JoinRate = 0.02
+	conf.LeaveRate = 0.05
+	conf.LookupRate = 0.2
+	conf.VDOs = 3
+	return conf
+}
+
+func TestLookupsSucceed(t *testing.T) {
+	conf := smallConfig()
+	conf.JoinRate = 0
+	conf.LeaveRate = 0
+	m := New(conf).Run()
+	if m.Lookups == 0 {
+		t.Fatal("no lookups run")
+	}
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("lookup success rate %.3f without churn", m.SuccessRate())
+	}
+	for _, s := range m.Samples {
+		if s.ShareSurvival != 1 || s.VDOSurvival != 1 {
+			t.Errorf("shares lost without churn: %+v", s)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	conf := smallConfig()
+	conf.LossRate = 0.05
+	m1 := New(conf).Run()
+	m2 := New(conf).Run()
+	if !reflect.DeepEqual(m1, m2) {
+		t.Errorf("runs with the same seed differ:\n%+v\n%+v", m1, m2)
+	}
+
+	conf.Seed++
+	m3 := New(conf).Run()
+	if reflect.DeepEqual(m1.LookupTimes, m3.LookupTimes) {
+		t.Error("runs with different seeds are identical")
+	}
+}
+
+func TestChurnLosesShares(t *testing.T) {
+	conf := smallConfig()
+	conf.LeaveRate = 0.25
+	conf.JoinRate = 0
+	m := New(conf).Run()
+	last := m.Samples[len(m.Samples)-1]
+	if last.ShareSurvival >= 1 {
+		t.Errorf("no shares lost with %d nodes leaving", int(conf.LeaveRate*conf.Duration.Seconds()))
+	}
+}
+
+func TestProximityShortensLookups(t *testing.T) {
+	conf := smallConfig()
+	conf.JoinRate = 0
+	conf.LeaveRate = 0
+	conf.LookupRate = 1
+	conf.VDOs = 0
+	conf.Latency = CoordinateLatency{Base: 5 * time.Millisecond, PerUnit: 200 * time.Millisecond, Jitter: 5 * time.Millisecond}
+	plain := New(conf).Run()
+	conf.Node.Proximity = true
+	pns := New(conf).Run()
+
+	if pns.SuccessRate() < plain.SuccessRate() || pns.SuccessRate() < 0.95 {
+		t.Errorf("lookup success rate %.3f with proximity, %.3f without", pns.SuccessRate(), plain.SuccessRate())
+	}
+	if pns.MeanHops() > plain.MeanHops() {
+		t.Errorf("%.2f hops per lookup with proximity, %.2f without", pns.MeanHops(), plain.MeanHops())
+	}
+	if pns.MeanLookupTime() >= plain.MeanLookupTime() {
+		t.Errorf("mean lookup time %v with proximity, %v without", pns.MeanLookupTime(), plain.MeanLookupTime())
+	}
+}
+
+func TestNodesUseVirtualClock(t *testing.T) {
+	conf := smallConfig()
+	conf.Nodes = 20
+	conf.LeaveRate = 0
+	sim := New(conf)
+	sim.Run()
+	end := Epoch.Add(conf.Duration)
+	if now := sim.Now(); now.After(end) || now.Before(Epoch) {
+		t.Fatalf("virtual clock at %v", now)
+	}
+	last := sim.Nodes()[len(sim.Nodes())-1]
+	seen := 0
+	for _, k := range sim.Nodes() {
+		if l, ok := k.Routes.Liveness(last.NodeID); ok {
+			seen++
+			if l.LastSeen.Before(Epoch) || l.LastSeen.After(end) {
+				t.Errorf("contact last seen at %v, outside the simulated %v to %v", l.LastSeen, Epoch, end)
+			}
+		}
+	}
+	if seen == 0 {
+		t.Error("the last node to join is in no routing table")
+	}
+}
+
+// The scale the simulator is for. Run with -bench TenThousand -benchtime 1x.
+func BenchmarkTenThousandNodes(b *testing.B) {
+	conf := DefaultConfig()
+	conf.Duration = 10 * time.Minute
+	conf.JoinRate = 0
+	conf.LeaveRate = 0
+	conf.LookupRate = 0.2
+	for i := 0; i < b.N; i++ {
+		m := New(conf).Run()
+		if m.SuccessRate() < 0.95 {
+			b.Errorf("lookup success rate %.3f across %d nodes", m.SuccessRate(), conf.Nodes)
+		}
+		b.ReportMetric(m.MeanHops(), "hops/lookup")
+		b.ReportMetric(m.SuccessRate(), "success")
+	}
+}